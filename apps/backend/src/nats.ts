@@ -1,4 +1,4 @@
-import { connect, StringCodec, NatsError } from "nats"
+import { connect, StringCodec, NatsError, RetentionPolicy } from "nats"
 import type { NatsConnection, JetStreamClient, JetStreamManager } from "nats"
 import type { FastifyBaseLogger } from "fastify"
 import { prisma } from "@nasx/database"
@@ -11,8 +11,11 @@ let js: JetStreamClient
 
 // ── Stream definition ─────────────────────────────────────────────────────────
 
+// The retention has to be the worker's: it can't be changed on an existing
+// stream, so the worker couldn't bring a stream created here up to date.
 const TASK_STREAM = {
   name: "NASX_TASKS",
+  retention: RetentionPolicy.Workqueue,
   subjects: [
     "nasx.root.fs.mkdir",
     "nasx.root.fs.copy",
@@ -57,14 +60,16 @@ export async function connectNats(): Promise<void> {
   }
   js = nc.jetstream()
 
-  // Ensure the task stream exists (idempotent — worker does the same).
+  // Ensure the task stream exists so jobs published before the worker's first
+  // start are kept. The worker owns its configuration (subjects, limits,
+  // dedupe window, all set from its environment) and brings it up to date
+  // itself, so an existing stream is left alone: updating it with this
+  // minimal config would reset those.
   const jsm: JetStreamManager = await nc.jetstreamManager()
   try {
     await jsm.streams.add(TASK_STREAM as any)
   } catch (e: any) {
-    if (e instanceof NatsError && e.message.includes("stream name already in use")) {
-      await jsm.streams.update("NASX_TASKS", TASK_STREAM as any)
-    } else {
+    if (!(e instanceof NatsError && e.message.includes("stream name already in use"))) {
       throw e
     }
   }
@@ -96,8 +101,12 @@ export async function publishJob(
     data: { id: jobId, status: "pending", action, userId },
   })
 
-  const subject = `nasx.root.${action}`
-  await js.publish(subject, sc.encode(JSON.stringify({ jobId, ...payload })))
+  // msgID sets Nats-Msg-Id, so JetStream drops a duplicate publish of the
+  // same job within the stream's dedup window. createdAt lets the worker
+  // refuse a task that sat in the stream too long (NASX_MAX_TASK_AGE_SECONDS).
+  const subject   = `nasx.root.${action}`
+  const createdAt = new Date().toISOString()
+  await js.publish(subject, sc.encode(JSON.stringify({ jobId, createdAt, ...payload })), { msgID: jobId })
 
   return jobId
 }
@@ -182,7 +191,54 @@ type JobEvent = {
   error?:  string
 }
 
+// Progress of running tasks arrives on its own subject. It moves the job to
+// "running" and is kept in memory for tasks.get, never written to result.
+export type JobProgress = {
+  bytesDone:  number
+  bytesTotal: number
+  itemsDone?: number
+}
+
+type ProgressEvent = {
+  jobId:    string
+  progress: JobProgress
+}
+
+const jobProgress = new Map<string, JobProgress>()
+
+export function getJobProgress(jobId: string): JobProgress | null {
+  return jobProgress.get(jobId) ?? null
+}
+
+async function startProgressSubscriber(log: FastifyBaseLogger): Promise<void> {
+  const sub = nc.subscribe("nasx.events.progress.*")
+
+  for await (const msg of sub) {
+    try {
+      let event: ProgressEvent
+      try {
+        event = JSON.parse(sc.decode(msg.data)) as ProgressEvent
+      } catch {
+        log.warn("nats: progress subscriber received invalid JSON, skipping message")
+        continue
+      }
+      if (!event.jobId || !event.progress) continue
+      const first = !jobProgress.has(event.jobId)
+      jobProgress.set(event.jobId, event.progress)
+      if (first) {
+        await prisma.job.updateMany({
+          where: { id: event.jobId, status: "pending" },
+          data:  { status: "running" },
+        })
+      }
+    } catch (e) {
+      log.error(e, "nats: progress subscriber error")
+    }
+  }
+}
+
 export async function startEventSubscriber(log: FastifyBaseLogger): Promise<void> {
+  void startProgressSubscriber(log).catch(err => log.error(err, "nats: progress subscriber stopped"))
   const sub = nc.subscribe("nasx.events.job.*")
 
   for await (const msg of sub) {
@@ -198,6 +254,7 @@ export async function startEventSubscriber(log: FastifyBaseLogger): Promise<void
         log.warn("nats: event subscriber received message without jobId, skipping")
         continue
       }
+      jobProgress.delete(event.jobId)
       await prisma.job.update({
         where: { id: event.jobId },
         data: {
@@ -63,7 +63,7 @@ export async function fileRoutes(app: FastifyInstance) {
   // Clean up uploads that have been silent for more than 2 h.
   startUploadGc((id, state) => {
     app.log.warn({ uploadId: id }, "Stale upload evicted by GC")
-    publishJob("fs.delete", { linuxUsername: state.linuxUser, path: state.stagingDir })
+    publishJob("fs.delete", { linuxUsername: state.linuxUser, path: state.stagingDir, force: true })
       .catch(err => app.log.error(err, "Failed to clean up stale upload staging dir"))
   })
 
@@ -222,7 +222,7 @@ export async function fileRoutes(app: FastifyInstance) {
 
     publishJob(
       "fs.delete",
-      { linuxUsername: state.linuxUser, path: state.stagingDir },
+      { linuxUsername: state.linuxUser, path: state.stagingDir, force: true },
     ).catch(err => app.log.error(err, "Failed to clean up upload staging dir on cancel"))
 
     return reply.send({ ok: true })
@@ -61,7 +61,13 @@ function mapWorkerError(e: any): TRPCError {
 
 // ── list (sync, request-reply) ────────────────────────────────────────────────
 
-type FsEntry = { name: string; path: string; type: "dir" | "file"; size: number | null; mtime: string }
+// A symlink's targetType says what it leads to; it sorts and opens as that.
+type FsEntry = {
+  name: string; path: string; type: "dir" | "file" | "symlink"; targetType?: "dir" | "file"
+  size: number | null; mtime: string
+}
+
+const isDir = (e: FsEntry) => e.type === "dir" || e.targetType === "dir"
 
 async function listAsProcess(dirPath: string): Promise<FsEntry[]> {
   const names = await readdir(dirPath)
@@ -84,7 +90,7 @@ async function listAsProcess(dirPath: string): Promise<FsEntry[]> {
 
 function sortEntries(entries: FsEntry[]): FsEntry[] {
   return entries.sort((a, b) => {
-    if (a.type !== b.type) return a.type === "dir" ? -1 : 1
+    if (isDir(a) !== isDir(b)) return isDir(a) ? -1 : 1
     return a.name.localeCompare(b.name, undefined, { sensitivity: "base" })
   })
 }
@@ -187,13 +193,30 @@ export const fsRouter = router({
     }),
 
   // ── delete (async) ───────────────────────────────────────────────────────────
+  // The worker only removes a non-empty folder with force. Without it, a
+  // non-empty folder is refused here with PRECONDITION_FAILED so the UI can
+  // confirm and resend with force: true, instead of the job failing later.
   delete: protectedProcedure
-    .input(z.object({ path: z.string() }))
+    .input(z.object({ path: z.string(), force: z.boolean().optional() }))
     .mutation(async ({ ctx, input }) => {
       const p = normalize(input.path)
       await checkPathPerm(ctx, p, "canDelete")
       const linuxUser = await getLinuxUser(ctx)
-      const jobId = await publishJob("fs.delete", { linuxUsername: linuxUser ?? "", path: p }, ctx.user.userId)
+      if (!input.force) {
+        let items = 0
+        try {
+          const st = await requestSync<{ type: string }>("nasx.root.fs.stat", { path: p, linuxUsername: linuxUser ?? "" })
+          if (st.type === "dir") {
+            items = (await requestSync<{ total: number }>("nasx.root.fs.count", { path: p, linuxUsername: linuxUser ?? "" })).total
+          }
+        } catch {
+          // Let the job report it.
+        }
+        if (items > 0) {
+          throw new TRPCError({ code: "PRECONDITION_FAILED", message: `ENOTEMPTY: folder contains ${items} item(s)` })
+        }
+      }
+      const jobId = await publishJob("fs.delete", { linuxUsername: linuxUser ?? "", path: p, force: !!input.force }, ctx.user.userId)
       return { jobId }
     }),
 
@@ -1,6 +1,7 @@
 import { z } from "zod"
 import { TRPCError } from "@trpc/server"
 import { router, protectedProcedure } from "../index"
+import { getJobProgress } from "../../nats"
 
 export const tasksRouter = router({
   get: protectedProcedure
@@ -9,11 +10,12 @@ export const tasksRouter = router({
       const job = await ctx.prisma.job.findUnique({ where: { id: input.jobId } })
       if (!job) throw new TRPCError({ code: "NOT_FOUND", message: "Job not found" })
       return {
-        id:     job.id,
-        status: job.status as "pending" | "running" | "completed" | "failed",
-        action: job.action,
-        result: job.result ? (() => { try { return JSON.parse(job.result!) } catch { return null } })() : null,
-        error:  job.error ?? null,
+        id:       job.id,
+        status:   job.status as "pending" | "running" | "completed" | "failed",
+        action:   job.action,
+        result:   job.result ? (() => { try { return JSON.parse(job.result!) } catch { return null } })() : null,
+        error:    job.error ?? null,
+        progress: getJobProgress(job.id),
       }
     }),
 })
@@ -0,0 +1,19 @@
+// A directory listing entry as the worker reports it. A symlink's targetType
+// says what it leads to (unset for a broken link), so that a linked folder
+// still opens as a folder and a linked file downloads as a file.
+export type Entry = {
+  name: string
+  path: string
+  type: 'dir' | 'file' | 'symlink'
+  targetType?: 'dir' | 'file'
+  size: number | null
+  mtime: string
+}
+
+export function isDir(e: Entry): boolean {
+  return e.type === 'dir' || e.targetType === 'dir'
+}
+
+export function isFile(e: Entry): boolean {
+  return e.type === 'file' || e.targetType === 'file'
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"syscall"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ── POSIX ACL xattr format ────────────────────────────────────────────────────
+//
+// The kernel stores ACLs in the system.posix_acl_access xattr as a 4-byte
+// version header (2) followed by 8-byte little-endian entries:
+// {tag u16, perm u16, id u32}. Entries must be sorted by tag, then id.
+
+const (
+	xattrAclAccess  = "system.posix_acl_access"
+	xattrAclDefault = "system.posix_acl_default" // directories only: inherited by new entries
+
+	aclVersion     = 2
+	aclUndefinedID = 0xFFFFFFFF
+
+	aclTagUserObj  = 0x01
+	aclTagUser     = 0x02
+	aclTagGroupObj = 0x04
+	aclTagGroup    = 0x08
+	aclTagMask     = 0x10
+	aclTagOther    = 0x20
+)
+
+// aclEntry is the JSON form of a single ACL entry, modelled on getfacl output:
+// "user::rw-" is {tag:"user", perms:"rw-"} and "group:staff:r-x" is
+// {tag:"group", qualifier:"staff", perms:"r-x"}.
+type aclEntry struct {
+	Tag       string `json:"tag"`                 // user | group | mask | other
+	Qualifier string `json:"qualifier,omitempty"` // user/group name or numeric id; empty for owner/owning group
+	ID        *int   `json:"id,omitempty"`
+	Perms     string `json:"perms"` // e.g. "rwx", "r-x"
+}
+
+type aclResult struct {
+	Entries []aclEntry `json:"entries"`
+	// Extended is false when the file has no ACL xattr and Entries were
+	// synthesized from the base mode bits (as getfacl does).
+	Extended bool `json:"extended"`
+}
+
+type rawAclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+func permString(p uint16) string {
+	b := []byte("---")
+	if p&4 != 0 {
+		b[0] = 'r'
+	}
+	if p&2 != 0 {
+		b[1] = 'w'
+	}
+	if p&1 != 0 {
+		b[2] = 'x'
+	}
+	return string(b)
+}
+
+func parsePerms(s string) (uint16, error) {
+	var p uint16
+	for _, c := range s {
+		switch c {
+		case 'r':
+			p |= 4
+		case 'w':
+			p |= 2
+		case 'x':
+			p |= 1
+		case '-':
+		default:
+			return 0, fmt.Errorf("invalid permission %q", s)
+		}
+	}
+	return p, nil
+}
+
+func decodeAcl(data []byte) ([]rawAclEntry, error) {
+	if len(data) < 4 || (len(data)-4)%8 != 0 {
+		return nil, fmt.Errorf("malformed acl xattr")
+	}
+	if v := binary.LittleEndian.Uint32(data[:4]); v != aclVersion {
+		return nil, fmt.Errorf("unsupported acl version %d", v)
+	}
+	entries := make([]rawAclEntry, 0, (len(data)-4)/8)
+	for off := 4; off < len(data); off += 8 {
+		entries = append(entries, rawAclEntry{
+			tag:  binary.LittleEndian.Uint16(data[off:]),
+			perm: binary.LittleEndian.Uint16(data[off+2:]),
+			id:   binary.LittleEndian.Uint32(data[off+4:]),
+		})
+	}
+	return entries, nil
+}
+
+func encodeAcl(entries []rawAclEntry) []byte {
+	data := make([]byte, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(data, aclVersion)
+	for i, e := range entries {
+		off := 4 + 8*i
+		binary.LittleEndian.PutUint16(data[off:], e.tag)
+		binary.LittleEndian.PutUint16(data[off+2:], e.perm)
+		binary.LittleEndian.PutUint32(data[off+4:], e.id)
+	}
+	return data
+}
+
+// synthesizeAcl builds the minimal three-entry ACL equivalent to mode.
+func synthesizeAcl(mode uint32) []rawAclEntry {
+	return []rawAclEntry{
+		{tag: aclTagUserObj, perm: uint16(mode>>6) & 7, id: aclUndefinedID},
+		{tag: aclTagGroupObj, perm: uint16(mode>>3) & 7, id: aclUndefinedID},
+		{tag: aclTagOther, perm: uint16(mode) & 7, id: aclUndefinedID},
+	}
+}
+
+func toAclEntry(e rawAclEntry) aclEntry {
+	out := aclEntry{Perms: permString(e.perm)}
+	switch e.tag {
+	case aclTagUserObj, aclTagUser:
+		out.Tag = "user"
+	case aclTagGroupObj, aclTagGroup:
+		out.Tag = "group"
+	case aclTagMask:
+		out.Tag = "mask"
+	case aclTagOther:
+		out.Tag = "other"
+	}
+	if e.tag == aclTagUser || e.tag == aclTagGroup {
+		id := int(e.id)
+		out.ID = &id
+		out.Qualifier = strconv.Itoa(id)
+		if e.tag == aclTagUser {
+			if u, err := user.LookupId(out.Qualifier); err == nil {
+				out.Qualifier = u.Username
+			}
+		} else if g, err := user.LookupGroupId(out.Qualifier); err == nil {
+			out.Qualifier = g.Name
+		}
+	}
+	return out
+}
+
+// resolveAclEntries validates entries and converts them to the kernel format.
+// A missing mask is computed as the union of the group-class permissions, as
+// setfacl does.
+func resolveAclEntries(entries []aclEntry) ([]rawAclEntry, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("acl: no entries")
+	}
+	raw := make([]rawAclEntry, 0, len(entries)+1)
+	seen := map[[2]uint32]bool{}
+	hasMask, named := false, false
+	var groupClass uint16
+	for _, e := range entries {
+		perm, err := parsePerms(e.Perms)
+		if err != nil {
+			return nil, fmt.Errorf("acl: %w", err)
+		}
+		r := rawAclEntry{perm: perm, id: aclUndefinedID}
+		qualified := e.Qualifier != "" || e.ID != nil
+		switch e.Tag {
+		case "user":
+			r.tag = aclTagUserObj
+			if qualified {
+				r.tag = aclTagUser
+				uid, err := aclQualifierID(e, lookupUid)
+				if err != nil {
+					return nil, err
+				}
+				r.id = uid
+			}
+		case "group":
+			r.tag = aclTagGroupObj
+			if qualified {
+				r.tag = aclTagGroup
+				gid, err := aclQualifierID(e, lookupGid)
+				if err != nil {
+					return nil, err
+				}
+				r.id = gid
+			}
+		case "mask":
+			r.tag = aclTagMask
+			hasMask = true
+		case "other":
+			r.tag = aclTagOther
+		default:
+			return nil, fmt.Errorf("acl: invalid tag %q", e.Tag)
+		}
+		if r.tag != aclTagUser && r.tag != aclTagGroup && qualified {
+			return nil, fmt.Errorf("acl: %s entry cannot have a qualifier", e.Tag)
+		}
+		key := [2]uint32{uint32(r.tag), r.id}
+		if seen[key] {
+			return nil, fmt.Errorf("acl: duplicate %s entry", e.Tag)
+		}
+		seen[key] = true
+		if r.tag == aclTagUser || r.tag == aclTagGroup {
+			named = true
+		}
+		if r.tag == aclTagUser || r.tag == aclTagGroup || r.tag == aclTagGroupObj {
+			groupClass |= perm
+		}
+		raw = append(raw, r)
+	}
+	for _, tag := range []uint16{aclTagUserObj, aclTagGroupObj, aclTagOther} {
+		if !seen[[2]uint32{uint32(tag), aclUndefinedID}] {
+			return nil, fmt.Errorf("acl: missing required user::, group:: or other:: entry")
+		}
+	}
+	if named && !hasMask {
+		raw = append(raw, rawAclEntry{tag: aclTagMask, perm: groupClass, id: aclUndefinedID})
+	}
+	sort.Slice(raw, func(i, j int) bool {
+		if raw[i].tag != raw[j].tag {
+			return raw[i].tag < raw[j].tag
+		}
+		return raw[i].id < raw[j].id
+	})
+	return raw, nil
+}
+
+func aclQualifierID(e aclEntry, lookup func(string) (int, error)) (uint32, error) {
+	if e.ID != nil {
+		if err := checkID(*e.ID); err != nil {
+			return 0, fmt.Errorf("acl: %w", err)
+		}
+		return uint32(*e.ID), nil
+	}
+	id, err := lookup(e.Qualifier)
+	if err != nil {
+		return 0, fmt.Errorf("acl: %w", err)
+	}
+	return uint32(id), nil
+}
+
+// checkID refuses what can't be a uid or gid: a negative number, one that
+// doesn't fit 32 bits, or 2^32-1, which is (uid_t)-1, "no change" to chown
+// and aclUndefinedID in an ACL.
+func checkID(n int) error {
+	if n < 0 || int64(n) >= aclUndefinedID {
+		return fmt.Errorf("invalid id %d: must be 0 to %d", n, aclUndefinedID-1)
+	}
+	return nil
+}
+
+// lookupUid resolves a username or numeric uid string.
+func lookupUid(name string) (int, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		if err := checkID(n); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown user %q", name)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGid resolves a group name or numeric gid string.
+func lookupGid(name string) (int, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		if err := checkID(n); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %q", name)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// getxattr reads an xattr, growing the buffer as needed.
+func getxattr(path, name string) ([]byte, error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := syscall.Getxattr(path, name, buf)
+		if err == syscall.ERANGE {
+			sz, err := syscall.Getxattr(path, name, nil)
+			if err != nil {
+				return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+			}
+			buf = make([]byte, sz)
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		return buf[:n], nil
+	}
+}
+
+func isNoData(err error) bool {
+	var pathErr *os.PathError
+	return errors.As(err, &pathErr) && pathErr.Err == syscall.ENODATA
+}
+
+// isNoAcl reports whether a getxattr of an ACL failed because there is none:
+// the file has no ACL, or its filesystem (procfs, some FUSE mounts) doesn't
+// support them, where the mode bits are all there is. Only a set reports
+// EUNSUPPORTED.
+func isNoAcl(err error) bool {
+	var pathErr *os.PathError
+	return isNoData(err) || errors.As(err, &pathErr) && pathErr.Err == syscall.EOPNOTSUPP
+}
+
+// ── getfacl / setfacl ─────────────────────────────────────────────────────────
+
+func doGetFacl(path string) (*aclResult, *fsError) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	data, err := getxattr(path, xattrAclAccess)
+	var raw []rawAclEntry
+	extended := true
+	switch {
+	case err == nil:
+		if raw, err = decodeAcl(data); err != nil {
+			return nil, &fsError{Code: "ERR", Message: err.Error()}
+		}
+	case isNoAcl(err):
+		raw = synthesizeAcl(info.Sys().(*syscall.Stat_t).Mode)
+		extended = false
+	default:
+		return nil, mapOsErr(err)
+	}
+	entries := make([]aclEntry, 0, len(raw))
+	for _, e := range raw {
+		entries = append(entries, toAclEntry(e))
+	}
+	return &aclResult{Entries: entries, Extended: extended}, nil
+}
+
+func doSetFacl(path string, entries []aclEntry) *fsError {
+	raw, err := resolveAclEntries(entries)
+	if err != nil {
+		return &fsError{Code: "ERR", Message: err.Error()}
+	}
+	if err := syscall.Setxattr(path, xattrAclAccess, encodeAcl(raw), 0); err != nil {
+		if err == syscall.EOPNOTSUPP {
+			return &fsError{Code: "EUNSUPPORTED", Message: "filesystem does not support ACLs"}
+		}
+		return mapOsErr(&os.PathError{Op: "setxattr", Path: path, Err: err})
+	}
+	return nil
+}
+
+// ── default ACL ───────────────────────────────────────────────────────────────
+//
+// A directory's default ACL is copied to everything created in it (and, as
+// its default ACL, to new subdirectories), so a share can grant a group
+// access to files no matter who creates them. It is in the same format as
+// the access ACL, in its own xattr.
+
+var errNotDir = &fsError{Code: "ENOTDIR", Message: "default ACLs can only be set on directories"}
+
+// doGetDefaultAcl returns dir's default ACL. Unlike doGetFacl nothing is
+// synthesized: a directory without one has no entries and Extended false.
+func doGetDefaultAcl(dir string) (*aclResult, *fsError) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if !info.IsDir() {
+		return nil, errNotDir
+	}
+	data, err := getxattr(dir, xattrAclDefault)
+	if isNoAcl(err) {
+		return &aclResult{Entries: []aclEntry{}}, nil
+	}
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	raw, err := decodeAcl(data)
+	if err != nil {
+		return nil, &fsError{Code: "ERR", Message: err.Error()}
+	}
+	entries := make([]aclEntry, 0, len(raw))
+	for _, e := range raw {
+		entries = append(entries, toAclEntry(e))
+	}
+	return &aclResult{Entries: entries, Extended: true}, nil
+}
+
+// doSetDefaultAcl replaces dir's default ACL; no entries removes it, like
+// setfacl -k.
+func doSetDefaultAcl(dir string, entries []aclEntry) *fsError {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return mapOsErr(err)
+	}
+	if !info.IsDir() {
+		return errNotDir
+	}
+	if len(entries) == 0 {
+		if err := syscall.Removexattr(dir, xattrAclDefault); err != nil && err != syscall.ENODATA {
+			return mapOsErr(&os.PathError{Op: "removexattr", Path: dir, Err: err})
+		}
+		return nil
+	}
+	raw, err := resolveAclEntries(entries)
+	if err != nil {
+		return &fsError{Code: "ERR", Message: err.Error()}
+	}
+	if err := syscall.Setxattr(dir, xattrAclDefault, encodeAcl(raw), 0); err != nil {
+		if err == syscall.EOPNOTSUPP {
+			return &fsError{Code: "EUNSUPPORTED", Message: "filesystem does not support ACLs"}
+		}
+		return mapOsErr(&os.PathError{Op: "setxattr", Path: dir, Err: err})
+	}
+	return nil
+}
+
+// hasDefaultAcl reports whether dir has a default ACL, for stat.
+func hasDefaultAcl(dir string) bool {
+	n, err := syscall.Getxattr(dir, xattrAclDefault, nil)
+	return err == nil && n > 0
+}
+
+// handleGetDefaultAcl handles nasx.root.fs.getfacl-default (request-reply).
+func handleGetDefaultAcl(nc *nats.Conn, msg *nats.Msg) {
+	var req syncMsg
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *aclResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doGetDefaultAcl(req.Path)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// handleGetFacl handles nasx.root.fs.getfacl (request-reply).
+func handleGetFacl(nc *nats.Conn, msg *nats.Msg) {
+	var req syncMsg
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *aclResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doGetFacl(req.Path)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+// TestGetFaclWithoutAclSupport reads the ACL of a procfs file, whose
+// filesystem doesn't support ACLs: like a file without one, it must come back
+// as the mode bits with Extended false rather than as an error.
+func TestGetFaclWithoutAclSupport(t *testing.T) {
+	res, fsErr := doGetFacl("/proc/self/status")
+	if fsErr != nil {
+		t.Fatal(fsErr)
+	}
+	if res.Extended || len(res.Entries) != 3 {
+		t.Errorf("got %+v, want the three mode-bit entries and Extended false", res)
+	}
+}
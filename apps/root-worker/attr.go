@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	nats "github.com/nats-io/nats.go"
+	"golang.org/x/sys/unix"
+)
+
+// ── immutable ─────────────────────────────────────────────────────────────────
+//
+// The immutable inode flag (chattr +i) stops everyone, root included, from
+// writing, renaming, deleting or hardlinking the file until it is cleared.
+// Those operations then fail with EPERM, which reaches clients as EACCES; the
+// Immutable field in stat lets the UI tell the two apart.
+
+// fsImmutableFl is FS_IMMUTABLE_FL from linux/fs.h; x/sys/unix doesn't
+// export the inode flag bits.
+const fsImmutableFl = 0x00000010
+
+var errNoInodeFlags = &fsError{Code: "EUNSUPPORTED", Message: "filesystem does not support inode flags"}
+
+// openForFlags opens path for the FS_IOC_{GET,SET}FLAGS ioctls. Only regular
+// files and directories are opened: the ioctls don't apply to symlinks, and
+// opening a device or FIFO can have side effects.
+func openForFlags(path string) (*os.File, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() && !info.IsDir() {
+		return nil, errNoInodeFlags
+	}
+	return os.OpenFile(path, os.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW, 0)
+}
+
+// flagsUnsupported reports whether err from an inode-flags ioctl means the
+// filesystem has no such flags rather than a real failure.
+func flagsUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL)
+}
+
+// isImmutable reports whether path has FS_IMMUTABLE_FL set. Anything that
+// stops us reading the flags counts as "not immutable".
+func isImmutable(path string) bool {
+	f, err := openForFlags(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	return err == nil && flags&fsImmutableFl != 0
+}
+
+// doSetImmutable sets or clears FS_IMMUTABLE_FL on path, leaving its other
+// inode flags alone. It needs CAP_LINUX_IMMUTABLE, so it runs as root.
+func doSetImmutable(path string, immutable bool) *fsError {
+	f, err := openForFlags(path)
+	if err != nil {
+		return mapOsErr(err)
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		if flagsUnsupported(err) {
+			return errNoInodeFlags
+		}
+		return mapOsErr(&os.PathError{Op: "ioctl", Path: path, Err: err})
+	}
+	if immutable {
+		flags |= fsImmutableFl
+	} else {
+		flags &^= fsImmutableFl
+	}
+	if err := unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(flags)); err != nil {
+		if flagsUnsupported(err) {
+			return errNoInodeFlags
+		}
+		return mapOsErr(&os.PathError{Op: "ioctl", Path: path, Err: err})
+	}
+	return nil
+}
+
+// handleSetImmutable handles nasx.root.fs.immutable (request-reply). It is
+// an admin operation and runs as root rather than as LinuxUsername.
+func handleSetImmutable(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Immutable bool `json:"immutable"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if fsErr := doSetImmutable(req.Path, req.Immutable); fsErr != nil {
+		replyErr(nc, msg.Reply, fsErr)
+		return
+	}
+	replyOk(nc, msg.Reply, map[string]bool{"immutable": req.Immutable})
+}
+
+// ── special bits ──────────────────────────────────────────────────────────────
+
+type specialBitsResult struct {
+	Mode string `json:"mode"` // the resulting mode, 4 octal digits
+}
+
+// doSetSpecialBits sets each of setgid, sticky and setuid on path as given,
+// keeping its permission bits, so a shared directory can be set up without
+// working out the octal mode. Symlinks are refused: chmod would follow them.
+func doSetSpecialBits(path string, setgid, sticky, setuid bool) (*specialBitsResult, *fsError) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil, &fsError{Code: "ERR", Message: "cannot set mode bits on a symbolic link"}
+	}
+	mode := info.Mode().Perm()
+	octal := uint32(mode)
+	if setuid {
+		mode |= os.ModeSetuid
+		octal |= unix.S_ISUID
+	}
+	if setgid {
+		mode |= os.ModeSetgid
+		octal |= unix.S_ISGID
+	}
+	if sticky {
+		mode |= os.ModeSticky
+		octal |= unix.S_ISVTX
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return nil, mapOsErr(err)
+	}
+	return &specialBitsResult{Mode: fmt.Sprintf("%04o", octal)}, nil
+}
+
+// handleSpecialBits handles nasx.root.fs.special-bits (request-reply). Runs
+// as root, like chown: setgid on a directory owned by another user is the
+// usual case for a team share.
+func handleSpecialBits(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Setgid bool `json:"setgid"`
+		Sticky bool `json:"sticky"`
+		Setuid bool `json:"setuid"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	result, fsErr := doSetSpecialBits(req.Path, req.Setgid, req.Sticky, req.Setuid)
+	if fsErr != nil {
+		replyErr(nc, msg.Reply, fsErr)
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// ── hidden ────────────────────────────────────────────────────────────────────
+//
+// What counts as hidden depends on how the share is served. With Samba's
+// default "hide dot files" a file is hidden by a leading dot, which
+// NASX_HIDDEN_MODE=dot (the default) toggles by renaming. With "store dos
+// attributes" Samba keeps the DOS hidden bit in the user.DOSATTRIB xattr,
+// which NASX_HIDDEN_MODE=xattr sets; Windows clients and the macOS SMB client
+// both honour it.
+
+var hiddenMode = getenv("NASX_HIDDEN_MODE", "dot")
+
+const (
+	xattrDosAttrib = "user.DOSATTRIB"
+	dosAttrHidden  = 0x2 // FILE_ATTRIBUTE_HIDDEN
+)
+
+type hiddenResult struct {
+	Path   string `json:"path"` // differs from the request's if the file was renamed
+	Name   string `json:"name"`
+	Hidden bool   `json:"hidden"`
+}
+
+// doSetHidden hides or unhides path according to hiddenMode. In dot mode an
+// existing file under the new name fails with EEXIST rather than be
+// replaced.
+func doSetHidden(path string, hidden bool) (*hiddenResult, *fsError) {
+	path = filepath.Clean(path)
+	switch hiddenMode {
+	case "dot":
+		name := filepath.Base(path)
+		newName := name
+		if hidden && !strings.HasPrefix(name, ".") {
+			newName = "." + name
+		} else if !hidden {
+			newName = strings.TrimPrefix(name, ".")
+		}
+		if !validBaseName(newName) {
+			return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("cannot unhide %q: %q is not a valid name", name, newName)}
+		}
+		dst := filepath.Join(filepath.Dir(path), newName)
+		if dst != path {
+			if err := renameNoReplace(path, dst); err != nil {
+				return nil, mapOsErr(err)
+			}
+		} else if _, err := os.Lstat(path); err != nil {
+			return nil, mapOsErr(err)
+		}
+		return &hiddenResult{Path: dst, Name: newName, Hidden: hidden}, nil
+	case "xattr":
+		if err := setDosHidden(path, hidden); err != nil {
+			return nil, err
+		}
+		return &hiddenResult{Path: path, Name: filepath.Base(path), Hidden: hidden}, nil
+	}
+	return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("unknown NASX_HIDDEN_MODE %q", hiddenMode)}
+}
+
+// setDosHidden sets or clears the hidden bit in user.DOSATTRIB, keeping the
+// other attributes. Samba writes either the legacy "0x<hex>" text or an NDR
+// blob: an attrib_hex string, a uint16 version and a repeated uint16 union
+// level, then, 4-aligned, the attributes (versions 1 to 3) or a valid_flags
+// word followed by them (4 and 5). A blob of any other version is refused
+// rather than risk corrupting it.
+func setDosHidden(path string, hidden bool) *fsError {
+	blob, err := getxattr(path, xattrDosAttrib)
+	if err != nil && !isNoData(err) {
+		if errors.Is(err, unix.EOPNOTSUPP) {
+			return &fsError{Code: "EUNSUPPORTED", Message: "filesystem does not support user xattrs"}
+		}
+		return mapOsErr(err)
+	}
+	apply := func(attr uint32) uint32 {
+		if hidden {
+			return attr | dosAttrHidden
+		}
+		return attr &^ dosAttrHidden
+	}
+
+	nul := bytes.IndexByte(blob, 0)
+	switch {
+	case len(blob) == 0:
+		blob = []byte(fmt.Sprintf("0x%x", apply(0)))
+	case nul < 0 || nul == len(blob)-1:
+		// Text only.
+		attr, err := strconv.ParseUint(strings.TrimPrefix(string(bytes.TrimRight(blob, "\x00")), "0x"), 16, 32)
+		if err != nil {
+			return &fsError{Code: "EUNSUPPORTED", Message: "unrecognised user.DOSATTRIB value"}
+		}
+		blob = []byte(fmt.Sprintf("0x%x", apply(uint32(attr))))
+	default:
+		off := (nul + 2) &^ 1 // the string is padded to 2 bytes
+		if off+4 > len(blob) {
+			return &fsError{Code: "EUNSUPPORTED", Message: "unrecognised user.DOSATTRIB value"}
+		}
+		version := binary.LittleEndian.Uint16(blob[off:])
+		at := (off + 4 + 3) &^ 3
+		switch version {
+		case 1, 2, 3:
+		case 4, 5:
+			at += 4
+		default:
+			return &fsError{Code: "EUNSUPPORTED", Message: fmt.Sprintf("unsupported user.DOSATTRIB version %d", version)}
+		}
+		if at+4 > len(blob) {
+			return &fsError{Code: "EUNSUPPORTED", Message: "unrecognised user.DOSATTRIB value"}
+		}
+		binary.LittleEndian.PutUint32(blob[at:], apply(binary.LittleEndian.Uint32(blob[at:])))
+	}
+	if err := unix.Setxattr(path, xattrDosAttrib, blob, 0); err != nil {
+		if err == unix.EOPNOTSUPP {
+			return &fsError{Code: "EUNSUPPORTED", Message: "filesystem does not support user xattrs"}
+		}
+		return mapOsErr(&os.PathError{Op: "setxattr", Path: path, Err: err})
+	}
+	return nil
+}
+
+// handleSetHidden handles nasx.root.fs.hidden (request-reply).
+func handleSetHidden(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Hidden bool `json:"hidden"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *hiddenResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doSetHidden(req.Path, req.Hidden)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ── Audit ─────────────────────────────────────────────────────────────────────
+
+// auditEnabled turns on audit events (NASX_AUDIT=1).
+var auditEnabled = os.Getenv("NASX_AUDIT") == "1"
+
+// auditEvent is published to nasx.audit.<op> (op as in nasx.root.fs.<op>)
+// once per filesystem task, whether it succeeded or failed, so that denied
+// operations are on record too. Consumers persist it as is: fields may be
+// added but are never renamed or removed.
+type auditEvent struct {
+	Time          time.Time `json:"time"` // when the task finished, UTC
+	Op            string    `json:"op"`   // mkdir, copy, move, rename, delete, chmod, chown, assemble, ...
+	JobID         string    `json:"jobId"`
+	LinuxUsername string    `json:"linuxUsername"`   // empty: ran as root
+	Uid           int       `json:"uid"`             // resolved uid; -1 if the username didn't resolve
+	Paths         []string  `json:"paths"`           // the paths the task named, in request order
+	Result        string    `json:"result"`          // ok | error
+	Code          string    `json:"code,omitempty"`  // error code (EACCES, ENOENT, ...) when result is error
+	Error         string    `json:"error,omitempty"` // error message when result is error
+}
+
+// taskPaths lists the non-empty paths named by a task.
+func taskPaths(task *taskMsg) []string {
+	paths := []string{}
+	add := func(p string) {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	if task.ParentPath != "" && task.Name != "" {
+		add(filepath.Join(task.ParentPath, task.Name))
+	} else {
+		add(task.ParentPath)
+	}
+	add(task.Path)
+	add(task.Src)
+	add(task.DstDir)
+	add(task.DestPath)
+	add(task.DestFile)
+	add(task.RefPath)
+	for _, c := range task.PermChanges {
+		add(c.Path)
+	}
+	return paths
+}
+
+// publishAudit records the outcome of a filesystem task on nasx.audit.<op>.
+func publishAudit(nc *nats.Conn, subject string, task *taskMsg, fsErr *fsError) {
+	if !auditEnabled {
+		return
+	}
+	op := strings.TrimPrefix(subject, "nasx.root.fs.")
+	ev := auditEvent{
+		Time:          time.Now().UTC(),
+		Op:            op,
+		JobID:         task.JobID,
+		LinuxUsername: task.LinuxUsername,
+		Uid:           -1,
+		Paths:         taskPaths(task),
+		Result:        "ok",
+	}
+	if ctx, err := resolveUserCtx(task.LinuxUsername); err == nil {
+		ev.Uid = int(ctx.uid)
+	}
+	if fsErr != nil {
+		ev.Result, ev.Code, ev.Error = "error", fsErr.Code, fsErr.Message
+	}
+	data, _ := json.Marshal(ev)
+	if err := nc.Publish("nasx.audit."+op, data); err != nil {
+		log.Printf("publish audit event for job %s: %v", task.JobID, err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ── Glob batches ──────────────────────────────────────────────────────────────
+
+// A glob batch runs in two phases. nasx.root.fs.glob expands the pattern and
+// returns the matches with a token that hashes them; the glob-delete and
+// glob-move tasks expand it again and only act if the token still matches, so
+// the user confirms exactly the set that will be affected. The token covers
+// the operation and pattern and each match's path, type and inode: a file
+// swapped for a directory of the same name, whose whole contents the batch
+// would then take along, no longer matches.
+
+type globResult struct {
+	Matches []string `json:"matches"`
+	Token   string   `json:"token,omitempty"` // absent when Partial: a truncated set can't be confirmed
+	Partial bool     `json:"partial"`         // walk budget hit before the expansion finished
+}
+
+type batchFailure struct {
+	Path    string `json:"path"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type batchResult struct {
+	Done   []string       `json:"done"`
+	Failed []batchFailure `json:"failed,omitempty"`
+}
+
+// globOps are the batch operations a preview can be confirmed for.
+var globOps = map[string]bool{"delete": true, "move": true}
+
+// globMatch is what matchToken hashes of a match: the entry's path, type and
+// inode.
+type globMatch struct {
+	path     string
+	typ      fs.FileMode
+	dev, ino uint64
+}
+
+// matchToken identifies a match set for op independently of how it was
+// produced.
+func matchToken(op, pattern string, recursive bool, matches []globMatch) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%t\x00", op, pattern, recursive)
+	for _, m := range matches {
+		fmt.Fprintf(h, "%s\x00%d\x00%d:%d\x00", m.path, m.typ, m.dev, m.ino)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// doGlob matches pattern (a base-name glob such as "*.tmp") against the
+// entries of dir, and with recursive against everything below it. A matched
+// directory is not descended into: acting on it covers its contents. op is
+// the batch operation the token is for, delete or move.
+func doGlob(dir, pattern, op string, recursive bool, budget *walkBudget) (*globResult, *fsError) {
+	if pattern == "" || strings.Contains(pattern, "/") {
+		return nil, &fsError{Code: "ERR", Message: "invalid pattern"}
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, &fsError{Code: "ERR", Message: "invalid pattern"}
+	}
+	if !globOps[op] {
+		return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("invalid op %q: must be delete or move", op)}
+	}
+	res := &globResult{Matches: []string{}}
+	var matches []globMatch
+	guard := newDirGuard()
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir {
+				return err
+			}
+			return nil
+		}
+		if p == dir {
+			return nil
+		}
+		if budget.tick() {
+			res.Partial = true
+			return filepath.SkipAll
+		}
+		if ok, _ := filepath.Match(pattern, d.Name()); ok {
+			info, err := d.Info()
+			if err != nil {
+				return nil // gone since the directory was read
+			}
+			sys := info.Sys().(*syscall.Stat_t)
+			res.Matches = append(res.Matches, p)
+			matches = append(matches, globMatch{path: p, typ: info.Mode().Type(), dev: sys.Dev, ino: sys.Ino})
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if !recursive {
+				return filepath.SkipDir
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			if err := guard.enter(info, relDepth(dir, p)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if !res.Partial {
+		res.Token = matchToken(op, pattern, recursive, matches)
+	}
+	return res, nil
+}
+
+// doGlobBatch re-expands the pattern, checks it against the token from the
+// preview and applies fn to every match. Per-path failures don't stop the
+// batch; they are reported in the result.
+func doGlobBatch(dir, pattern, op string, recursive bool, token string, budget *walkBudget, fn func(p string) *fsError) (*batchResult, *fsError) {
+	g, fsErr := doGlob(dir, pattern, op, recursive, budget)
+	if fsErr != nil {
+		return nil, fsErr
+	}
+	if g.Partial {
+		return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("pattern matches too much to expand (%d+ entries)", len(g.Matches))}
+	}
+	if token == "" || g.Token != token {
+		return nil, &fsError{Code: "ECHANGED", Message: "the matched files changed since the preview"}
+	}
+	res := &batchResult{Done: []string{}}
+	for _, p := range g.Matches {
+		if fsErr := fn(p); fsErr != nil {
+			res.Failed = append(res.Failed, batchFailure{Path: p, Code: fsErr.Code, Message: fsErr.Message})
+			continue
+		}
+		res.Done = append(res.Done, p)
+	}
+	return res, nil
+}
+
+// handleGlob handles nasx.root.fs.glob (request-reply): the preview phase of
+// a glob batch.
+func handleGlob(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Pattern    string `json:"pattern"`
+		Op         string `json:"op"` // the batch to confirm: delete | move
+		Recursive  bool   `json:"recursive"`
+		MaxEntries int    `json:"maxEntries"`
+		TimeBudget int    `json:"timeBudget"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *globResult
+	budget := newWalkBudget(req.MaxEntries, req.TimeBudget)
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doGlob(req.Path, req.Pattern, req.Op, req.Recursive, budget)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
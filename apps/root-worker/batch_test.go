@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestGlobBatchRefusesSwappedMatch previews a glob-delete of a file, swaps
+// the file for a directory of the same name and checks that the confirmed
+// batch fails with ECHANGED instead of deleting the directory.
+func TestGlobBatchRefusesSwappedMatch(t *testing.T) {
+	dir := t.TempDir()
+	match := filepath.Join(dir, "a.tmp")
+	if err := os.WriteFile(match, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	preview, fsErr := doGlob(dir, "*.tmp", "delete", false, newWalkBudget(0, 0))
+	if fsErr != nil {
+		t.Fatal(fsErr)
+	}
+
+	if err := os.Remove(match); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(match, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(match, "precious"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var applied []string
+	apply := func(p string) *fsError { applied = append(applied, p); return nil }
+	_, fsErr = doGlobBatch(dir, "*.tmp", "delete", false, preview.Token, newWalkBudget(0, 0), apply)
+	if fsErr == nil || fsErr.Code != "ECHANGED" {
+		t.Fatalf("got %v, want ECHANGED", fsErr)
+	}
+	if len(applied) != 0 {
+		t.Errorf("batch applied to %v", applied)
+	}
+}
+
+// TestGlobBatchToken checks that a token confirms only the operation it was
+// previewed for, and an unchanged match set for that operation.
+func TestGlobBatchToken(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.tmp"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	preview, fsErr := doGlob(dir, "*.tmp", "move", false, newWalkBudget(0, 0))
+	if fsErr != nil {
+		t.Fatal(fsErr)
+	}
+	apply := func(string) *fsError { return nil }
+	if _, fsErr := doGlobBatch(dir, "*.tmp", "delete", false, preview.Token, newWalkBudget(0, 0), apply); fsErr == nil || fsErr.Code != "ECHANGED" {
+		t.Errorf("move token confirming a delete: got %v, want ECHANGED", fsErr)
+	}
+	res, fsErr := doGlobBatch(dir, "*.tmp", "move", false, preview.Token, newWalkBudget(0, 0), apply)
+	if fsErr != nil {
+		t.Fatal(fsErr)
+	}
+	if len(res.Done) != 1 {
+		t.Errorf("done %v, want the one match", res.Done)
+	}
+}
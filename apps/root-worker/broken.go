@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ── find broken symlinks ──────────────────────────────────────────────────────
+
+type brokenLink struct {
+	Path   string `json:"path"`
+	Target string `json:"target"` // as stored in the link
+}
+
+type brokenResult struct {
+	Links   []brokenLink `json:"links"`
+	Scanned int          `json:"scanned"`
+	Partial bool         `json:"partial"` // budget hit before the walk finished
+	Removed int          `json:"removed"`
+	Notes   []string     `json:"notes,omitempty"`
+}
+
+// danglingErr reports whether err, from stat'ing through a symlink, means
+// the link doesn't resolve: its target is missing, a path component isn't a
+// directory, or the links form a loop.
+func danglingErr(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.ELOOP)
+}
+
+// doFindBroken walks root without following symlinks and reports every
+// symlink whose target doesn't resolve. With remove set the broken links are
+// deleted; a link that can't be removed gets a note.
+func doFindBroken(root string, budget *walkBudget, remove bool) (*brokenResult, *fsError) {
+	res := &brokenResult{Links: []brokenLink{}}
+	guard := newDirGuard()
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			res.Notes = append(res.Notes, fmt.Sprintf("%s: %s", p, mapOsErr(err).Message))
+			return nil
+		}
+		if budget.tick() {
+			res.Partial = true
+			return filepath.SkipAll
+		}
+		if d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			return guard.enter(info, relDepth(root, p))
+		}
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		res.Scanned++
+		if _, err := os.Stat(p); err == nil || !danglingErr(err) {
+			return nil
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			res.Notes = append(res.Notes, fmt.Sprintf("%s: %s", p, mapOsErr(err).Message))
+			return nil
+		}
+		res.Links = append(res.Links, brokenLink{Path: p, Target: target})
+		if remove {
+			if err := os.Remove(p); err != nil {
+				res.Notes = append(res.Notes, fmt.Sprintf("%s: %s", p, mapOsErr(err).Message))
+				return nil
+			}
+			res.Removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	return res, nil
+}
+
+// ── resolve link ──────────────────────────────────────────────────────────────
+
+type resolveLinkResult struct {
+	Target   string `json:"target"`   // the link's own target, as stored
+	Resolved string `json:"resolved"` // fully resolved path; for a broken link, its target made absolute
+	Exists   bool   `json:"exists"`   // the final target exists
+	Type     string `json:"type,omitempty"`
+	Escapes  bool   `json:"escapes"` // the final target is outside the allowed roots
+}
+
+// doResolveLink follows the symlink at path to its final target. A broken
+// link is not an error: Resolved is then the lexical resolution of its
+// target, which is still checked against the allowed roots.
+func doResolveLink(path string) (*resolveLinkResult, *fsError) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		if errors.Is(err, syscall.EINVAL) {
+			return nil, &fsError{Code: "ERR", Message: "not a symbolic link"}
+		}
+		return nil, mapOsErr(err)
+	}
+	res := &resolveLinkResult{Target: target}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		res.Resolved = resolved
+		info, err := os.Stat(resolved)
+		if err != nil {
+			return nil, mapOsErr(err)
+		}
+		res.Exists, res.Type = true, "file"
+		if info.IsDir() {
+			res.Type = "dir"
+		}
+	} else if danglingErr(err) {
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		res.Resolved = filepath.Clean(target)
+	} else {
+		return nil, mapOsErr(err)
+	}
+	res.Escapes = !withinAllowedRoots(res.Resolved)
+	return res, nil
+}
+
+// handleResolveLink handles nasx.root.fs.resolve-link (request-reply).
+func handleResolveLink(nc *nats.Conn, msg *nats.Msg) {
+	var req syncMsg
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *resolveLinkResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doResolveLink(req.Path)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// ── realpath ──────────────────────────────────────────────────────────────────
+
+type realpathResult struct {
+	Path    string `json:"path"`    // canonical absolute path
+	Exists  bool   `json:"exists"`  // false when trailing components don't exist yet
+	Escapes bool   `json:"escapes"` // the canonical path is outside the allowed roots
+}
+
+// doRealpath resolves every symlink, "." and ".." in path, like realpath -m
+// for missing trailing components: the longest existing prefix is resolved
+// and the rest appended lexically. ".." is applied after resolving what
+// precedes it, as the kernel does. A dangling symlink in the existing part
+// is an error, since where it leads can't be known.
+func doRealpath(path string) (*realpathResult, *fsError) {
+	real, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return &realpathResult{Path: real, Exists: true, Escapes: !withinAllowedRoots(real)}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, mapOsErr(err)
+	}
+	// Find the first component that doesn't exist. The prefix is built
+	// without filepath.Join, which would apply ".." lexically.
+	parts := strings.Split(path, "/")
+	base := "/"
+	i := 0
+	for ; i < len(parts); i++ {
+		next := strings.TrimSuffix(base, "/") + "/" + parts[i]
+		if _, err := os.Lstat(next); err != nil {
+			if !os.IsNotExist(err) {
+				return nil, mapOsErr(err)
+			}
+			break
+		}
+		base = next
+	}
+	if real, err = filepath.EvalSymlinks(base); err != nil {
+		return nil, mapOsErr(err)
+	}
+	p := filepath.Join(real, filepath.Join(parts[i:]...))
+	return &realpathResult{Path: p, Escapes: !withinAllowedRoots(p)}, nil
+}
+
+// handleRealpath handles nasx.root.fs.realpath (request-reply). A path that
+// resolves outside the allowed roots is reported, not refused: callers
+// canonicalising user input decide what to do with it.
+func handleRealpath(nc *nats.Conn, msg *nats.Msg) {
+	var req syncMsg
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *realpathResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doRealpath(req.Path)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ── Interactive conflict resolution ───────────────────────────────────────────
+//
+// With collision "ask", a copy or move whose destination is taken doesn't
+// pick a name itself: it sends a conflictPrompt to the task's conflictSubject
+// and waits for the backend to answer overwrite, skip or rename. No answer
+// within the timeout means skip, the only choice that can't lose data. The
+// task's ack heartbeat keeps JetStream from redelivering it meanwhile.
+
+const (
+	collisionAsk = "ask"
+
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	conflictRename    = "rename"
+
+	defaultConflictTimeout = 30 * time.Second
+	maxConflictTimeout     = 10 * time.Minute
+)
+
+type conflictPrompt struct {
+	JobID string `json:"jobId"`
+	Src   string `json:"src"`
+	Dst   string `json:"dst"`
+}
+
+type conflictAnswer struct {
+	Action string `json:"action"` // overwrite | skip | rename
+}
+
+// newConflictResolver returns the function copy/move call on a conflict.
+func newConflictResolver(nc *nats.Conn, task *taskMsg) func(src, dst string) string {
+	timeout := time.Duration(task.ConflictTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultConflictTimeout
+	}
+	timeout = min(timeout, maxConflictTimeout)
+	return func(src, dst string) string {
+		data, _ := json.Marshal(conflictPrompt{JobID: task.JobID, Src: src, Dst: dst})
+		reply, err := nc.Request(task.ConflictSubject, data, timeout)
+		if err != nil {
+			log.Printf("task %s: conflict on %s: %v, skipping", task.JobID, dst, err)
+			return conflictSkip
+		}
+		var ans conflictAnswer
+		if err := json.Unmarshal(reply.Data, &ans); err != nil {
+			log.Printf("task %s: bad conflict answer %q, skipping", task.JobID, reply.Data)
+			return conflictSkip
+		}
+		switch ans.Action {
+		case conflictOverwrite, conflictRename, conflictSkip:
+			return ans.Action
+		}
+		log.Printf("task %s: unknown conflict action %q, skipping", task.JobID, ans.Action)
+		return conflictSkip
+	}
+}
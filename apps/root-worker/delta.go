@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ── delta sync ────────────────────────────────────────────────────────────────
+//
+// rsync's algorithm, split between client and worker. The worker sends the
+// signature of its copy of a file: a weak rolling checksum and a strong hash
+// per block. The client rolls the weak checksum over its own copy to find
+// the blocks the worker already has, and sends back a delta of block
+// references and literal bytes, from which the worker rebuilds the file. A
+// small edit to a large file costs its signature plus the changed bytes.
+
+const (
+	minSignatureBlock = 512
+	maxSignatureBlock = 1 << 20
+	strongSumBytes    = 16 // of the SHA-256; collisions are caught by the final hash
+)
+
+type blockSig struct {
+	Index  int    `json:"index"`
+	Weak   uint32 `json:"weak"`   // rsync rolling checksum, see weakSum
+	Strong string `json:"strong"` // leading strongSumBytes of the block's SHA-256, hex
+}
+
+type signatureSummary struct {
+	BlockSize int   `json:"blockSize"`
+	Size      int64 `json:"size"`
+	Blocks    int   `json:"blocks"`
+}
+
+// signatureBlockSize picks rsync's default for a file of size bytes, about
+// its square root, so signature and block count grow together.
+func signatureBlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size))) &^ 7
+	return min(max(bs, 2048), maxSignatureBlock)
+}
+
+// weakSum is rsync's rolling checksum: a is the byte sum and b the
+// position-weighted sum, both mod 2^16. Clients roll it one byte at a time
+// with a += in - out, b += a - len*out.
+func weakSum(block []byte) uint32 {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a&0xffff | b<<16
+}
+
+func strongSum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:strongSumBytes])
+}
+
+// doSignature emits the signature of path block by block; the last block may
+// be short. blockSize 0 picks signatureBlockSize.
+func doSignature(path string, blockSize int, emit func(blockSig)) (*signatureSummary, *fsError) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, &fsError{Code: "ERR", Message: "not a regular file"}
+	}
+	if blockSize == 0 {
+		blockSize = signatureBlockSize(info.Size())
+	}
+	if blockSize < minSignatureBlock || blockSize > maxSignatureBlock {
+		return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("block size must be between %d and %d", minSignatureBlock, maxSignatureBlock)}
+	}
+
+	sum := &signatureSummary{BlockSize: blockSize}
+	r := throttle(f, nil)
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			emit(blockSig{Index: sum.Blocks, Weak: weakSum(buf[:n]), Strong: strongSum(buf[:n])})
+			sum.Blocks++
+			sum.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, mapOsErr(err)
+		}
+	}
+	return sum, nil
+}
+
+// handleSignature handles nasx.root.fs.signature (streamed request-reply, see
+// streamReply): batches of {"blocks": [...]}, then the signatureSummary.
+func handleSignature(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		BlockSize int `json:"blockSize"` // 0 = about sqrt(size)
+	}
+	stream := &streamReply{nc: nc, subject: msg.Reply}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		stream.fail(&fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		stream.fail(&fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+
+	// A block's JSON is under 80 bytes; leave room for the envelope.
+	perBatch := int((nc.MaxPayload()/2 - 1024) / 80)
+	var batch []blockSig
+	flush := func() {
+		if len(batch) > 0 {
+			stream.send(map[string]interface{}{"blocks": batch})
+			batch = nil
+		}
+	}
+	var sum *signatureSummary
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		sum, fsErr = doSignature(req.Path, req.BlockSize, func(b blockSig) {
+			batch = append(batch, b)
+			if len(batch) >= perBatch {
+				flush()
+			}
+		})
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		stream.fail(toFsErr(err))
+		return
+	}
+	flush()
+	stream.end(sum)
+}
+
+// deltaOp is one instruction of a delta: either literal Data, or Count
+// blocks (default 1) of the worker's current file starting at Block.
+type deltaOp struct {
+	Block int    `json:"block,omitempty"`
+	Count int    `json:"count,omitempty"`
+	Data  []byte `json:"data,omitempty"` // base64 in JSON
+}
+
+type patchResult struct {
+	Path         string `json:"path"`
+	Size         int64  `json:"size"`
+	CopiedBytes  int64  `json:"copiedBytes"`  // reused from the old file
+	LiteralBytes int64  `json:"literalBytes"` // sent in the delta
+}
+
+// doPatch rebuilds path from its current content and ops, against the
+// signature taken with blockSize. Every block reference is checked against
+// the current file before anything is written. The result goes to a temp
+// file with the original's mode and ownership and is renamed over path, so
+// readers never see a half-patched file; with wantSha256 set it must hash
+// to that, or path is left untouched. As with replace-file, a file whose
+// owner can't be kept is refused.
+func doPatch(path string, blockSize int, ops []deltaOp, wantSha256 string) (*patchResult, *fsError) {
+	if blockSize < minSignatureBlock || blockSize > maxSignatureBlock {
+		return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("block size must be between %d and %d", minSignatureBlock, maxSignatureBlock)}
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	old, err := os.Open(target)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	defer old.Close()
+	info, err := old.Stat()
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, &fsError{Code: "ERR", Message: "not a regular file"}
+	}
+	blocks := int((info.Size() + int64(blockSize) - 1) / int64(blockSize))
+	for i, op := range ops {
+		if op.Data != nil {
+			continue
+		}
+		count := max(op.Count, 1)
+		if op.Block < 0 || op.Count < 0 || op.Block > blocks-count {
+			return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("op %d: blocks %d..%d out of range (file has %d)", i, op.Block, op.Block+count-1, blocks)}
+		}
+	}
+
+	dir := filepath.Dir(target)
+	tmp, err := os.CreateTemp(dir, ".nasx-tmp-*")
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op once renamed
+	res, fsErr := writePatched(tmp, old, int64(blockSize), info.Size(), ops, wantSha256)
+	if err := tmp.Close(); err != nil && fsErr == nil {
+		fsErr = mapOsErr(err)
+	}
+	if fsErr != nil {
+		return nil, fsErr
+	}
+
+	mode := info.Mode() & (fs.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	sys := info.Sys().(*syscall.Stat_t)
+	if err := os.Lchown(tmpName, int(sys.Uid), int(sys.Gid)); err != nil {
+		return nil, &fsError{Code: "EACCES", Message: "cannot preserve file ownership"}
+	}
+	// After the chown, which clears setuid/setgid.
+	if err := os.Chmod(tmpName, mode); err != nil {
+		return nil, mapOsErr(err)
+	}
+	if err := os.Rename(tmpName, target); err != nil {
+		return nil, mapOsErr(err)
+	}
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	res.Path = target
+	return res, nil
+}
+
+// writePatched writes the patched content to tmp and fsyncs it.
+func writePatched(tmp *os.File, old *os.File, blockSize, oldSize int64, ops []deltaOp, wantSha256 string) (*patchResult, *fsError) {
+	res := &patchResult{}
+	var h hash.Hash
+	var w io.Writer = tmp
+	if wantSha256 != "" {
+		h = sha256.New()
+		w = io.MultiWriter(tmp, h)
+	}
+	for _, op := range ops {
+		if op.Data != nil {
+			if _, err := w.Write(op.Data); err != nil {
+				return nil, mapOsErr(err)
+			}
+			res.LiteralBytes += int64(len(op.Data))
+			continue
+		}
+		off := int64(op.Block) * blockSize
+		n := min(int64(max(op.Count, 1))*blockSize, oldSize-off)
+		if _, err := io.Copy(w, throttle(io.NewSectionReader(old, off, n), nil)); err != nil {
+			return nil, mapOsErr(err)
+		}
+		res.CopiedBytes += n
+	}
+	res.Size = res.CopiedBytes + res.LiteralBytes
+	if h != nil {
+		if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, wantSha256) {
+			return nil, &fsError{Code: "ECHECKSUM", Message: "patched content does not match sha256 " + wantSha256}
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, mapOsErr(err)
+	}
+	return res, nil
+}
+
+// handlePatch handles nasx.root.fs.patch (request-reply).
+func handlePatch(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		BlockSize int       `json:"blockSize"` // as reported by the signature the delta was made against
+		Ops       []deltaOp `json:"ops"`
+		Sha256    string    `json:"sha256"` // optional hash of the expected result
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *patchResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doPatch(req.Path, req.BlockSize, req.Ops, req.Sha256)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
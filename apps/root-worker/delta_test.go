@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testBlock = minSignatureBlock
+
+// deltaFixture writes a file of three full blocks and a short one, and
+// returns its path and content.
+func deltaFixture(t *testing.T) (string, []byte) {
+	t.Helper()
+	old := make([]byte, 3*testBlock+100)
+	rand.New(rand.NewSource(1)).Read(old)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, old, 0640); err != nil {
+		t.Fatal(err)
+	}
+	return path, old
+}
+
+// checkUntouched fails unless path still holds want and no temp file was
+// left next to it.
+func checkUntouched(t *testing.T, path string, want []byte) {
+	t.Helper()
+	if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("file changed (%v)", err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d entries, want only the file", len(entries))
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// TestPatchRoundTrip takes a signature, builds a delta of block references
+// and a literal from it as a client would, and patches the file with it.
+func TestPatchRoundTrip(t *testing.T) {
+	path, old := deltaFixture(t)
+	var sigs []blockSig
+	sum, fsErr := doSignature(path, testBlock, func(b blockSig) { sigs = append(sigs, b) })
+	if fsErr != nil {
+		t.Fatal(fsErr)
+	}
+	if sum.Blocks != 4 || sum.Size != int64(len(old)) || len(sigs) != 4 {
+		t.Fatalf("signature: %+v with %d blocks, want 4 blocks of %d bytes", sum, len(sigs), len(old))
+	}
+
+	// The new content drops block 0 and puts a literal after block 1.
+	literal := []byte("inserted by the client")
+	want := append(append(append([]byte{}, old[testBlock:2*testBlock]...), literal...), old[2*testBlock:]...)
+	for _, ref := range []struct{ block, off, n int }{
+		{1, 0, testBlock},
+		{2, testBlock + len(literal), testBlock},
+		{3, 2*testBlock + len(literal), 100},
+	} {
+		piece := want[ref.off : ref.off+ref.n]
+		if s := sigs[ref.block]; s.Weak != weakSum(piece) || s.Strong != strongSum(piece) {
+			t.Fatalf("block %d: signature doesn't match the client's copy", ref.block)
+		}
+	}
+	ops := []deltaOp{{Block: 1}, {Data: literal}, {Block: 2, Count: 2}}
+
+	res, fsErr := doPatch(path, testBlock, ops, sha256Hex(want))
+	if fsErr != nil {
+		t.Fatal(fsErr)
+	}
+	if res.Size != int64(len(want)) || res.CopiedBytes != int64(len(want)-len(literal)) || res.LiteralBytes != int64(len(literal)) {
+		t.Errorf("result %+v", res)
+	}
+	if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("patched content differs (%v)", err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0640 {
+		t.Errorf("patched file has mode %v, want 0640", info.Mode())
+	}
+}
+
+// TestPatchRejectsOutOfRange checks that a reference past the file's blocks
+// fails before anything is written.
+func TestPatchRejectsOutOfRange(t *testing.T) {
+	path, old := deltaFixture(t)
+	for _, op := range []deltaOp{
+		{Block: 4},
+		{Block: 3, Count: 2},
+		{Block: -1},
+		{Block: 0, Count: -1},
+	} {
+		ops := []deltaOp{{Data: []byte("x")}, op}
+		if _, fsErr := doPatch(path, testBlock, ops, ""); fsErr == nil {
+			t.Errorf("%+v: patch succeeded", op)
+		}
+		checkUntouched(t, path, old)
+	}
+}
+
+// TestPatchChecksumMismatch checks that a result not hashing to the wanted
+// sha256 fails with ECHECKSUM and leaves the file as it was.
+func TestPatchChecksumMismatch(t *testing.T) {
+	path, old := deltaFixture(t)
+	ops := []deltaOp{{Block: 0, Count: 4}, {Data: []byte("x")}}
+	_, fsErr := doPatch(path, testBlock, ops, sha256Hex(old))
+	if fsErr == nil || fsErr.Code != "ECHECKSUM" {
+		t.Fatalf("got %v, want ECHECKSUM", fsErr)
+	}
+	checkUntouched(t, path, old)
+}
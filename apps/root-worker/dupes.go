@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// ── find duplicates ───────────────────────────────────────────────────────────
+
+type dupeGroup struct {
+	Size  int64    `json:"size"`
+	Hash  string   `json:"hash"`
+	Paths []string `json:"paths"`
+}
+
+type dupesResult struct {
+	Groups         []dupeGroup `json:"groups"`
+	Scanned        int         `json:"scanned"`
+	Partial        bool        `json:"partial"` // budget hit before the walk/hashing finished
+	Linked         int         `json:"linked"`
+	ReclaimedBytes int64       `json:"reclaimedBytes"`
+	Notes          []string    `json:"notes,omitempty"`
+}
+
+type dupeCandidate struct {
+	path  string
+	dev   uint64
+	ino   uint64
+	uid   uint32
+	gid   uint32
+	mode  fs.FileMode
+	mtime time.Time
+}
+
+// unchanged reports whether c.path is still the file that was hashed: the
+// same inode, with the same size and mtime. Linking over a file written to
+// since would throw its new content away.
+func (c dupeCandidate) unchanged(size int64) bool {
+	info, err := os.Lstat(c.path)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	sys := info.Sys().(*syscall.Stat_t)
+	return sys.Dev == c.dev && sys.Ino == c.ino && info.Size() == size && info.ModTime().Equal(c.mtime)
+}
+
+// hashFile returns the hex digest of path's content under newHash. The file
+// is read through throttle, like any other bulk read.
+func hashFile(newHash func() hash.Hash, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := newHash()
+	if _, err := io.Copy(h, throttle(f, nil)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// doFindDupes walks root, groups regular files by size, then confirms
+// duplicates by SHA-256. Files that are already hardlinks of one another are
+// counted once. With replace set, every duplicate is replaced by a hardlink to
+// the first path of its group — only when it lives on the same filesystem and
+// has the same owner and mode, since a hardlink shares both.
+func doFindDupes(root string, budget *walkBudget, replace bool) (*dupesResult, *fsError) {
+	res := &dupesResult{Groups: []dupeGroup{}}
+	bySize := map[int64][]dupeCandidate{}
+	seenInodes := map[[2]uint64]bool{}
+	guard := newDirGuard()
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			res.Notes = append(res.Notes, fmt.Sprintf("%s: %s", p, mapOsErr(err).Message))
+			return nil
+		}
+		if budget.tick() {
+			res.Partial = true
+			return filepath.SkipAll
+		}
+		if d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			return guard.enter(info, relDepth(root, p))
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() == 0 {
+			return nil
+		}
+		res.Scanned++
+		sys := info.Sys().(*syscall.Stat_t)
+		key := [2]uint64{sys.Dev, sys.Ino}
+		if seenInodes[key] {
+			return nil
+		}
+		seenInodes[key] = true
+		bySize[info.Size()] = append(bySize[info.Size()], dupeCandidate{
+			path: p, dev: sys.Dev, ino: sys.Ino, uid: sys.Uid, gid: sys.Gid, mode: info.Mode(), mtime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+
+	for size, cands := range bySize {
+		if len(cands) < 2 {
+			continue
+		}
+		if budget.expired() {
+			res.Partial = true
+			break
+		}
+		byHash := map[string][]dupeCandidate{}
+		for _, c := range cands {
+			sum, err := hashFile(sha256.New, c.path)
+			if err != nil {
+				res.Notes = append(res.Notes, fmt.Sprintf("%s: %s", c.path, mapOsErr(err).Message))
+				continue
+			}
+			byHash[sum] = append(byHash[sum], c)
+		}
+		for sum, group := range byHash {
+			if len(group) < 2 {
+				continue
+			}
+			g := dupeGroup{Size: size, Hash: sum}
+			for _, c := range group {
+				g.Paths = append(g.Paths, c.path)
+			}
+			res.Groups = append(res.Groups, g)
+			if replace {
+				linkDupes(res, size, group)
+			}
+		}
+	}
+	return res, nil
+}
+
+// linkDupes replaces group[1:] with hardlinks to the first compatible keeper.
+// Each replacement is linked under a temp name then renamed over the
+// duplicate, so the path never disappears. Right before the rename both
+// files are checked against what was hashed, and a pair where either has
+// changed since is left alone.
+func linkDupes(res *dupesResult, size int64, group []dupeCandidate) {
+	keepers := map[uint64]dupeCandidate{} // one keeper per filesystem
+	for _, c := range group {
+		keep, ok := keepers[c.dev]
+		if !ok {
+			keepers[c.dev] = c
+			continue
+		}
+		if c.uid != keep.uid || c.gid != keep.gid || c.mode != keep.mode {
+			res.Notes = append(res.Notes, fmt.Sprintf("%s: owner or mode differs from %s, not linked", c.path, keep.path))
+			continue
+		}
+		tmp := filepath.Join(filepath.Dir(c.path), fmt.Sprintf(".nasx-link-%d", time.Now().UnixNano()))
+		if err := os.Link(keep.path, tmp); err != nil {
+			res.Notes = append(res.Notes, fmt.Sprintf("%s: %s", c.path, mapOsErr(err).Message))
+			continue
+		}
+		if !keep.unchanged(size) || !c.unchanged(size) {
+			_ = os.Remove(tmp)
+			res.Notes = append(res.Notes, fmt.Sprintf("%s: changed since it was hashed, not linked", c.path))
+			continue
+		}
+		if err := os.Rename(tmp, c.path); err != nil {
+			_ = os.Remove(tmp)
+			res.Notes = append(res.Notes, fmt.Sprintf("%s: %s", c.path, mapOsErr(err).Message))
+			continue
+		}
+		res.Linked++
+		res.ReclaimedBytes += size
+	}
+	if len(keepers) > 1 {
+		res.Notes = append(res.Notes, fmt.Sprintf("group %s spans %d filesystems; copies on different filesystems can't be linked", group[0].path, len(keepers)))
+	}
+}
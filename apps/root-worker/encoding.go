@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// ── Text encodings ────────────────────────────────────────────────────────────
+//
+// Clients always exchange text as UTF-8. On read the worker reports what the
+// file is actually encoded in; on write it transcodes the client's UTF-8 into
+// the requested encoding so that saving a legacy file doesn't convert it.
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// detectCharset guesses the encoding of data and reports the length of its
+// byte-order mark (0 if none). Without a BOM it can only tell UTF-8, UTF-16
+// (from the pattern of NUL bytes in ASCII-heavy text), "binary" (NULs that fit
+// no pattern) and, for anything else, windows-1252 — the usual legacy
+// encoding of Western text files and a superset of ISO-8859-1.
+func detectCharset(data []byte) (charset string, bomLen int) {
+	switch {
+	case bytes.HasPrefix(data, bomUTF8):
+		return "utf-8", len(bomUTF8)
+	case bytes.HasPrefix(data, bomUTF16LE):
+		return "utf-16le", len(bomUTF16LE)
+	case bytes.HasPrefix(data, bomUTF16BE):
+		return "utf-16be", len(bomUTF16BE)
+	}
+	if utf8.Valid(data) && bytes.IndexByte(data, 0) < 0 {
+		return "utf-8", 0
+	}
+	sample := data[:min(len(data), 4096)]
+	var evenNul, oddNul int
+	for i, b := range sample {
+		if b == 0 {
+			if i%2 == 0 {
+				evenNul++
+			} else {
+				oddNul++
+			}
+		}
+	}
+	pairs := len(sample) / 2
+	switch {
+	case pairs > 0 && oddNul*10 >= pairs*9 && evenNul == 0:
+		return "utf-16le", 0
+	case pairs > 0 && evenNul*10 >= pairs*9 && oddNul == 0:
+		return "utf-16be", 0
+	case evenNul+oddNul > 0:
+		return "binary", 0
+	}
+	return "windows-1252", 0
+}
+
+// lookupEncoding resolves a WHATWG encoding label ("utf-16le", "latin1",
+// "shift_jis", …). UTF-8 returns a nil encoding.
+func lookupEncoding(name string) (encoding.Encoding, *fsError) {
+	switch strings.ToLower(name) {
+	case "", "utf-8", "utf8":
+		return nil, nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("unknown encoding %q", name)}
+	}
+	return enc, nil
+}
+
+// encodeText converts UTF-8 data from a client into the named encoding,
+// writing a byte-order mark when bom is set (only meaningful for UTF-8 and
+// UTF-16). A BOM the client left in data is dropped first so it is never
+// doubled. Characters the target encoding can't represent are an error rather
+// than being silently replaced.
+func encodeText(data []byte, name string, bom bool) ([]byte, *fsError) {
+	data = bytes.TrimPrefix(data, bomUTF8)
+	enc, fsErr := lookupEncoding(name)
+	if fsErr != nil {
+		return nil, fsErr
+	}
+	if enc == nil {
+		if bom {
+			return append(append([]byte{}, bomUTF8...), data...), nil
+		}
+		return data, nil
+	}
+	out, err := enc.NewEncoder().Bytes(data)
+	if err != nil {
+		return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("text cannot be represented in %s", name)}
+	}
+	if bom {
+		switch canonical, _ := htmlindex.Name(enc); canonical {
+		case "utf-16le":
+			out = append(append([]byte{}, bomUTF16LE...), out...)
+		case "utf-16be":
+			out = append(append([]byte{}, bomUTF16BE...), out...)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ── Flatten ───────────────────────────────────────────────────────────────────
+
+type flattenResult struct {
+	Files       int            `json:"files"`       // files moved or copied into destDir
+	RemovedDirs int            `json:"removedDirs"` // emptied source directories removed
+	Failed      []batchFailure `json:"failed,omitempty"`
+}
+
+// doFlatten moves (or with copyFiles, copies) every regular file below root
+// directly into destDir, renaming on collision per opts.collision. The file
+// list is taken before anything moves, so a destDir inside root doesn't get
+// its new arrivals processed again; files already in destDir stay put. With
+// removeEmpty the source directories left empty are removed afterwards,
+// deepest first; root itself and destDir's ancestors are kept.
+func doFlatten(root, destDir string, copyFiles, removeEmpty bool, opts copyOptions) (*flattenResult, *fsError) {
+	root, destDir = filepath.Clean(root), filepath.Clean(destDir)
+	info, err := os.Stat(destDir)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if !info.IsDir() {
+		return nil, &fsError{Code: "ERR", Message: "destination is not a directory"}
+	}
+	collision := opts.collision
+	if collision == "" || collision == collisionAsk {
+		collision = collisionParens
+	}
+
+	res := &flattenResult{}
+	fail := func(p string, err error) {
+		fe := mapOsErr(err)
+		res.Failed = append(res.Failed, batchFailure{Path: p, Code: fe.Code, Message: fe.Message})
+	}
+	var files, dirs []string
+	guard := newDirGuard()
+	walkErr := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root && d == nil {
+				return err
+			}
+			fail(p, err)
+			return nil
+		}
+		if d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			if p != root {
+				dirs = append(dirs, p)
+			}
+			return guard.enter(info, relDepth(root, p))
+		}
+		if d.Type().IsRegular() && filepath.Dir(p) != destDir {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return nil, mapOsErr(walkErr)
+	}
+
+	progress := newCopyProgress(0, opts.report)
+	opts.progress = progress
+	for _, p := range files {
+		if err := flattenOne(p, destDir, collision, copyFiles, opts); err != nil {
+			fail(p, err)
+		} else {
+			res.Files++
+		}
+		progress.addItem()
+	}
+
+	if removeEmpty {
+		// WalkDir lists parents before children; go backwards.
+		for i := len(dirs) - 1; i >= 0; i-- {
+			d := dirs[i]
+			if d == destDir || strings.HasPrefix(destDir, d+"/") {
+				continue
+			}
+			if os.Remove(d) == nil {
+				res.RemovedDirs++
+			}
+		}
+	}
+	return res, nil
+}
+
+// flattenOne moves or copies the file p into destDir under a free name.
+func flattenOne(p, destDir, collision string, copyFiles bool, opts copyOptions) error {
+	dst, fsErr := uniqueDst(p, destDir, collision)
+	if fsErr != nil {
+		return fsErr
+	}
+	if !copyFiles {
+		err := renameNoReplace(p, dst)
+		if !errors.Is(err, syscall.EXDEV) {
+			return err
+		}
+	}
+	if err := copyAll(p, dst, opts); err != nil {
+		return err
+	}
+	if !copyFiles {
+		return os.Remove(p)
+	}
+	return nil
+}
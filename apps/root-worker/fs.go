@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"log"
+	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+
+	"github.com/nats-io/nuid"
+	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
 )
 
 // ── Path validation ───────────────────────────────────────────────────────────
@@ -25,16 +36,95 @@ func validatePath(p string) error {
 	return nil
 }
 
+// allowedRoots are the trees the worker may create directories in on demand
+// (NASX_ALLOWED_ROOTS, colon-separated). Empty means no restriction.
+var allowedRoots = splitRoots(os.Getenv("NASX_ALLOWED_ROOTS"))
+
+func splitRoots(v string) []string {
+	var roots []string
+	for _, r := range filepath.SplitList(v) {
+		if r != "" && filepath.IsAbs(r) {
+			roots = append(roots, filepath.Clean(r))
+		}
+	}
+	return roots
+}
+
+// withinAllowedRoots reports whether the resolved path p lies in one of the
+// allowed roots.
+func withinAllowedRoots(p string) bool {
+	if len(allowedRoots) == 0 {
+		return true
+	}
+	for _, root := range allowedRoots {
+		if p == root || strings.HasPrefix(p, root+"/") || root == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// windowsReserved are device names Windows refuses as a file's base name,
+// with or without an extension ("NUL", "con.txt").
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// checkPortableName rejects names that Linux accepts but SMB/Windows clients
+// can't open: reserved device names, characters Windows forbids, control
+// characters, and leading/trailing spaces or a trailing dot (Windows strips
+// these, so the file becomes unreachable under its real name). Leading dots
+// are allowed: dotfiles are ordinary names over SMB.
+func checkPortableName(name string) *fsError {
+	reject := func(reason string) *fsError {
+		return &fsError{Code: "ENAME", Message: fmt.Sprintf("invalid name %q: %s", name, reason)}
+	}
+	switch {
+	case name == "" || name == "." || name == "..":
+		return reject("empty or relative")
+	case len(name) > 255:
+		return reject("longer than 255 bytes")
+	case strings.HasSuffix(name, ".") || strings.HasSuffix(name, " "):
+		return reject("ends with a dot or space")
+	case strings.HasPrefix(name, " "):
+		return reject("starts with a space")
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return reject("contains a control character")
+		}
+		if strings.ContainsRune(`<>:"/\|?*`, r) {
+			return reject(fmt.Sprintf("contains %q", r))
+		}
+	}
+	base, _, _ := strings.Cut(name, ".")
+	if windowsReserved[strings.ToUpper(strings.TrimRight(base, " "))] {
+		return reject("reserved on Windows")
+	}
+	return nil
+}
+
 // ── Error mapping ─────────────────────────────────────────────────────────────
 
 type fsError struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
+	Size    int64  `json:"size,omitempty"`   // ETOOBIG: the file's actual size, when known
+	Line    int    `json:"line,omitempty"`   // EFORMAT: 1-based position of the parse error
+	Column  int    `json:"column,omitempty"` // EFORMAT: in runes
 }
 
 func (e *fsError) Error() string { return e.Message }
 
 func mapOsErr(err error) *fsError {
+	var fe *fsError
+	if errors.As(err, &fe) {
+		return fe // already classified, e.g. EDEPTH from a walk guard
+	}
 	var pathErr *fs.PathError
 	var linkErr *os.LinkError
 	var errno syscall.Errno
@@ -46,6 +136,8 @@ func mapOsErr(err error) *fsError {
 		if e, ok := linkErr.Err.(syscall.Errno); ok {
 			errno = e
 		}
+	} else {
+		errors.As(err, &errno)
 	}
 	switch errno {
 	case syscall.EACCES, syscall.EPERM:
@@ -54,6 +146,20 @@ func mapOsErr(err error) *fsError {
 		return &fsError{Code: "ENOENT", Message: "no such file or directory"}
 	case syscall.EEXIST, syscall.ENOTEMPTY:
 		return &fsError{Code: "EEXIST", Message: "destination already exists"}
+	case syscall.EINTR:
+		return &fsError{Code: "EINTR", Message: "interrupted system call"}
+	case syscall.EAGAIN:
+		return &fsError{Code: "EAGAIN", Message: "resource temporarily unavailable"}
+	case syscall.EBUSY:
+		return &fsError{Code: "EBUSY", Message: "device or resource busy"}
+	case syscall.EROFS:
+		return &fsError{Code: "EROFS", Message: "read-only file system"}
+	case syscall.ENOSPC:
+		return &fsError{Code: "ENOSPC", Message: "no space left on device"}
+	case syscall.EDQUOT:
+		return &fsError{Code: "EDQUOT", Message: "disk quota exceeded"}
+	case syscall.EIO:
+		return &fsError{Code: "EIO", Message: "input/output error"}
 	}
 	if err != nil {
 		return &fsError{Code: "ERR", Message: err.Error()}
@@ -69,35 +175,278 @@ type listEntry struct {
 	Type  string `json:"type"`
 	Size  *int64 `json:"size"`
 	Mtime string `json:"mtime"`
+	Mime  string `json:"mime,omitempty"`
+	// What the requesting user may do with the entry; only set on request.
+	Readable   *bool `json:"readable,omitempty"`
+	Writable   *bool `json:"writable,omitempty"`
+	Executable *bool `json:"executable,omitempty"`
+	// Inaccessible is set when the entry couldn't be stat'ed (no search
+	// permission on the directory, removed mid-listing, ...). Only Name,
+	// Path and Type are then filled in, Type from the directory entry.
+	Inaccessible bool   `json:"inaccessible,omitempty"`
+	StatError    string `json:"statError,omitempty"` // error code of the failed stat
+	// Link describes a symlink's target; only set with resolveLinks.
+	Link *resolveLinkResult `json:"link,omitempty"`
+	// TargetType is what a symlink leads to, "dir" or "file", so a client
+	// can still open a linked directory; empty for a broken link.
+	TargetType string `json:"targetType,omitempty"`
+}
+
+// listRetries is how many times doList retries a ReadDir or stat that failed
+// transiently, retryBackoff apart and doubling.
+const listRetries = 2
+
+// transientFsErr reports whether err is worth retrying on a network
+// filesystem: an I/O error or stale handle from a flaky NFS mount, or an
+// interrupted or busy call. ENOENT, EACCES and the like never are.
+func transientFsErr(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.ESTALE, syscall.EINTR, syscall.EAGAIN, syscall.EBUSY} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// withListRetry runs fn, retrying it while it fails transiently.
+func withListRetry(fn func() error) error {
+	err := fn()
+	for i := 0; i < listRetries && err != nil && transientFsErr(err); i++ {
+		time.Sleep(retryBackoff << i)
+		err = fn()
+	}
+	return err
 }
 
-func doList(dir string) ([]listEntry, *fsError) {
-	entries, err := os.ReadDir(dir)
+// doList lists dir. Entries are Lstat'ed, so a symlink is reported as type
+// "symlink" with its own mtime rather than as whatever it points to; with
+// resolveLinks each link's target is looked up as well. Entries that can't
+// be stat'ed are still returned, marked Inaccessible, so the listing matches
+// what ls shows. Transient errors are retried; if reading the directory
+// still breaks off midway, what was read is returned with partial set.
+func doList(dir string, resolveLinks bool) (result []listEntry, partial bool, fsErr *fsError) {
+	var entries []os.DirEntry
+	err := withListRetry(func() (err error) {
+		entries, err = os.ReadDir(dir)
+		return err
+	})
 	if err != nil {
-		return nil, mapOsErr(err)
+		if len(entries) == 0 || !transientFsErr(err) {
+			return nil, false, mapOsErr(err)
+		}
+		partial = true
 	}
-	result := make([]listEntry, 0, len(entries))
+	result = make([]listEntry, 0, len(entries))
 	for _, e := range entries {
-		full := filepath.Join(dir, e.Name())
-		info, err := os.Stat(full)
+		result = append(result, listEntryFor(dir, e, resolveLinks))
+	}
+	return result, partial, nil
+}
+
+// listEntryFor describes one entry of dir for doList and doListStream.
+func listEntryFor(dir string, e os.DirEntry, resolveLinks bool) listEntry {
+	full := filepath.Join(dir, e.Name())
+	var info fs.FileInfo
+	err := withListRetry(func() (err error) {
+		info, err = os.Lstat(full)
+		return err
+	})
+	if err != nil {
+		le := listEntry{Name: e.Name(), Path: full, Type: "file", Inaccessible: true, StatError: mapOsErr(err).Code}
+		if e.IsDir() {
+			le.Type = "dir"
+		} else if e.Type()&fs.ModeSymlink != 0 {
+			le.Type = "symlink"
+		}
+		return le
+	}
+	le := listEntry{
+		Name:  e.Name(),
+		Path:  full,
+		Mtime: info.ModTime().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+	}
+	switch {
+	case info.IsDir():
+		le.Type = "dir"
+	case info.Mode()&fs.ModeSymlink != 0:
+		le.Type = "symlink"
+		if target, err := os.Stat(full); err == nil {
+			le.TargetType = "file"
+			if target.IsDir() {
+				le.TargetType = "dir"
+			}
+		}
+		if resolveLinks {
+			le.Link, _ = doResolveLink(full)
+		}
+	default:
+		le.Type = "file"
+		sz := info.Size()
+		le.Size = &sz
+	}
+	return le
+}
+
+// listStreamBatchBytes is the listing JSON budgeted per entry when sizing
+// the batches of a streamed listing, generous for long paths.
+const listStreamBatchBytes = 1024
+
+// doListStream lists dir like doList but hands the entries to emit in
+// batches of up to n as they are read, so the first arrive before a huge
+// directory has been read to the end. Unlike doList it has nothing to fall
+// back on if reading breaks off, so that is an error, after the batches
+// already emitted.
+func doListStream(dir string, resolveLinks bool, n int, emit func([]listEntry)) *fsError {
+	f, err := os.Open(dir)
+	if err != nil {
+		return mapOsErr(err)
+	}
+	defer f.Close()
+	for {
+		var entries []os.DirEntry
+		err := withListRetry(func() (err error) {
+			entries, err = f.ReadDir(n)
+			return err
+		})
+		if len(entries) > 0 {
+			batch := make([]listEntry, 0, len(entries))
+			for _, e := range entries {
+				batch = append(batch, listEntryFor(dir, e, resolveLinks))
+			}
+			emit(batch)
+		}
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			continue
+			return mapOsErr(err)
+		}
+	}
+}
+
+// addAccessFlags fills in Readable/Writable/Executable for each entry. It
+// must run on the impersonated thread: faccessat with AT_EACCESS checks the
+// effective ids (the real uid stays root), and it also honours ACLs and
+// read-only mounts, which the mode bits alone don't show.
+func addAccessFlags(entries []listEntry) {
+	can := func(path string, mode uint32) *bool {
+		ok := faccess(path, mode) == nil
+		return &ok
+	}
+	for i := range entries {
+		e := &entries[i]
+		e.Readable = can(e.Path, unix.R_OK)
+		e.Writable = can(e.Path, unix.W_OK)
+		e.Executable = can(e.Path, unix.X_OK)
+	}
+}
+
+// ── access ────────────────────────────────────────────────────────────────────
+
+// faccess checks mode (R_OK|W_OK|X_OK, or F_OK) against the effective ids;
+// see addAccessFlags for why that needs AT_EACCESS.
+func faccess(path string, mode uint32) error {
+	return unix.Faccessat(unix.AT_FDCWD, path, mode, unix.AT_EACCESS)
+}
+
+// parseAccessMode turns "r", "rw", "rwx", ... into faccessat flags. An empty
+// mode only checks that the path exists.
+func parseAccessMode(s string) (uint32, error) {
+	var mode uint32 = unix.F_OK
+	for _, c := range s {
+		switch c {
+		case 'r':
+			mode |= unix.R_OK
+		case 'w':
+			mode |= unix.W_OK
+		case 'x':
+			mode |= unix.X_OK
+		default:
+			return 0, fmt.Errorf("invalid access mode %q: want a combination of r, w and x", s)
 		}
-		le := listEntry{
-			Name:  e.Name(),
-			Path:  full,
-			Mtime: info.ModTime().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+	}
+	return mode, nil
+}
+
+type accessResult struct {
+	Allowed bool   `json:"allowed"`
+	Code    string `json:"code,omitempty"` // why not: EACCES, EROFS, ...
+}
+
+// doAccess asks the kernel whether the caller may access path with mode,
+// honouring ACLs and read-only mounts. Must run on the impersonated thread.
+// A denial is a normal answer; a missing path is an error.
+func doAccess(path, mode string) (*accessResult, *fsError) {
+	m, err := parseAccessMode(mode)
+	if err != nil {
+		return nil, &fsError{Code: "ERR", Message: err.Error()}
+	}
+	if err := faccess(path, m); err != nil {
+		fe := mapOsErr(&os.PathError{Op: "faccessat", Path: path, Err: err})
+		switch fe.Code {
+		case "EACCES", "EROFS":
+			return &accessResult{Code: fe.Code}, nil
 		}
-		if info.IsDir() {
-			le.Type = "dir"
-		} else {
-			le.Type = "file"
-			sz := info.Size()
-			le.Size = &sz
+		return nil, fe
+	}
+	return &accessResult{Allowed: true}, nil
+}
+
+// ── MIME detection ────────────────────────────────────────────────────────────
+
+const (
+	mimeSniffBytes  = 512     // all http.DetectContentType looks at
+	mimeMaxSize     = 4 << 30 // skip sniffing files larger than 4 GB
+	mimeListWorkers = 8       // concurrent sniffers per list request
+)
+
+// detectMime sniffs the content type of a regular file from its first bytes.
+// Returns "" if the file can't be read.
+func detectMime(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, mimeSniffBytes)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return ""
+	}
+	return http.DetectContentType(buf[:n])
+}
+
+// detectListMimes fills in Mime for the regular-file entries of a listing
+// using a bounded pool. Credentials are per-thread, so each worker
+// impersonates the user itself — goroutines started inside withUser would
+// run as root.
+func detectListMimes(username string, entries []listEntry) {
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < mimeListWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := withUser(username, func() error {
+				for i := range idx {
+					entries[i].Mime = detectMime(entries[i].Path)
+				}
+				return nil
+			})
+			if err != nil {
+				for range idx {
+					// drain so the producer doesn't block
+				}
+			}
+		}()
+	}
+	for i, e := range entries {
+		if e.Type == "file" && e.Size != nil && *e.Size <= mimeMaxSize {
+			idx <- i
 		}
-		result = append(result, le)
 	}
-	return result, nil
+	close(idx)
+	wg.Wait()
 }
 
 // ── stat ──────────────────────────────────────────────────────────────────────
@@ -110,9 +459,19 @@ type statResult struct {
 	Gid   int    `json:"gid"`
 	Type  string `json:"type"`
 	Size  *int64 `json:"size"`
+	Mime  string `json:"mime,omitempty"`
+	// Immutable is the chattr +i flag: writes, renames and deletes fail with
+	// EACCES until an admin clears it.
+	Immutable bool `json:"immutable,omitempty"`
+	// The special bits of Mode, spelled out.
+	Setuid bool `json:"setuid"`
+	Setgid bool `json:"setgid"`
+	Sticky bool `json:"sticky"`
+	// DefaultAcl is set on directories whose new entries inherit an ACL.
+	DefaultAcl bool `json:"defaultAcl,omitempty"`
 }
 
-func doStat(path string) (*statResult, *fsError) {
+func doStat(path string, withMime bool) (*statResult, *fsError) {
 	info, err := os.Lstat(path)
 	if err != nil {
 		return nil, mapOsErr(err)
@@ -120,7 +479,8 @@ func doStat(path string) (*statResult, *fsError) {
 	sys := info.Sys().(*syscall.Stat_t)
 	uid := int(sys.Uid)
 	gid := int(sys.Gid)
-	mode := fmt.Sprintf("%03o", info.Mode().Perm())
+	// 4 digits so setuid/setgid/sticky survive a stat → chmod round-trip.
+	mode := fmt.Sprintf("%04o", sys.Mode&07777)
 
 	ownerName := strconv.Itoa(uid)
 	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
@@ -140,24 +500,145 @@ func doStat(path string) (*statResult, *fsError) {
 		sz := info.Size()
 		size = &sz
 	}
-	return &statResult{Mode: mode, Owner: ownerName, Group: groupName, Uid: uid, Gid: gid, Type: typ, Size: size}, nil
+	res := &statResult{Mode: mode, Owner: ownerName, Group: groupName, Uid: uid, Gid: gid, Type: typ, Size: size}
+	res.Immutable = isImmutable(path)
+	if info.IsDir() {
+		res.DefaultAcl = hasDefaultAcl(path)
+	}
+	res.Setuid = sys.Mode&syscall.S_ISUID != 0
+	res.Setgid = sys.Mode&syscall.S_ISGID != 0
+	res.Sticky = sys.Mode&syscall.S_ISVTX != 0
+	if withMime && info.Mode().IsRegular() && info.Size() <= mimeMaxSize {
+		res.Mime = detectMime(path)
+	}
+	return res, nil
+}
+
+// ── exists ────────────────────────────────────────────────────────────────────
+
+type existsResult struct {
+	Exists bool   `json:"exists"`
+	Type   string `json:"type,omitempty"` // dir | file | symlink
+}
+
+// doExists is a single Lstat, for checking one name without listing its
+// directory. A missing path is a normal answer, not an error.
+func doExists(path string) (*existsResult, *fsError) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		return &existsResult{}, nil
+	}
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	typ := "file"
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		typ = "symlink"
+	case info.IsDir():
+		typ = "dir"
+	}
+	return &existsResult{Exists: true, Type: typ}, nil
+}
+
+// ── count ─────────────────────────────────────────────────────────────────────
+
+type countResult struct {
+	Files int `json:"files"`
+	Dirs  int `json:"dirs"`
+	Other int `json:"other"` // symlinks, sockets, devices, ...
+	Total int `json:"total"`
+}
+
+// doCount counts the entries of dir from the types getdents reports, without
+// statting or even holding them all, for "N items" badges on huge folders.
+func doCount(dir string) (*countResult, *fsError) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	defer f.Close()
+	res := &countResult{}
+	for {
+		entries, err := f.ReadDir(1024)
+		for _, e := range entries {
+			switch {
+			case e.IsDir():
+				res.Dirs++
+			case e.Type().IsRegular():
+				res.Files++
+			default:
+				res.Other++
+			}
+		}
+		res.Total += len(entries)
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, mapOsErr(err)
+		}
+	}
 }
 
 // ── read ──────────────────────────────────────────────────────────────────────
 
-const maxReadBytes = 64 * 1024 * 1024 // 64 MB
+var maxReadBytes = getenvInt64("NASX_MAX_READ_BYTES", 64*1024*1024) // 64 MB
+
+type readResult struct {
+	data      []byte
+	size      int64 // the file's true size; -1 if unknown (a pipe cut off at the limit)
+	truncated bool
+	sha256    string // hex SHA-256 of data, if asked for and not truncated
+}
 
-func doRead(path string) ([]byte, *fsError) {
+// doRead returns the whole file, or ETOOBIG (with the file's size) if it is
+// larger than limit. With allowTruncate, an oversized file instead yields its
+// first limit bytes flagged as truncated, for previews. A limit of 0, or one
+// above NASX_MAX_READ_BYTES, means the server maximum: requests may only
+// lower it. withSha256 hashes the bytes as they are read, saving clients a
+// second pass through checksum.
+func doRead(path string, limit int64, allowTruncate, withSha256 bool) (*readResult, *fsError) {
+	if limit <= 0 || limit > maxReadBytes {
+		limit = maxReadBytes
+	}
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, mapOsErr(err)
 	}
 	defer f.Close()
-	data, err := io.ReadAll(io.LimitReader(f, maxReadBytes))
+	size := int64(-1)
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+		size = info.Size()
+	}
+	tooBig := &fsError{Code: "ETOOBIG", Message: fmt.Sprintf("file exceeds the %d byte read limit", limit), Size: max(size, 0)}
+	if size > limit && !allowTruncate {
+		return nil, tooBig
+	}
+	// Read one byte past the limit so that a file of exactly limit bytes is
+	// told apart from a longer one, even if it grew or reports no size.
+	var r io.Reader = io.LimitReader(throttle(f, nil), limit+1)
+	h := sha256.New()
+	if withSha256 {
+		r = io.TeeReader(r, h)
+	}
+	data, err := io.ReadAll(r)
 	if err != nil {
 		return nil, mapOsErr(err)
 	}
-	return data, nil
+	res := &readResult{data: data, size: size}
+	if int64(len(data)) > limit {
+		if !allowTruncate {
+			return nil, tooBig
+		}
+		res.data, res.truncated = data[:limit], true
+	} else {
+		res.size = int64(len(data)) // exact, even if the file changed since Stat
+		if withSha256 {
+			res.sha256 = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+	return res, nil
 }
 
 // ── mkdir ─────────────────────────────────────────────────────────────────────
@@ -167,76 +648,339 @@ type mkdirResult struct {
 	Name string `json:"name"`
 }
 
-func doMkdir(parent, name string) (*mkdirResult, *fsError) {
+// doMkdir creates name in parent. With noParents it creates only that
+// directory and fails if parent is missing, like plain mkdir; otherwise
+// missing ancestors are created too. A mode, if given, is set exactly,
+// umask aside, on every directory created, ancestors included, so a private
+// folder never gets world-readable parents; nil leaves them at 0755 less
+// the umask. 000 is a mode like any other.
+func doMkdir(parent, name, collision string, noParents bool, mode *fs.FileMode) (*mkdirResult, *fsError) {
 	if name == "" {
 		name = "New Folder"
 	}
-	target := filepath.Join(parent, name)
-	for n := 1; n <= 1000; n++ {
-		if _, err := os.Lstat(target); os.IsNotExist(err) {
+	target, fsErr := freeName(parent, name, "", collision)
+	if fsErr != nil {
+		return nil, fsErr
+	}
+	if mode == nil {
+		mkdir := os.MkdirAll
+		if noParents {
+			mkdir = os.Mkdir
+		}
+		if err := mkdir(target, 0755); err != nil {
+			return nil, mapOsErr(err)
+		}
+		return &mkdirResult{Path: target, Name: filepath.Base(target)}, nil
+	}
+	if noParents {
+		// Created private, then opened up: no window with a looser mode.
+		if err := os.Mkdir(target, 0700); err != nil {
+			return nil, mapOsErr(err)
+		}
+		if err := os.Chmod(target, *mode); err != nil {
+			return nil, mapOsErr(err)
+		}
+		return &mkdirResult{Path: target, Name: filepath.Base(target)}, nil
+	}
+	var missing []string
+	for dir := target; ; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil || !os.IsNotExist(err) || dir == filepath.Dir(dir) {
 			break
 		}
-		target = filepath.Join(parent, fmt.Sprintf("%s (%d)", name, n))
+		missing = append(missing, dir)
+	}
+	var created []string
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], 0700); err != nil && !os.IsExist(err) {
+			return nil, mapOsErr(err)
+		} else if err == nil {
+			created = append(created, missing[i])
+		}
 	}
-	if err := os.MkdirAll(target, 0755); err != nil {
+	if info, err := os.Stat(target); err != nil {
 		return nil, mapOsErr(err)
+	} else if !info.IsDir() {
+		return nil, &fsError{Code: "ERR", Message: "not a directory: " + target}
+	}
+	// Innermost first: a mode without search permission (000, 600, ...) on
+	// an ancestor would otherwise lock the user out of the ones below it.
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := os.Chmod(created[i], *mode); err != nil {
+			return nil, mapOsErr(err)
+		}
 	}
 	return &mkdirResult{Path: target, Name: filepath.Base(target)}, nil
 }
 
+// doMkdirParents creates dir and any missing parents, like mkdir -p, and
+// returns the directories it actually created, outermost first. The missing
+// part is resolved against the nearest existing ancestor (following its
+// symlinks) and must fall inside the allowed roots, or nothing is created.
+func doMkdirParents(dir string) ([]string, *fsError) {
+	dir = filepath.Clean(dir)
+	var missing []string
+	base := dir
+	for {
+		info, err := os.Stat(base)
+		if err == nil {
+			if !info.IsDir() {
+				return nil, &fsError{Code: "ERR", Message: "not a directory: " + base}
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return nil, mapOsErr(err)
+		}
+		missing = append(missing, base)
+		base = filepath.Dir(base)
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	real, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	rel, _ := filepath.Rel(base, dir)
+	if !withinAllowedRoots(filepath.Join(real, rel)) {
+		return nil, &fsError{Code: "EJAIL", Message: "destination is outside the allowed roots"}
+	}
+	var created []string
+	for i := len(missing) - 1; i >= 0; i-- {
+		err := os.Mkdir(missing[i], 0755)
+		if err == nil {
+			created = append(created, missing[i])
+		} else if !os.IsExist(err) {
+			return created, mapOsErr(err)
+		}
+	}
+	return created, nil
+}
+
 // ── copy ──────────────────────────────────────────────────────────────────────
 
 type copyResult struct {
-	Ok  bool   `json:"ok"`
-	Dst string `json:"dst"`
+	Ok       bool     `json:"ok"`
+	Dst      string   `json:"dst"`
+	Skipped  []string `json:"skipped,omitempty"`  // special files not copied, with reason
+	Conflict string   `json:"conflict,omitempty"` // collision "ask": the action taken
+
+	CreatedDirs []string `json:"createdDirs,omitempty"` // createParents: directories made for dstDir
 }
 
-func uniqueDst(src, dstDir string) string {
-	base := filepath.Base(src)
-	ext := filepath.Ext(base)
-	name := strings.TrimSuffix(base, ext)
-	candidate := filepath.Join(dstDir, base)
+// Collision strategies for picking a destination name that is already taken.
+const (
+	collisionParens     = "numbered-parens"     // "name (1).ext" — the default
+	collisionUnderscore = "numbered-underscore" // "name_1.ext"
+	collisionTimestamp  = "timestamp"           // "name_20060102-150405.ext"
+	collisionFail       = "fail"                // EEXIST
+)
+
+func validCollision(strategy string) bool {
+	switch strategy {
+	case "", collisionParens, collisionUnderscore, collisionTimestamp, collisionFail:
+		return true
+	}
+	return false
+}
+
+// freeName returns the first free path in dir for name+ext under the given
+// collision strategy. The extension is kept at the end of the name.
+func freeName(dir, name, ext, strategy string) (string, *fsError) {
+	if !validCollision(strategy) {
+		return "", &fsError{Code: "ERR", Message: fmt.Sprintf("invalid collision strategy %q", strategy)}
+	}
+	candidate := filepath.Join(dir, name+ext)
+	stamp := time.Now().Format("20060102-150405")
 	for n := 1; n <= 1000; n++ {
 		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
-			return candidate
+			return candidate, nil
+		}
+		var next string
+		switch strategy {
+		case collisionFail:
+			return "", &fsError{Code: "EEXIST", Message: "destination already exists"}
+		case collisionUnderscore:
+			next = fmt.Sprintf("%s_%d", name, n)
+		case collisionTimestamp:
+			next = fmt.Sprintf("%s_%s", name, stamp)
+			if n > 1 {
+				next = fmt.Sprintf("%s_%s-%d", name, stamp, n-1)
+			}
+		default:
+			next = fmt.Sprintf("%s (%d)", name, n)
 		}
-		candidate = filepath.Join(dstDir, fmt.Sprintf("%s (%d)%s", name, n, ext))
+		candidate = filepath.Join(dir, next+ext)
+	}
+	return candidate, nil
+}
+
+// uniqueDst picks the destination for src inside dstDir.
+func uniqueDst(src, dstDir, strategy string) (string, *fsError) {
+	base := filepath.Base(src)
+	ext := filepath.Ext(base)
+	return freeName(dstDir, strings.TrimSuffix(base, ext), ext, strategy)
+}
+
+// copyOptions carries per-operation settings down the copy recursion.
+type copyOptions struct {
+	limiter         *rate.Limiter                // per-task I/O rate; nil = global cap only
+	workers         int                          // >1 copies directory trees with a worker pool
+	username        string                       // user the pool workers impersonate
+	group           string                       // primary group override for the pool workers
+	recreateSpecial bool                         // mkfifo/mknod special files instead of skipping them
+	notes           *copyNotes                   // collects skipped entries; may be nil
+	guard           *dirGuard                    // depth/cycle guard, set by copyAll
+	collision       string                       // how doCopy names a taken destination
+	resolve         func(src, dst string) string // collision "ask": overwrite | skip | rename
+	refuseXDev      bool                         // move: fail with EXDEV instead of copying across filesystems
+	report          func(progressInfo)           // receives progress events; nil = none
+	progress        *copyProgress                // byte counter for the current copy; may be nil
+	transform       transformer                  // rewrites each file's bytes; nil = plain copy
+	autoRename      bool                         // move: take a free name by collision instead of failing with EEXIST
+}
+
+// copyNotes collects per-entry notes from a (possibly parallel) copy.
+type copyNotes struct {
+	mu      sync.Mutex
+	skipped []string
+}
+
+func (n *copyNotes) skip(path, reason string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	n.skipped = append(n.skipped, path+": "+reason)
+	n.mu.Unlock()
+}
+
+func (n *copyNotes) list() []string {
+	if n == nil {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.skipped
+}
+
+const specialFileTypes = fs.ModeNamedPipe | fs.ModeSocket | fs.ModeDevice | fs.ModeCharDevice | fs.ModeIrregular
+
+// copySpecial handles FIFOs, sockets and device nodes, which must never be
+// opened for reading (opening a FIFO blocks until a writer appears). FIFOs
+// and devices are recreated when opts.recreateSpecial is set — device nodes
+// need CAP_MKNOD, so this usually only succeeds for root. Sockets are always
+// skipped: a socket file is meaningless without the process listening on it.
+func copySpecial(src, dst string, info fs.FileInfo, opts copyOptions) error {
+	mode := info.Mode()
+	if mode&fs.ModeSocket != 0 {
+		log.Printf("copy: skipping socket %s", src)
+		opts.notes.skip(src, "socket")
+		return nil
+	}
+	if !opts.recreateSpecial {
+		opts.notes.skip(src, "special file")
+		return nil
+	}
+	sys := info.Sys().(*syscall.Stat_t)
+	var err error
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		err = syscall.Mkfifo(dst, uint32(mode.Perm()))
+	case mode&fs.ModeCharDevice != 0:
+		err = syscall.Mknod(dst, syscall.S_IFCHR|uint32(mode.Perm()), int(sys.Rdev))
+	case mode&fs.ModeDevice != 0:
+		err = syscall.Mknod(dst, syscall.S_IFBLK|uint32(mode.Perm()), int(sys.Rdev))
+	default:
+		opts.notes.skip(src, "unsupported file type")
+		return nil
+	}
+	if err != nil {
+		opts.notes.skip(src, mapOsErr(&os.PathError{Op: "mknod", Path: dst, Err: err}).Message)
 	}
-	return candidate
+	return nil
 }
 
-func copyAll(src, dst string) error {
+// copyAll copies src to dst. If the copy fails, whatever it wrote at dst is
+// removed again, unless dst was already there (an "ask" overwrite merging
+// into an existing directory): that is not ours to delete.
+func copyAll(src, dst string, opts copyOptions) (err error) {
 	info, err := os.Lstat(src)
 	if err != nil {
 		return err
 	}
+	if _, statErr := os.Lstat(dst); os.IsNotExist(statErr) {
+		defer func() {
+			if err != nil {
+				_ = os.RemoveAll(dst)
+			}
+		}()
+	}
 	if info.IsDir() {
-		return copyDir(src, dst, info)
+		opts.guard = newDirGuard()
+		if opts.workers > 1 {
+			return copyDirParallel(src, dst, opts)
+		}
+		return copyDir(src, dst, info, 0, opts)
 	}
-	return copyFile(src, dst, info)
+	return copyFile(src, dst, info, opts)
 }
 
-func copyFile(src, dst string, info fs.FileInfo) error {
+func copyFile(src, dst string, info fs.FileInfo, opts copyOptions) error {
+	if info.Mode()&specialFileTypes != 0 {
+		return copySpecial(src, dst, info, opts)
+	}
 	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer in.Close()
-	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode())
+	created := err == nil
+	if os.IsExist(err) { // an "ask" overwrite
+		out, err = os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, info.Mode())
+	}
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(out, in); err != nil {
+	r := throttle(in, opts.limiter)
+	if opts.transform != nil {
+		err = runTransform(opts.transform, opts.progress.reader(r), out)
+	} else {
+		_, err = opts.progress.copy(out, r)
+	}
+	if err != nil {
 		out.Close()
+		if opts.transform != nil && created {
+			_ = os.Remove(dst) // a partial rewrite is worth nothing
+		}
+		return err
+	}
+	if err := out.Close(); err != nil {
 		return err
 	}
-	return out.Close()
+	return preserveSpecialBits(dst, info)
+}
+
+// preserveSpecialBits re-applies setuid/setgid/sticky after creation, since
+// OpenFile/Mkdir drop them (and the umask may have masked permission bits).
+func preserveSpecialBits(dst string, info fs.FileInfo) error {
+	if info.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky) == 0 {
+		return nil
+	}
+	return os.Chmod(dst, info.Mode()&(fs.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
 }
 
-func copyDir(src, dst string, info fs.FileInfo) error {
+func copyDir(src, dst string, info fs.FileInfo, depth int, opts copyOptions) error {
+	if err := opts.guard.enter(info, depth); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(dst, info.Mode()); err != nil {
 		return err
 	}
+	if err := preserveSpecialBits(dst, info); err != nil {
+		return err
+	}
 	entries, err := os.ReadDir(src)
 	if err != nil {
 		return err
@@ -249,11 +993,11 @@ func copyDir(src, dst string, info fs.FileInfo) error {
 			return err
 		}
 		if e.IsDir() {
-			if err := copyDir(s, d, ei); err != nil {
+			if err := copyDir(s, d, ei, depth+1, opts); err != nil {
 				return err
 			}
 		} else {
-			if err := copyFile(s, d, ei); err != nil {
+			if err := copyFile(s, d, ei, opts); err != nil {
 				return err
 			}
 		}
@@ -261,86 +1005,675 @@ func copyDir(src, dst string, info fs.FileInfo) error {
 	return nil
 }
 
-func doCopy(src, dstDir string) (*copyResult, *fsError) {
-	dst := uniqueDst(src, dstDir)
-	if err := copyAll(src, dst); err != nil {
-		return nil, mapOsErr(err)
+// copyDirParallel copies a tree in two passes: a single walk creates the whole
+// directory skeleton (so workers never race on MkdirAll) and collects the
+// files, then opts.workers goroutines copy the files. The first failure
+// cancels the remaining work and is returned.
+//
+// Credentials are per-thread, so each worker impersonates opts.username itself
+// rather than inheriting the caller's identity.
+//
+// Crossover, from BenchmarkCopyDir (5,000 × 4 KB files) on a 1-vCPU VM: ~0.7 s
+// serially and 1.0–1.6 s with 2–16 workers — slower, as the page cache
+// absorbs per-file latency and there is no spare core. The pool only
+// helps when per-file latency dominates and the device serves concurrent
+// requests (NVMe arrays, network filesystems) with cores to spare; on a single
+// spinning disk concurrent streams seek and get slower. Hence the serial
+// default (NASX_COPY_WORKERS=1): raise it only after measuring on the array.
+func copyDirParallel(src, dst string, opts copyOptions) error {
+	type fileJob struct {
+		src, dst string
+		info     fs.FileInfo
+	}
+	var files []fileJob
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if err := opts.guard.enter(info, relDepth(src, p)); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(target, info.Mode()); err != nil {
+				return err
+			}
+			return preserveSpecialBits(target, info)
+		}
+		files = append(files, fileJob{src: p, dst: target, info: info})
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	return &copyResult{Ok: true, Dst: dst}, nil
-}
-
-// ── move ──────────────────────────────────────────────────────────────────────
-
-type moveResult struct {
-	Ok  bool   `json:"ok"`
-	Dst string `json:"dst"`
-}
 
-func doMove(src, dstDir string) (*moveResult, *fsError) {
-	dst := filepath.Join(dstDir, filepath.Base(src))
-	if _, err := os.Lstat(dst); err == nil {
-		return nil, &fsError{Code: "EEXIST", Message: "destination already exists"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		firstErr error
+		errOnce  sync.Once
+		wg       sync.WaitGroup
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
 	}
-	err := os.Rename(src, dst)
-	if err != nil {
-		var linkErr *os.LinkError
-		if errors.As(err, &linkErr) {
-			if errno, ok := linkErr.Err.(syscall.Errno); ok && errno == syscall.EXDEV {
-				if err2 := copyAll(src, dst); err2 != nil {
-					return nil, mapOsErr(err2)
-				}
-				if err2 := os.RemoveAll(src); err2 != nil {
-					return nil, mapOsErr(err2)
+	jobs := make(chan fileJob)
+	for w := 0; w < opts.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := withUserGroup(opts.username, opts.group, func() error {
+				for j := range jobs {
+					if ctx.Err() != nil {
+						continue // drain after a failure
+					}
+					if err := copyFile(j.src, j.dst, j.info, opts); err != nil {
+						fail(err)
+					}
 				}
-				return &moveResult{Ok: true, Dst: dst}, nil
+				return nil
+			}); err != nil {
+				fail(err)
 			}
+		}()
+	}
+feed:
+	for _, j := range files {
+		select {
+		case jobs <- j:
+		case <-ctx.Done():
+			break feed
 		}
-		return nil, mapOsErr(err)
 	}
-	return &moveResult{Ok: true, Dst: dst}, nil
+	close(jobs)
+	wg.Wait()
+	return firstErr
 }
 
-// ── rename ────────────────────────────────────────────────────────────────────
-
-type renameResult struct {
-	Ok  bool   `json:"ok"`
+func doCopy(src, dstDir string, opts copyOptions) (*copyResult, *fsError) {
+	res := &copyResult{Ok: true}
+	var dst string
+	if opts.collision == collisionAsk {
+		var fsErr *fsError
+		dst, res.Conflict, fsErr = askConflict(src, filepath.Join(dstDir, filepath.Base(src)), opts)
+		if fsErr != nil {
+			return nil, fsErr
+		}
+		if res.Conflict == conflictSkip {
+			return res, nil
+		}
+	} else {
+		var fsErr *fsError
+		if dst, fsErr = uniqueDst(src, dstDir, opts.collision); fsErr != nil {
+			return nil, fsErr
+		}
+	}
+	opts.notes = &copyNotes{}
+	if err := copyAll(src, dst, opts); err != nil {
+		return nil, mapOsErr(err)
+	}
+	res.Dst, res.Skipped = dst, opts.notes.list()
+	return res, nil
+}
+
+// askConflict resolves the destination for collision "ask", returning the
+// path to use and the action taken, which is empty when dst was free. A
+// rename picks a free name next to dst. Overwriting replaces files and
+// merges into an existing directory; overwriting src with itself is turned
+// into a rename.
+func askConflict(src, dst string, opts copyOptions) (string, string, *fsError) {
+	if opts.resolve == nil {
+		return "", "", &fsError{Code: "ERR", Message: "collision \"ask\" needs a conflictSubject"}
+	}
+	if _, err := os.Lstat(dst); os.IsNotExist(err) {
+		return dst, "", nil
+	}
+	action := opts.resolve(src, dst)
+	if action == conflictOverwrite && filepath.Clean(src) == filepath.Clean(dst) {
+		action = conflictRename
+	}
+	var fsErr *fsError
+	if action == conflictRename {
+		dst, fsErr = uniqueDst(dst, filepath.Dir(dst), collisionParens)
+	}
+	return dst, action, fsErr
+}
+
+// ── move ──────────────────────────────────────────────────────────────────────
+
+type moveResult struct {
+	Ok          bool   `json:"ok"`
+	Dst         string `json:"dst"`
+	Conflict    string `json:"conflict,omitempty"`    // collision "ask": the action taken
+	CrossDevice bool   `json:"crossDevice,omitempty"` // moved by copy+delete rather than rename
+
+	CreatedDirs []string `json:"createdDirs,omitempty"` // createParents: directories made for dstDir
+}
+
+func doMove(src, dstDir string, opts copyOptions) (*moveResult, *fsError) {
+	return doMoveTo(src, filepath.Join(dstDir, filepath.Base(src)), opts)
+}
+
+// doMoveTo moves src to exactly dst, so a move and a rename happen as one
+// rename(2) when both are on the same filesystem. dst's parent must exist.
+// A taken dst fails with EEXIST unless opts.autoRename, with which the move
+// goes to a free name picked like doCopy's; the result's Dst says where. A
+// dst that only differs from src in case is a case change, not a collision.
+// An "ask" overwrite of a directory with a directory merges the two (see
+// mergeDir).
+func doMoveTo(src, dst string, opts copyOptions) (*moveResult, *fsError) {
+	dstDir := filepath.Dir(dst)
+	var conflict string
+	if isCaseOnlyRename(src, dst) {
+		if err := renameCase(src, dst); err != nil {
+			return nil, mapOsErr(err)
+		}
+		return &moveResult{Ok: true, Dst: dst}, nil
+	}
+	if opts.collision == collisionAsk {
+		var fsErr *fsError
+		if dst, conflict, fsErr = askConflict(src, dst, opts); fsErr != nil {
+			return nil, fsErr
+		}
+		if conflict == conflictSkip {
+			return &moveResult{Ok: true, Conflict: conflict}, nil
+		}
+	} else if _, err := os.Lstat(dst); err == nil {
+		if !opts.autoRename {
+			return nil, &fsError{Code: "EEXIST", Message: "destination already exists"}
+		}
+		var fsErr *fsError
+		if dst, fsErr = uniqueDst(dst, dstDir, opts.collision); fsErr != nil {
+			return nil, fsErr
+		}
+	}
+	// Decide up front rather than waiting for rename's EXDEV, so that a
+	// refused cross-device move fails before anything has been touched.
+	same, err := sameDevice(src, dstDir)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if same {
+		if conflict == conflictOverwrite {
+			err = os.Rename(src, dst)
+			if errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST) {
+				err = mergeDir(src, dst)
+			}
+		} else {
+			err = renameNoReplace(src, dst)
+		}
+		if err == nil {
+			return &moveResult{Ok: true, Dst: dst, Conflict: conflict}, nil
+		}
+		// Bind mounts share st_dev but still can't be renamed across.
+		if !errors.Is(err, syscall.EXDEV) {
+			return nil, mapOsErr(err)
+		}
+	}
+	if fsErr := moveAcrossDevices(src, dst, opts); fsErr != nil {
+		return nil, fsErr
+	}
+	return &moveResult{Ok: true, Dst: dst, Conflict: conflict, CrossDevice: true}, nil
+}
+
+// mergeDir moves the entries of directory src into directory dst, which
+// rename(2) won't replace while it has entries of its own: subdirectories
+// present in both are merged in turn, anything else in dst under a name src
+// also has is replaced. src is removed once empty. A failure part way
+// leaves the entries moved so far in dst and the rest in src.
+func mergeDir(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		s, d := filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())
+		if e.IsDir() {
+			if info, err := os.Lstat(d); err == nil && info.IsDir() {
+				if err := mergeDir(s, d); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := os.Rename(s, d); err != nil {
+			return err
+		}
+	}
+	return os.Remove(src)
+}
+
+// moveAcrossDevices moves src to dst by copying and then deleting the source.
+// With refuseXDev it only reports EXDEV, with the size that would be copied.
+func moveAcrossDevices(src, dst string, opts copyOptions) *fsError {
+	total := treeBytes(src)
+	if opts.refuseXDev {
+		return &fsError{Code: "EXDEV", Message: "source and destination are on different filesystems", Size: total}
+	}
+	opts.notes = &copyNotes{}
+	opts.progress = newCopyProgress(total, opts.report)
+	if err := copyAll(src, dst, opts); err != nil {
+		// copyAll has removed the partial dst; src is still intact.
+		return mapOsErr(err)
+	}
+	if skipped := opts.notes.list(); len(skipped) > 0 {
+		// Deleting the source would lose what we couldn't copy.
+		_ = os.RemoveAll(dst)
+		return &fsError{Code: "ERR", Message: "cannot move special files across filesystems: " + strings.Join(skipped, "; ")}
+	}
+	if err := os.RemoveAll(src); err != nil {
+		return mapOsErr(err)
+	}
+	return nil
+}
+
+// ── rename ────────────────────────────────────────────────────────────────────
+
+type renameResult struct {
+	Ok  bool   `json:"ok"`
 	Dst string `json:"dst"`
 }
 
 func doRename(path, newName string) (*renameResult, *fsError) {
 	dst := filepath.Join(filepath.Dir(path), newName)
-	if _, err := os.Lstat(dst); err == nil {
-		return nil, &fsError{Code: "EEXIST", Message: "destination already exists"}
+	rename := renameNoReplace
+	if isCaseOnlyRename(path, dst) {
+		rename = renameCase
 	}
-	if err := os.Rename(path, dst); err != nil {
+	if err := rename(path, dst); err != nil {
 		return nil, mapOsErr(err)
 	}
 	return &renameResult{Ok: true, Dst: dst}, nil
 }
 
+// isCaseOnlyRename reports whether dst is src's own name in a different
+// case on a filesystem that ignores case (vfat, exFAT, casefolded ext4,
+// some SMB mounts): dst then "exists", being src itself.
+func isCaseOnlyRename(src, dst string) bool {
+	return caseOnlyRename(src, dst, os.Lstat)
+}
+
+// caseOnlyRename is isCaseOnlyRename with lstat to look up both names, so
+// that a case-insensitive filesystem can be simulated on any other.
+func caseOnlyRename(src, dst string, lstat func(string) (fs.FileInfo, error)) bool {
+	from, to := filepath.Base(src), filepath.Base(dst)
+	if filepath.Dir(src) != filepath.Dir(dst) || from == to || !strings.EqualFold(from, to) {
+		return false
+	}
+	a, err := lstat(src)
+	if err != nil {
+		return false
+	}
+	b, err := lstat(dst)
+	return err == nil && os.SameFile(a, b)
+}
+
+// renameCase gives src the differently cased name dst by way of a temporary
+// name, since a direct rename is refused as EEXIST or, on some filesystems,
+// silently keeps the old case. If the second step fails src is put back.
+func renameCase(src, dst string) error {
+	tmp := filepath.Join(filepath.Dir(src), ".nasx-case-"+nuid.Next())
+	if err := renameNoReplace(src, tmp); err != nil {
+		return err
+	}
+	if err := renameNoReplace(tmp, dst); err != nil {
+		_ = os.Rename(tmp, src)
+		return err
+	}
+	return nil
+}
+
+// renameNoReplace renames src to dst unless dst exists. renameat2 with
+// RENAME_NOREPLACE makes the kernel refuse atomically, so nothing created at
+// dst in the meantime can be overwritten. Kernels or filesystems without it
+// (ENOSYS, EINVAL) get the racy check-then-rename.
+func renameNoReplace(src, dst string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, src, unix.AT_FDCWD, dst, unix.RENAME_NOREPLACE)
+	if err == unix.ENOSYS || err == unix.EINVAL {
+		if _, err := os.Lstat(dst); err == nil {
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EEXIST}
+		}
+		return os.Rename(src, dst)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: err}
+	}
+	return nil
+}
+
 // ── delete ────────────────────────────────────────────────────────────────────
 
-func doDelete(path string) *fsError {
-	if err := os.RemoveAll(path); err != nil {
+// doDelete removes path. Like rmdir versus rm -rf, a non-empty directory is
+// only removed with force; otherwise ENOTEMPTY reports how many entries it
+// holds so the UI can ask for confirmation. A forced delete of a tree deeper
+// than NASX_MAX_DEPTH or containing a directory cycle is refused up front
+// rather than left half-deleted. A path that is already gone is not an error.
+func doDelete(path string, force bool) *fsError {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return mapOsErr(err)
+	}
+	if info.IsDir() && force {
+		if fsErr := checkTree(path); fsErr != nil {
+			return fsErr
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return mapOsErr(err)
+		}
+		return nil
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return mapOsErr(err)
+		}
+		if len(entries) > 0 {
+			return &fsError{Code: "ENOTEMPTY", Message: fmt.Sprintf("directory not empty (%d items)", len(entries))}
+		}
+	}
+	if err := os.Remove(path); err != nil {
 		return mapOsErr(err)
 	}
 	return nil
 }
 
+type pruneResult struct {
+	Pruned []string `json:"pruned"` // removed directories, deepest first
+	Count  int      `json:"count"`
+	Notes  []string `json:"notes,omitempty"`
+}
+
+// doPruneEmpty removes the empty directories below root, bottom-up, so a
+// directory whose only contents were empty directories goes too. Files are
+// never touched and root itself is kept. A directory that can't be read or
+// removed (no write permission on its parent) is skipped with a note.
+func doPruneEmpty(root string) (*pruneResult, *fsError) {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if !info.IsDir() {
+		return nil, &fsError{Code: "ERR", Message: "not a directory"}
+	}
+	res := &pruneResult{Pruned: []string{}}
+	guard := newDirGuard()
+	// prune reports whether dir is empty once its subdirectories are pruned.
+	var prune func(dir string, info fs.FileInfo, depth int) (bool, error)
+	prune = func(dir string, info fs.FileInfo, depth int) (bool, error) {
+		if err := guard.enter(info, depth); err != nil {
+			return false, err
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			res.Notes = append(res.Notes, fmt.Sprintf("%s: %s", dir, mapOsErr(err).Message))
+			return false, nil
+		}
+		left := len(entries)
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			p := filepath.Join(dir, e.Name())
+			ei, err := e.Info()
+			if err != nil {
+				continue
+			}
+			empty, err := prune(p, ei, depth+1)
+			if err != nil {
+				return false, err
+			}
+			if !empty {
+				continue
+			}
+			if err := os.Remove(p); err != nil {
+				res.Notes = append(res.Notes, fmt.Sprintf("%s: %s", p, mapOsErr(err).Message))
+				continue
+			}
+			res.Pruned = append(res.Pruned, p)
+			left--
+		}
+		return left == 0, nil
+	}
+	if _, err := prune(root, info, 0); err != nil {
+		return nil, mapOsErr(err)
+	}
+	res.Count = len(res.Pruned)
+	return res, nil
+}
+
+// ── sidecars ─────────────────────────────────────────────────────────────────
+
+// defaultSidecarPatterns match the lock and metadata files desktop clients
+// leave on shares: LibreOffice locks, Office owner files, AppleDouble files
+// and Finder's folder settings.
+var defaultSidecarPatterns = []string{".~lock.*#", "~$*", "._*", ".DS_Store"}
+
+type sidecarResult struct {
+	Removed []string `json:"removed"` // or, on a dry run, would be removed
+	Count   int      `json:"count"`
+	Notes   []string `json:"notes,omitempty"`
+}
+
+// doCleanSidecars removes the regular files in dir whose base name matches
+// one of patterns (filepath.Match syntax; none means
+// defaultSidecarPatterns), descending into subdirectories if recursive.
+// dryRun only lists them. Files that can't be removed, and directories that
+// can't be read, are skipped with a note.
+func doCleanSidecars(dir string, patterns []string, recursive, dryRun bool) (*sidecarResult, *fsError) {
+	if len(patterns) == 0 {
+		patterns = defaultSidecarPatterns
+	}
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil || strings.Contains(p, "/") {
+			return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("invalid pattern %q", p)}
+		}
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if !info.IsDir() {
+		return nil, &fsError{Code: "ERR", Message: "not a directory"}
+	}
+	matches := func(name string) bool {
+		for _, p := range patterns {
+			if ok, _ := filepath.Match(p, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	res := &sidecarResult{Removed: []string{}}
+	guard := newDirGuard()
+	var clean func(dir string, info fs.FileInfo, depth int) error
+	clean = func(dir string, info fs.FileInfo, depth int) error {
+		if err := guard.enter(info, depth); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			res.Notes = append(res.Notes, fmt.Sprintf("%s: %s", dir, mapOsErr(err).Message))
+			return nil
+		}
+		for _, e := range entries {
+			p := filepath.Join(dir, e.Name())
+			if e.IsDir() {
+				if !recursive {
+					continue
+				}
+				ei, err := e.Info()
+				if err != nil {
+					continue
+				}
+				if err := clean(p, ei, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			if !e.Type().IsRegular() || !matches(e.Name()) {
+				continue
+			}
+			if !dryRun {
+				if err := os.Remove(p); err != nil {
+					res.Notes = append(res.Notes, fmt.Sprintf("%s: %s", p, mapOsErr(err).Message))
+					continue
+				}
+			}
+			res.Removed = append(res.Removed, p)
+		}
+		return nil
+	}
+	if err := clean(dir, info, 0); err != nil {
+		return nil, mapOsErr(err)
+	}
+	res.Count = len(res.Removed)
+	return res, nil
+}
+
+// ── atomic write ──────────────────────────────────────────────────────────────
+
+// writeFileAtomic writes data to a hidden temp file in dst's directory (so the
+// rename stays on one filesystem), fsyncs it and renames it over dst. Readers
+// see either the old content or the new, never a torn file.
+func writeFileAtomic(dst string, data []byte, mode fs.FileMode) error {
+	tmpName, err := writeTemp(filepath.Dir(dst), data, mode)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName) // no-op once renamed
+	return os.Rename(tmpName, dst)
+}
+
+// writeTemp writes data to a new hidden temp file in dir, fsyncs it and sets
+// mode. The caller renames it into place or removes it.
+func writeTemp(dir string, data []byte, mode fs.FileMode) (string, error) {
+	tmp, err := os.CreateTemp(dir, ".nasx-tmp-*")
+	if err != nil {
+		return "", err
+	}
+	tmpName := tmp.Name()
+	fail := func(err error) (string, error) {
+		tmp.Close()
+		os.Remove(tmpName)
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	// Explicit chmod: CreateTemp uses 0600 and the umask would mask mode anyway.
+	if err := tmp.Chmod(mode); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+	return tmpName, nil
+}
+
 // ── assemble ──────────────────────────────────────────────────────────────────
 
-func doAssemble(destFile string, chunks []string) *fsError {
-	out, err := os.OpenFile(destFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+// doAssemble concatenates chunks into destFile. Chunks staged in place are
+// appended straight into destFile. Chunks from a dedicated staging area
+// (stagingDir set) are assembled into a temp file that is then renamed into
+// place, so destFile never shows a partial upload: the temp file lives next
+// to the chunks when they share destFile's filesystem, making the final move
+// free, and next to destFile otherwise. The file gets mode by an explicit
+// chmod, as the umask would mask it at creation.
+func doAssemble(destFile string, chunks []string, stagingDir string, mode fs.FileMode, limiter *rate.Limiter) *fsError {
+	if stagingDir == "" {
+		_, statErr := os.Lstat(destFile)
+		out, err := os.OpenFile(destFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return mapOsErr(err)
+		}
+		fsErr := appendChunks(out, chunks, limiter)
+		if fsErr == nil {
+			fsErr = mapOsErr(out.Chmod(mode))
+		}
+		out.Close()
+		if fsErr != nil && os.IsNotExist(statErr) {
+			// Don't leave a truncated upload behind.
+			_ = os.Remove(destFile)
+		}
+		return fsErr
+	}
+	return mapOsErr(assembleAtomic(destFile, chunks, stagingDir, mode, limiter, ""))
+}
+
+// assembleAtomic assembles chunks into a temp file that is renamed to
+// destFile, next to the chunks in stagingDir if that shares destFile's
+// filesystem and next to destFile otherwise. With wantSha256 set the result
+// must hash to it, or destFile is left untouched.
+func assembleAtomic(destFile string, chunks []string, stagingDir string, mode fs.FileMode, limiter *rate.Limiter, wantSha256 string) error {
+	destDir := filepath.Dir(destFile)
+	if same, err := sameDevice(stagingDir, destDir); err == nil && same {
+		err := assembleVia(stagingDir, destFile, chunks, mode, limiter, wantSha256)
+		// A bind mount can share st_dev and still refuse the rename.
+		if !errors.Is(err, syscall.EXDEV) {
+			return err
+		}
+	}
+	return assembleVia(destDir, destFile, chunks, mode, limiter, wantSha256)
+}
+
+// assembleVia builds the file in a temp file in dir and renames it to
+// destFile.
+func assembleVia(dir, destFile string, chunks []string, mode fs.FileMode, limiter *rate.Limiter, wantSha256 string) error {
+	tmp, err := os.CreateTemp(dir, ".nasx-tmp-*")
 	if err != nil {
-		return mapOsErr(err)
+		return err
 	}
-	defer out.Close()
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	var out io.Writer = tmp
+	h := sha256.New()
+	if wantSha256 != "" {
+		out = io.MultiWriter(tmp, h)
+	}
+	if fsErr := appendChunks(out, chunks, limiter); fsErr != nil {
+		tmp.Close()
+		return fsErr
+	}
+	if wantSha256 != "" {
+		if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, wantSha256) {
+			tmp.Close()
+			return &fsError{Code: "ECHECKSUM", Message: fmt.Sprintf("assembled file has sha256 %s, expected %s", got, wantSha256)}
+		}
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), destFile)
+}
+
+func appendChunks(out io.Writer, chunks []string, limiter *rate.Limiter) *fsError {
 	for _, chunk := range chunks {
 		f, err := os.Open(chunk)
 		if err != nil {
 			return mapOsErr(err)
 		}
-		_, cpErr := io.Copy(out, f)
+		_, cpErr := io.Copy(out, throttle(f, limiter))
 		f.Close()
 		if cpErr != nil {
 			return &fsError{Code: "ERR", Message: cpErr.Error()}
@@ -349,19 +1682,361 @@ func doAssemble(destFile string, chunks []string) *fsError {
 	return nil
 }
 
+// ── split ─────────────────────────────────────────────────────────────────────
+
+// maxSplitParts caps how many parts one split may produce
+// (NASX_MAX_SPLIT_PARTS).
+var maxSplitParts = max(getenvInt("NASX_MAX_SPLIT_PARTS", 1000), 1)
+
+type splitResult struct {
+	Parts    []string `json:"parts"`
+	Size     int64    `json:"size"`
+	PartSize int64    `json:"partSize"`
+}
+
+// doSplit is the counterpart of assemble: it streams path into dstDir as
+// "<name>.part001", "<name>.part002", ... of partSize bytes each, the last
+// one holding the remainder. Existing parts are never overwritten, and on
+// failure the parts already written are removed again.
+func doSplit(path, dstDir string, partSize int64, opts copyOptions) (*splitResult, *fsError) {
+	if partSize <= 0 {
+		return nil, &fsError{Code: "ERR", Message: "invalid partSize"}
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, &fsError{Code: "ERR", Message: "not a regular file"}
+	}
+	n := max((info.Size()+partSize-1)/partSize, 1)
+	if n > int64(maxSplitParts) {
+		return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("split would produce %d parts (max %d)", n, maxSplitParts)}
+	}
+	width := max(len(strconv.FormatInt(n, 10)), 3)
+	progress := newCopyProgress(info.Size(), opts.report)
+	src := progress.reader(throttle(in, opts.limiter))
+
+	res := &splitResult{Parts: []string{}, Size: info.Size(), PartSize: partSize}
+	fail := func(err error) (*splitResult, *fsError) {
+		for _, p := range res.Parts {
+			_ = os.Remove(p)
+		}
+		return nil, mapOsErr(err)
+	}
+	for i := int64(1); i <= n; i++ {
+		name := fmt.Sprintf("%s.part%0*d", filepath.Base(path), width, i)
+		part := filepath.Join(dstDir, name)
+		out, err := os.OpenFile(part, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+		if err != nil {
+			return fail(err)
+		}
+		res.Parts = append(res.Parts, part)
+		_, err = io.CopyN(out, src, partSize)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		// A short last part ends in EOF; anything else short means the file
+		// shrank under us.
+		if err != nil && !(err == io.EOF && i == n) {
+			return fail(err)
+		}
+	}
+	return res, nil
+}
+
 // ── chmod ─────────────────────────────────────────────────────────────────────
 
+// parseMode parses an octal mode string ("755", "2775", "4755") into an
+// fs.FileMode, translating the Unix special bits into their Go equivalents
+// (a raw 04000 in an fs.FileMode is not recognised as setuid by os.Chmod).
+func parseMode(modeStr string) (fs.FileMode, error) {
+	n, err := strconv.ParseUint(modeStr, 8, 32)
+	if err != nil || n > 07777 {
+		return 0, fmt.Errorf("invalid mode %q", modeStr)
+	}
+	mode := fs.FileMode(n) & fs.ModePerm
+	if n&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if n&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if n&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
 func doChmod(path, modeStr string) *fsError {
-	mode, err := strconv.ParseUint(modeStr, 8, 32)
+	mode, err := parseMode(modeStr)
 	if err != nil {
-		return &fsError{Code: "ERR", Message: fmt.Sprintf("invalid mode %q", modeStr)}
+		return &fsError{Code: "ERR", Message: err.Error()}
 	}
-	if err := os.Chmod(path, fs.FileMode(mode)); err != nil {
+	if err := os.Chmod(path, mode); err != nil {
 		return mapOsErr(err)
 	}
 	return nil
 }
 
+// ── permission batches ────────────────────────────────────────────────────────
+
+// maxPermBatch caps the changes in one perms-batch (NASX_MAX_PERM_BATCH).
+var maxPermBatch = max(getenvInt("NASX_MAX_PERM_BATCH", 1000), 1)
+
+// permEdit is one entry of a perms-batch; empty fields are left alone.
+type permEdit struct {
+	Path  string `json:"path"`
+	Mode  string `json:"mode"`  // octal, as for chmod
+	Owner string `json:"owner"` // user name or uid
+	Group string `json:"group"` // group name or gid
+}
+
+type permBatchResult struct {
+	Committed bool `json:"committed"`
+	Applied   int  `json:"applied"`
+}
+
+// resolvedPerm is a permEdit with its names and mode resolved, and its
+// target opened.
+type resolvedPerm struct {
+	path     string
+	fd       int    // O_PATH, never following a symlink
+	mode     uint32 // permission and setuid/setgid/sticky bits
+	hasMode  bool
+	uid, gid int // -1 = unchanged
+}
+
+// priorPerm records an entry's mode and owner before the batch.
+type priorPerm struct {
+	mode     uint32
+	uid, gid int
+}
+
+// unixMode converts m to chmod(2) bits.
+func unixMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= unix.S_ISUID
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= unix.S_ISGID
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= unix.S_ISVTX
+	}
+	return mode
+}
+
+// fdPerm reads the mode and owner of the file open at fd.
+func fdPerm(fd int) (priorPerm, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return priorPerm{}, err
+	}
+	return priorPerm{mode: st.Mode & 07777, uid: int(st.Uid), gid: int(st.Gid)}, nil
+}
+
+// applyPerm changes the file open at fd, owner first: chown clears
+// setuid/setgid, which the mode may set. An O_PATH descriptor can't be
+// fchmod'ed, so the mode goes through its /proc/self/fd link, which names
+// the open inode itself however the path has changed since.
+func applyPerm(r resolvedPerm) error {
+	if r.uid >= 0 || r.gid >= 0 {
+		if err := unix.Fchownat(r.fd, "", r.uid, r.gid, unix.AT_EMPTY_PATH); err != nil {
+			return &os.PathError{Op: "chown", Path: r.path, Err: err}
+		}
+	}
+	if r.hasMode {
+		if err := unix.Chmod(fmt.Sprintf("/proc/self/fd/%d", r.fd), r.mode); err != nil {
+			return &os.PathError{Op: "chmod", Path: r.path, Err: err}
+		}
+	}
+	return nil
+}
+
+// doPermBatch applies changes all or nothing. Everything is validated, every
+// target opened and its mode and owner recorded before the first change; if
+// a change then fails, the entries already touched are put back as
+// recorded, in reverse order, and the batch fails, its error saying what was
+// restored and what couldn't be. Targets are opened without following
+// symlinks and changed through that descriptor, so a path swapped for a
+// symlink after the check can't redirect a change. Symlinks themselves are
+// refused, as chmod would follow them.
+func doPermBatch(changes []permEdit) (*permBatchResult, *fsError) {
+	if len(changes) == 0 {
+		return nil, &fsError{Code: "ERR", Message: "no changes"}
+	}
+	if len(changes) > maxPermBatch {
+		return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("too many changes (%d, at most %d)", len(changes), maxPermBatch)}
+	}
+	resolved := make([]resolvedPerm, 0, len(changes))
+	defer func() {
+		for _, r := range resolved {
+			unix.Close(r.fd)
+		}
+	}()
+	prior := make([]priorPerm, len(changes))
+	for i, c := range changes {
+		r := resolvedPerm{path: c.Path, uid: -1, gid: -1}
+		if c.Mode == "" && c.Owner == "" && c.Group == "" {
+			return nil, &fsError{Code: "ERR", Message: c.Path + ": nothing to change"}
+		}
+		if c.Mode != "" {
+			mode, err := parseMode(c.Mode)
+			if err != nil {
+				return nil, &fsError{Code: "ERR", Message: c.Path + ": " + err.Error()}
+			}
+			r.mode, r.hasMode = unixMode(mode), true
+		}
+		if c.Owner != "" {
+			uid, err := lookupUid(c.Owner)
+			if err != nil {
+				return nil, &fsError{Code: "ERR", Message: c.Path + ": " + err.Error()}
+			}
+			r.uid = uid
+		}
+		if c.Group != "" {
+			gid, err := lookupGid(c.Group)
+			if err != nil {
+				return nil, &fsError{Code: "ERR", Message: c.Path + ": " + err.Error()}
+			}
+			r.gid = gid
+		}
+		fd, err := unix.Open(c.Path, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, mapOsErr(&os.PathError{Op: "open", Path: c.Path, Err: err})
+		}
+		r.fd = fd
+		resolved = append(resolved, r)
+		var st unix.Stat_t
+		if err := unix.Fstat(fd, &st); err != nil {
+			return nil, mapOsErr(&os.PathError{Op: "stat", Path: c.Path, Err: err})
+		}
+		if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			return nil, &fsError{Code: "ERR", Message: c.Path + ": cannot change a symbolic link"}
+		}
+		prior[i] = priorPerm{mode: st.Mode & 07777, uid: int(st.Uid), gid: int(st.Gid)}
+	}
+
+	res := &permBatchResult{}
+	for i, r := range resolved {
+		err := applyPerm(r)
+		if err == nil {
+			res.Applied++
+			continue
+		}
+		fe := mapOsErr(err)
+		msg := fmt.Sprintf("%s: %s", r.path, fe.Message)
+		rolledBack := 0
+		var inconsistent []string
+		// The failed entry may be half-changed too.
+		for j := i; j >= 0; j-- {
+			p := prior[j]
+			if now, err := fdPerm(resolved[j].fd); j == i && err == nil && now == p {
+				continue
+			}
+			err := applyPerm(resolvedPerm{path: resolved[j].path, fd: resolved[j].fd, mode: p.mode, hasMode: true, uid: p.uid, gid: p.gid})
+			if err != nil {
+				inconsistent = append(inconsistent, fmt.Sprintf("%s (%s)", resolved[j].path, mapOsErr(err).Message))
+				continue
+			}
+			rolledBack++
+		}
+		msg += fmt.Sprintf("; batch rolled back, %d entries restored", rolledBack)
+		if len(inconsistent) > 0 {
+			msg += fmt.Sprintf(", %d left with some of its changes: %s", len(inconsistent), strings.Join(inconsistent, ", "))
+		}
+		return nil, &fsError{Code: fe.Code, Message: msg}
+	}
+	res.Committed = true
+	return res, nil
+}
+
+// ── normalize permissions ─────────────────────────────────────────────────────
+
+type normalizeResult struct {
+	Files  int            `json:"files"`
+	Dirs   int            `json:"dirs"`
+	Failed []batchFailure `json:"failed,omitempty"`
+}
+
+// doNormalizePerms gives every regular file under root fileMode and every
+// directory dirMode, in one walk. A directory keeps its setgid bit, which
+// makes new files inherit its group, but files lose setuid/setgid: this is
+// for cleaning up imported trees, not for installing programs. Each
+// directory is chmodded before it is read, so one that lacked execute
+// permission can still be descended into. Symlinks and special files are
+// left alone; per-entry failures are collected and the walk goes on.
+func doNormalizePerms(root, fileModeStr, dirModeStr string, report func(progressInfo)) (*normalizeResult, *fsError) {
+	if fileModeStr == "" {
+		fileModeStr = "644"
+	}
+	if dirModeStr == "" {
+		dirModeStr = "755"
+	}
+	fileMode, err := parseMode(fileModeStr)
+	if err != nil {
+		return nil, &fsError{Code: "ERR", Message: err.Error()}
+	}
+	dirMode, err := parseMode(dirModeStr)
+	if err != nil {
+		return nil, &fsError{Code: "ERR", Message: err.Error()}
+	}
+	fileMode &^= os.ModeSetuid | os.ModeSetgid
+
+	res := &normalizeResult{}
+	progress := newCopyProgress(0, report)
+	guard := newDirGuard()
+	fail := func(p string, err error) {
+		fe := mapOsErr(err)
+		res.Failed = append(res.Failed, batchFailure{Path: p, Code: fe.Code, Message: fe.Message})
+	}
+	walkErr := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root && d == nil {
+				return err
+			}
+			fail(p, err)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			fail(p, err)
+			return nil
+		}
+		defer progress.addItem()
+		switch {
+		case info.IsDir():
+			if err := guard.enter(info, relDepth(root, p)); err != nil {
+				return err
+			}
+			mode := dirMode | info.Mode()&os.ModeSetgid
+			if err := os.Chmod(p, mode); err != nil {
+				fail(p, err)
+				return nil
+			}
+			res.Dirs++
+		case info.Mode().IsRegular():
+			if err := os.Chmod(p, fileMode); err != nil {
+				fail(p, err)
+				return nil
+			}
+			res.Files++
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return nil, mapOsErr(walkErr)
+	}
+	return res, nil
+}
+
 // ── chown ─────────────────────────────────────────────────────────────────────
 
 func doChown(path, ownerStr, groupStr string) *fsError {
@@ -392,3 +2067,266 @@ func doChown(path, ownerStr, groupStr string) *fsError {
 	}
 	return nil
 }
+
+// minChownUid is the lowest uid a move or chown-ref may re-own a tree to
+// (NASX_CHOWN_MIN_UID). Below it are root and the system accounts, which
+// must never be handed a user's files: a setuid binary moved in and given to
+// root would be a root shell.
+var minChownUid = max(getenvInt("NASX_CHOWN_MIN_UID", 1000), 1)
+
+// resolveChownTarget resolves a username or numeric uid to the user's uid and
+// primary gid. The user must exist so that a typo can't strand files under an
+// unowned uid, and must be a regular account (see minChownUid).
+func resolveChownTarget(target string) (int, int, *fsError) {
+	name := target
+	if _, err := strconv.Atoi(target); err == nil {
+		u, err := user.LookupId(target)
+		if err != nil {
+			return 0, 0, &fsError{Code: "ERR", Message: fmt.Sprintf("unknown user %q", target)}
+		}
+		name = u.Username
+	}
+	ctx, err := resolveUser(name)
+	if err != nil {
+		return 0, 0, &fsError{Code: "ERR", Message: fmt.Sprintf("unknown user %q", target)}
+	}
+	if int(ctx.uid) < minChownUid {
+		return 0, 0, &fsError{Code: "EPERM", Message: fmt.Sprintf("cannot give files to %q: system accounts (uid below %d) are not allowed", target, minChownUid)}
+	}
+	return int(ctx.uid), int(ctx.gid), nil
+}
+
+type ownerRecord struct {
+	path     string
+	uid, gid int
+}
+
+// chownTree recursively chowns root and everything below it (without
+// following symlinks). If any entry fails, entries already changed are
+// restored to their previous owner so the tree isn't left half-converted.
+func chownTree(root string, uid, gid int) *fsError {
+	var done []ownerRecord
+	guard := newDirGuard()
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if err := guard.enter(info, relDepth(root, p)); err != nil {
+				return err
+			}
+		}
+		sys := info.Sys().(*syscall.Stat_t)
+		if err := os.Lchown(p, uid, gid); err != nil {
+			return err
+		}
+		done = append(done, ownerRecord{path: p, uid: int(sys.Uid), gid: int(sys.Gid)})
+		return nil
+	})
+	if err != nil {
+		for i := len(done) - 1; i >= 0; i-- {
+			_ = os.Lchown(done[i].path, done[i].uid, done[i].gid)
+		}
+		return mapOsErr(err)
+	}
+	return nil
+}
+
+// chownRefResult is the outcome of doChownRef.
+type chownRefResult struct {
+	Uid       int            `json:"uid"`
+	Gid       int            `json:"gid"`
+	Changed   int            `json:"changed"`
+	Unchanged int            `json:"unchanged"` // already owned like the reference
+	Failed    []batchFailure `json:"failed,omitempty"`
+}
+
+// doChownRef gives root and everything below it (without following
+// symlinks) the owner and group of refPath, like chown --reference -R.
+// Unlike chownTree it doesn't roll back: a failing entry is recorded and
+// the walk goes on, since bringing a share in line is worth finishing.
+// refPath itself must not be a symlink, which could lend the tree the owner
+// of anything on the system, and must belong to a regular account.
+func doChownRef(root, refPath string, report func(progressInfo)) (*chownRefResult, *fsError) {
+	ref, err := os.Lstat(refPath)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if ref.Mode()&os.ModeSymlink != 0 {
+		return nil, &fsError{Code: "ERR", Message: "the reference is a symbolic link"}
+	}
+	refSys := ref.Sys().(*syscall.Stat_t)
+	if int(refSys.Uid) < minChownUid {
+		return nil, &fsError{Code: "EPERM", Message: fmt.Sprintf("cannot give files the owner of %s: system accounts (uid below %d) are not allowed", refPath, minChownUid)}
+	}
+	res := &chownRefResult{Uid: int(refSys.Uid), Gid: int(refSys.Gid)}
+	progress := newCopyProgress(0, report)
+	guard := newDirGuard()
+	fail := func(p string, err error) {
+		fe := mapOsErr(err)
+		res.Failed = append(res.Failed, batchFailure{Path: p, Code: fe.Code, Message: fe.Message})
+	}
+	walkErr := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root && d == nil {
+				return err
+			}
+			fail(p, err)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			fail(p, err)
+			return nil
+		}
+		defer progress.addItem()
+		if d.IsDir() {
+			if err := guard.enter(info, relDepth(root, p)); err != nil {
+				return err
+			}
+		}
+		sys := info.Sys().(*syscall.Stat_t)
+		if sys.Uid == refSys.Uid && sys.Gid == refSys.Gid {
+			res.Unchanged++
+			return nil
+		}
+		if err := os.Lchown(p, res.Uid, res.Gid); err != nil {
+			fail(p, err)
+			return nil
+		}
+		res.Changed++
+		return nil
+	})
+	if walkErr != nil {
+		return nil, mapOsErr(walkErr)
+	}
+	return res, nil
+}
+
+// ownershipSampleSize caps the offending paths doAuditOwnership reports.
+const ownershipSampleSize = 100
+
+type ownershipMismatch struct {
+	Path string `json:"path"`
+	Uid  int    `json:"uid"`
+	Gid  int    `json:"gid"`
+}
+
+type ownershipAuditResult struct {
+	Uid        int                 `json:"uid"`
+	Gid        int                 `json:"gid"`
+	Checked    int                 `json:"checked"`
+	Mismatched int                 `json:"mismatched"`
+	Fixed      int                 `json:"fixed"`
+	Sample     []ownershipMismatch `json:"sample"` // the first ownershipSampleSize mismatches, with their owner as found
+	Failed     []batchFailure      `json:"failed,omitempty"`
+}
+
+// doAuditOwnership finds the entries under root (without following
+// symlinks) not owned by expectedUser and their primary group, the usual
+// state of a home after a restore or migration. With fix it chowns them
+// too, going on past failures like doChownRef.
+func doAuditOwnership(root, expectedUser string, fix bool, report func(progressInfo)) (*ownershipAuditResult, *fsError) {
+	uid, gid, fsErr := resolveChownTarget(expectedUser)
+	if fsErr != nil {
+		return nil, fsErr
+	}
+	res := &ownershipAuditResult{Uid: uid, Gid: gid, Sample: []ownershipMismatch{}}
+	progress := newCopyProgress(0, report)
+	guard := newDirGuard()
+	fail := func(p string, err error) {
+		fe := mapOsErr(err)
+		res.Failed = append(res.Failed, batchFailure{Path: p, Code: fe.Code, Message: fe.Message})
+	}
+	walkErr := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root && d == nil {
+				return err
+			}
+			fail(p, err)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			fail(p, err)
+			return nil
+		}
+		defer progress.addItem()
+		if d.IsDir() {
+			if err := guard.enter(info, relDepth(root, p)); err != nil {
+				return err
+			}
+		}
+		res.Checked++
+		sys := info.Sys().(*syscall.Stat_t)
+		if int(sys.Uid) == uid && int(sys.Gid) == gid {
+			return nil
+		}
+		res.Mismatched++
+		if len(res.Sample) < ownershipSampleSize {
+			res.Sample = append(res.Sample, ownershipMismatch{Path: p, Uid: int(sys.Uid), Gid: int(sys.Gid)})
+		}
+		if fix {
+			if err := os.Lchown(p, uid, gid); err != nil {
+				fail(p, err)
+				return nil
+			}
+			res.Fixed++
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return nil, mapOsErr(walkErr)
+	}
+	return res, nil
+}
+
+// ── set times ─────────────────────────────────────────────────────────────────
+
+type setTimesResult struct {
+	Mtime string `json:"mtime"`
+	Atime string `json:"atime"`
+}
+
+// parseTimeArg parses an RFC3339 timestamp or one of the sentinels "now" and
+// "omit" (also the empty string). Omit yields the zero time, which os.Chtimes
+// leaves unchanged.
+func parseTimeArg(s string) (time.Time, error) {
+	switch s {
+	case "", "omit":
+		return time.Time{}, nil
+	case "now":
+		return time.Now(), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func doSetTimes(path, mtimeStr, atimeStr string) (*setTimesResult, *fsError) {
+	mtime, err := parseTimeArg(mtimeStr)
+	if err != nil {
+		return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("invalid mtime %q", mtimeStr)}
+	}
+	atime, err := parseTimeArg(atimeStr)
+	if err != nil {
+		return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("invalid atime %q", atimeStr)}
+	}
+	if mtime.IsZero() && atime.IsZero() {
+		return nil, &fsError{Code: "ERR", Message: "nothing to set: both times omitted"}
+	}
+	if err := os.Chtimes(path, atime, mtime); err != nil {
+		return nil, mapOsErr(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	at := info.Sys().(*syscall.Stat_t).Atim
+	return &setTimesResult{
+		Mtime: info.ModTime().UTC().Format(time.RFC3339Nano),
+		Atime: time.Unix(at.Sec, at.Nsec).UTC().Format(time.RFC3339Nano),
+	}, nil
+}
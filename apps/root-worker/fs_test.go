@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestCopyKeepsSetuid checks that a copied 4755 file is still 4755: the
+// create drops the setuid bit and preserveSpecialBits has to put it back.
+func TestCopyKeepsSetuid(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := os.WriteFile(src, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(src, 0755|fs.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyAll(src, dst, copyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky), 0755|fs.ModeSetuid; got != want {
+		t.Errorf("copy has mode %v, want %v", got, want)
+	}
+}
+
+// TestCopySkipsFifo copies a tree holding a FIFO, which a copy that opened it
+// for reading would block on forever. The copy must finish, skipping the
+// FIFO or, with recreateSpecial, making a new one.
+func TestCopySkipsFifo(t *testing.T) {
+	for _, recreate := range []bool{false, true} {
+		dir := t.TempDir()
+		src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+		if err := os.Mkdir(src, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Mkfifo(filepath.Join(src, "pipe"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, "file"), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		notes := &copyNotes{}
+		done := make(chan error, 1)
+		go func() { done <- copyAll(src, dst, copyOptions{recreateSpecial: recreate, notes: notes}) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("recreateSpecial %v: %v", recreate, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("recreateSpecial %v: copy blocked on the FIFO", recreate)
+		}
+		if _, err := os.Stat(filepath.Join(dst, "file")); err != nil {
+			t.Errorf("recreateSpecial %v: regular file not copied: %v", recreate, err)
+		}
+		info, err := os.Lstat(filepath.Join(dst, "pipe"))
+		switch {
+		case recreate && (err != nil || info.Mode()&fs.ModeNamedPipe == 0):
+			t.Errorf("recreateSpecial: FIFO not recreated (%v)", err)
+		case !recreate && !os.IsNotExist(err):
+			t.Errorf("FIFO copied without recreateSpecial (%v)", err)
+		case !recreate && len(notes.list()) != 1:
+			t.Errorf("skipped = %v, want the FIFO", notes.list())
+		}
+	}
+}
+
+// failingTree makes a source tree whose copy fails part way: "z" is a
+// symlink to a directory, which copyFile follows and can't read.
+func failingTree(t *testing.T, src string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "sub/c"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("sub", filepath.Join(src, "z")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCopyFailureLeavesNoPartialDst fails a tree copy after its first files
+// and checks that none of the copy is left behind.
+func TestCopyFailureLeavesNoPartialDst(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		dir := t.TempDir()
+		src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+		failingTree(t, src)
+		if err := copyAll(src, dst, copyOptions{workers: workers}); err == nil {
+			t.Fatalf("workers %d: copy succeeded despite the unreadable entry", workers)
+		}
+		if _, err := os.Lstat(dst); !os.IsNotExist(err) {
+			t.Errorf("workers %d: partial destination left behind (%v)", workers, err)
+		}
+	}
+}
+
+// TestCopyFailureKeepsExistingDst checks that a failed copy merging into a
+// directory that was already there (an "ask" overwrite) doesn't delete it.
+func TestCopyFailureKeepsExistingDst(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	failingTree(t, src)
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dst, "keep"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyAll(src, dst, copyOptions{}); err == nil {
+		t.Fatal("copy succeeded despite the unreadable entry")
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "keep")); err != nil {
+		t.Errorf("existing destination removed: %v", err)
+	}
+}
+
+// failingTransform is a transformer that always fails.
+func failingTransform(context.Context, io.Reader, io.Writer) error {
+	return errors.New("injected failure")
+}
+
+// TestTransformFailureKeepsExistingDst checks that a failed transform into a
+// file that was already there (an "ask" overwrite) doesn't delete it, while
+// the partial rewrite of a new file is removed.
+func TestTransformFailureKeepsExistingDst(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, p := range []string{src, dst} {
+		if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := copyAll(src, dst, copyOptions{transform: failingTransform}); err == nil {
+		t.Fatal("copy succeeded despite the injected failure")
+	}
+	if _, err := os.Lstat(dst); err != nil {
+		t.Errorf("existing destination removed: %v", err)
+	}
+
+	fresh := filepath.Join(dir, "fresh")
+	if err := copyAll(src, fresh, copyOptions{transform: failingTransform}); err == nil {
+		t.Fatal("copy succeeded despite the injected failure")
+	}
+	if _, err := os.Lstat(fresh); !os.IsNotExist(err) {
+		t.Errorf("partial rewrite left behind (%v)", err)
+	}
+}
+
+// foldingLstat is os.Lstat as on a case-insensitive filesystem: a name
+// matches an entry of its directory whatever its case.
+func foldingLstat(path string) (fs.FileInfo, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if strings.EqualFold(e.Name(), filepath.Base(path)) {
+			return os.Lstat(filepath.Join(filepath.Dir(path), e.Name()))
+		}
+	}
+	return nil, &fs.PathError{Op: "lstat", Path: path, Err: syscall.ENOENT}
+}
+
+// TestCaseOnlyRename checks the case-only rename detection on a simulated
+// case-insensitive filesystem, then that renameCase changes just the case.
+func TestCaseOnlyRename(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "Report.txt")
+	for _, p := range []string{src, filepath.Join(dir, "other.txt")} {
+		if err := os.WriteFile(p, []byte(filepath.Base(p)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		dst  string
+		want bool
+	}{
+		{"REPORT.TXT", true},
+		{"report.txt", true},
+		{"Report.txt", false},     // same name
+		{"other.txt", false},      // another file
+		{"sub/report.txt", false}, // another directory
+		{"Report.txt.bak", false}, // not the same name at all
+		{"missing.txt", false},    // doesn't exist
+	} {
+		if got := caseOnlyRename(src, filepath.Join(dir, tc.dst), foldingLstat); got != tc.want {
+			t.Errorf("caseOnlyRename(Report.txt, %s) = %v, want %v", tc.dst, got, tc.want)
+		}
+	}
+	// A case-sensitive filesystem holds two different files here.
+	if caseOnlyRename(src, filepath.Join(dir, "REPORT.TXT"), os.Lstat) {
+		t.Error("caseOnlyRename with os.Lstat: true for a name that doesn't exist")
+	}
+
+	dst := filepath.Join(dir, "report.txt")
+	if err := renameCase(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, ",") != "other.txt,report.txt,sub" {
+		t.Errorf("after renameCase the directory holds %v", names)
+	}
+	if data, err := os.ReadFile(dst); err != nil || string(data) != "Report.txt" {
+		t.Errorf("renamed file reads %q, %v", data, err)
+	}
+}
+
+// TestChownRefRefusesRef checks that chown-ref won't take its owner from a
+// symlink, which could point anywhere, or from a system account such as
+// root's "/", and that the tree is left alone when it refuses.
+func TestChownRefRefusesRef(t *testing.T) {
+	dir := t.TempDir()
+	tree, ref := filepath.Join(dir, "tree"), filepath.Join(dir, "ref")
+	if err := os.Mkdir(tree, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ref, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(ref, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Lstat(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ ref, code string }{
+		{filepath.Join(dir, "link"), "ERR"},
+		{"/", "EPERM"},
+	} {
+		if _, fsErr := doChownRef(tree, tc.ref, nil); fsErr == nil || fsErr.Code != tc.code {
+			t.Errorf("reference %s: got %v, want %s", tc.ref, fsErr, tc.code)
+		}
+	}
+	after, err := os.Lstat(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, a := before.Sys().(*syscall.Stat_t), after.Sys().(*syscall.Stat_t)
+	if a.Uid != b.Uid || a.Gid != b.Gid {
+		t.Errorf("tree re-owned to %d:%d", a.Uid, a.Gid)
+	}
+}
+
+// BenchmarkCopyDir copies a tree of 5,000 4 KB files serially (workers=1)
+// and with growing worker pools, to find where copyDirParallel pays off.
+// Point TMPDIR at the filesystem to measure.
+func BenchmarkCopyDir(b *testing.B) {
+	src := filepath.Join(b.TempDir(), "src")
+	data := make([]byte, 4096)
+	for i := 0; i < 5000; i++ {
+		dir := filepath.Join(src, fmt.Sprintf("d%02d", i%50))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%04d", i)), data, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for _, workers := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			dst := filepath.Join(b.TempDir(), "dst")
+			for i := 0; i < b.N; i++ {
+				if err := copyAll(src, dst, copyOptions{workers: workers}); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				if err := os.RemoveAll(dst); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
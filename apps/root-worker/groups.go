@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ── groups ────────────────────────────────────────────────────────────────────
+//
+// os/user can look a group up but not enumerate groups or their members, so
+// both are read from the group and passwd files. Like user.Lookup's pure-Go
+// fallback, this sees local accounts only, not ones served by LDAP or sssd.
+
+const (
+	groupFile  = "/etc/group"
+	passwdFile = "/etc/passwd"
+)
+
+type groupInfo struct {
+	Name string `json:"name"`
+	Gid  int    `json:"gid"`
+}
+
+type groupMembersResult struct {
+	Name    string   `json:"name"`
+	Gid     int      `json:"gid"`
+	Members []string `json:"members"` // sorted; includes users whose primary group it is
+}
+
+// readColonFile calls fn with the fields of each entry of an /etc/passwd
+// style file, skipping comments and NIS "+"/"-" lines.
+func readColonFile(path string, fn func(fields []string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20) // large groups make long lines
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == '+' || line[0] == '-' {
+			continue
+		}
+		fn(strings.Split(line, ":"))
+	}
+	return sc.Err()
+}
+
+// doListGroups returns every group in the group file, sorted by name.
+func doListGroups() ([]groupInfo, *fsError) {
+	groups := []groupInfo{}
+	err := readColonFile(groupFile, func(fields []string) {
+		if len(fields) < 3 {
+			return
+		}
+		if gid, err := strconv.Atoi(fields[2]); err == nil {
+			groups = append(groups, groupInfo{Name: fields[0], Gid: gid})
+		}
+	})
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, nil
+}
+
+// doGroupMembers returns the members of group, given by name or gid: the
+// users listed for it in the group file plus those whose primary group it
+// is, which the group file doesn't list.
+func doGroupMembers(group string) (*groupMembersResult, *fsError) {
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		if _, numErr := strconv.Atoi(group); numErr == nil {
+			g, err = user.LookupGroupId(group)
+		}
+	}
+	if err != nil {
+		return nil, &fsError{Code: "ENOENT", Message: fmt.Sprintf("unknown group %q", group)}
+	}
+	gid, _ := strconv.Atoi(g.Gid)
+
+	seen := map[string]bool{}
+	err = readColonFile(groupFile, func(fields []string) {
+		if len(fields) < 4 || fields[0] != g.Name {
+			return
+		}
+		for _, m := range strings.Split(fields[3], ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				seen[m] = true
+			}
+		}
+	})
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	err = readColonFile(passwdFile, func(fields []string) {
+		if len(fields) >= 4 && fields[3] == g.Gid {
+			seen[fields[0]] = true
+		}
+	})
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+
+	res := &groupMembersResult{Name: g.Name, Gid: gid, Members: make([]string, 0, len(seen))}
+	for m := range seen {
+		res.Members = append(res.Members, m)
+	}
+	sort.Strings(res.Members)
+	return res, nil
+}
+
+// handleListGroups handles nasx.root.fs.groups (request-reply). Runs as root.
+func handleListGroups(nc *nats.Conn, msg *nats.Msg) {
+	result, fsErr := doListGroups()
+	if fsErr != nil {
+		replyErr(nc, msg.Reply, fsErr)
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// handleGroupMembers handles nasx.root.fs.group-members (request-reply): the
+// members of {"group": name or gid}. Runs as root.
+func handleGroupMembers(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		Group string `json:"group"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if req.Group == "" {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "group is required"})
+		return
+	}
+	result, fsErr := doGroupMembers(req.Group)
+	if fsErr != nil {
+		replyErr(nc, msg.Reply, fsErr)
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ── Active jobs ───────────────────────────────────────────────────────────────
+
+type jobInfo struct {
+	JobID      string    `json:"jobId"`
+	Op         string    `json:"op"` // subject without the "nasx.root." prefix, e.g. "fs.copy"
+	Username   string    `json:"linuxUsername,omitempty"`
+	Started    time.Time `json:"started"`
+	BytesDone  int64     `json:"bytesDone"`
+	BytesTotal int64     `json:"bytesTotal"`
+}
+
+// jobRegistry tracks the filesystem tasks this worker is running.
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*jobInfo
+}
+
+var activeJobs = &jobRegistry{jobs: map[string]*jobInfo{}}
+
+// start records a running job and returns the function that removes it.
+func (r *jobRegistry) start(jobID, subject, username string) (done func()) {
+	j := &jobInfo{
+		JobID:    jobID,
+		Op:       strings.TrimPrefix(subject, "nasx.root."),
+		Username: username,
+		Started:  time.Now().UTC(),
+	}
+	r.mu.Lock()
+	r.jobs[jobID] = j
+	r.mu.Unlock()
+	return func() {
+		r.mu.Lock()
+		if r.jobs[jobID] == j {
+			delete(r.jobs, jobID)
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *jobRegistry) progress(jobID string, p progressInfo) {
+	r.mu.Lock()
+	if j := r.jobs[jobID]; j != nil {
+		j.BytesDone, j.BytesTotal = p.BytesDone, p.BytesTotal
+	}
+	r.mu.Unlock()
+}
+
+// list returns a snapshot of the running jobs, oldest first.
+func (r *jobRegistry) list() []jobInfo {
+	r.mu.Lock()
+	out := make([]jobInfo, 0, len(r.jobs))
+	for _, j := range r.jobs {
+		out = append(out, *j)
+	}
+	r.mu.Unlock()
+	sort.Slice(out, func(a, b int) bool { return out[a].Started.Before(out[b].Started) })
+	return out
+}
+
+// handleJobs handles nasx.root.control.jobs (request-reply): lists the
+// filesystem tasks currently in flight on this worker. Every instance
+// replies, tagged with its instanceID; a caller after all of them gathers
+// the replies rather than taking the first.
+func handleJobs(nc *nats.Conn, msg *nats.Msg) {
+	replyOk(nc, msg.Reply, map[string]interface{}{"instance": instanceID, "jobs": activeJobs.list()})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	nats "github.com/nats-io/nats.go"
+	"golang.org/x/sys/unix"
+)
+
+// ── in use ────────────────────────────────────────────────────────────────────
+//
+// Whether a file is in use is a heuristic. Locks are taken from /proc/locks,
+// which, unlike an F_OFD_GETLK probe, also lists flock(2) locks and who holds
+// them (except OFD locks, whose owner is a file description, not a pid). Open
+// descriptors come from /proc/<pid>/fd. Neither sees clients of an NFS or SMB
+// export working on their own machines, nor a program that read the file and
+// closed it, as most editors do; and a process in another PID namespace shows
+// under that namespace's pids.
+
+// maxInUseHolders caps the processes doIsLocked lists.
+const maxInUseHolders = 20
+
+type fileHolder struct {
+	Pid     int    `json:"pid"`               // -1 for an OFD lock
+	Command string `json:"command,omitempty"` // from /proc/<pid>/comm
+	Lock    string `json:"lock,omitempty"`    // e.g. "POSIX WRITE", "FLOCK READ"; empty for an open descriptor
+}
+
+type inUseResult struct {
+	InUse   bool         `json:"inUse"`
+	Locked  bool         `json:"locked"`
+	Holders []fileHolder `json:"holders"`
+}
+
+// doIsLocked reports the locks on path and the processes that have it open.
+// It needs root to see other users' descriptors.
+func doIsLocked(path string) (*inUseResult, *fsError) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	res := &inUseResult{Holders: []fileHolder{}}
+	add := func(h fileHolder) {
+		if len(res.Holders) < maxInUseHolders {
+			if h.Pid > 0 {
+				h.Command = procComm(h.Pid)
+			}
+			res.Holders = append(res.Holders, h)
+		}
+	}
+
+	locks, err := fileLocks(st.Dev, st.Ino)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	for _, h := range locks {
+		res.Locked = true
+		add(h)
+	}
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	self := os.Getpid()
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		if procHasOpen(pid, st.Dev, st.Ino) {
+			res.InUse = true
+			add(fileHolder{Pid: pid})
+		}
+	}
+	res.InUse = res.InUse || res.Locked
+	return res, nil
+}
+
+// fileLocks returns the locks /proc/locks lists on the inode (dev, ino),
+// skipping waiters ("->" lines).
+func fileLocks(dev, ino uint64) ([]fileHolder, error) {
+	f, err := os.Open("/proc/locks")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// 1: POSIX  ADVISORY  WRITE 1234 08:01:5678 0 EOF
+	want := fmt.Sprintf("%02x:%02x:%d", unix.Major(dev), unix.Minor(dev), ino)
+	var holders []fileHolder
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 6 || fields[1] == "->" || fields[5] != want {
+			continue
+		}
+		pid, _ := strconv.Atoi(fields[4])
+		holders = append(holders, fileHolder{Pid: pid, Lock: fields[1] + " " + fields[3]})
+	}
+	return holders, sc.Err()
+}
+
+// procHasOpen reports whether process pid has the inode (dev, ino) open.
+// Processes that exit or deny access mid-scan are skipped.
+func procHasOpen(pid int, dev, ino uint64) bool {
+	dir := filepath.Join("/proc", strconv.Itoa(pid), "fd")
+	fds, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, fd := range fds {
+		var st unix.Stat_t
+		if unix.Stat(filepath.Join(dir, fd.Name()), &st) == nil && st.Dev == dev && st.Ino == ino {
+			return true
+		}
+	}
+	return false
+}
+
+func procComm(pid int) string {
+	b, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// handleIsLocked handles nasx.root.fs.islocked (request-reply). Runs as root;
+// see doIsLocked.
+func handleIsLocked(nc *nats.Conn, msg *nats.Msg) {
+	var req syncMsg
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	result, fsErr := doIsLocked(req.Path)
+	if fsErr != nil {
+		replyErr(nc, msg.Reply, fsErr)
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
@@ -3,15 +3,19 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
 )
 
 func getenv(key, fallback string) string {
@@ -21,30 +25,193 @@ func getenv(key, fallback string) string {
 	return fallback
 }
 
+func getenvInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("warn: %s=%q is not an integer, using %d", key, v, fallback)
+		return fallback
+	}
+	return n
+}
+
+func getenvInt64(key string, fallback int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Printf("warn: %s=%q is not an integer, using %d", key, v, fallback)
+		return fallback
+	}
+	return n
+}
+
 // ── Message envelopes ─────────────────────────────────────────────────────────
 
 // taskMsg is the payload published by the backend for async jobs.
 type taskMsg struct {
-	JobID         string   `json:"jobId"`
-	LinuxUsername string   `json:"linuxUsername"`
-	Path          string   `json:"path"`
-	ParentPath    string   `json:"parentPath"`
-	Name          string   `json:"name"`
-	Src           string   `json:"src"`
-	DstDir        string   `json:"dstDir"`
-	NewName       string   `json:"newName"`
-	DestFile      string   `json:"destFile"`
-	Chunks        []string `json:"chunks"`
-	StagingDir    string   `json:"stagingDir"`
-	Mode          string   `json:"mode"`
-	Owner         string   `json:"owner"`
-	Group         string   `json:"group"`
+	JobID                string     `json:"jobId"`
+	LinuxUsername        string     `json:"linuxUsername"`
+	Path                 string     `json:"path"`
+	ParentPath           string     `json:"parentPath"`
+	Name                 string     `json:"name"`
+	Src                  string     `json:"src"`
+	DstDir               string     `json:"dstDir"`
+	DestPath             string     `json:"destPath"` // move: exact destination path, used instead of dstDir
+	NewName              string     `json:"newName"`
+	DestFile             string     `json:"destFile"`
+	Chunks               []string   `json:"chunks"`
+	StagingDir           string     `json:"stagingDir"`
+	Mode                 string     `json:"mode"`  // chmod; assemble: mode of the assembled file (default 644); mkdir: exact mode of the directories it creates (default 755 less umask)
+	Owner                string     `json:"owner"` // chown; audit-ownership: the user everything should belong to
+	Group                string     `json:"group"`
+	Acl                  []aclEntry `json:"acl"`        // setfacl; setfacl-default: empty removes the default ACL
+	ChownTo              string     `json:"chownTo"`    // move: re-own the moved tree to this user (name or uid)
+	MaxEntries           int        `json:"maxEntries"` // tree walks: 0 = server default
+	TimeBudget           int        `json:"timeBudget"` // tree walks: seconds, 0 = server default
+	ReplaceWithHardlinks bool       `json:"replaceWithHardlinks"`
+	RateLimit            int64      `json:"rateLimit"`         // copy/move/assemble: bytes/sec, 0 = global cap only
+	Workers              int        `json:"workers"`           // copy/move: parallel file copies, 0 = NASX_COPY_WORKERS
+	RecreateSpecial      bool       `json:"recreateSpecial"`   // copy/move: recreate FIFOs/devices instead of skipping
+	Collision            string     `json:"collision"`         // mkdir/copy: numbered-parens (default) | numbered-underscore | timestamp | fail
+	Force                bool       `json:"force"`             // delete: remove non-empty directories recursively
+	Mtime                string     `json:"mtime"`             // settimes: RFC3339, "now" or "omit"
+	Atime                string     `json:"atime"`             // settimes: RFC3339, "now" or "omit"
+	RunAsGroup           string     `json:"runAsGroup"`        // primary group (name or gid) to impersonate with; must be one of the user's groups
+	StrictNames          bool       `json:"strictNames"`       // mkdir/rename: reject names SMB/Windows clients can't use (ENAME)
+	TrashID              string     `json:"trashId"`           // restore: entry to restore; path is any path on its filesystem
+	ConflictSubject      string     `json:"conflictSubject"`   // collision "ask": where to send conflict prompts
+	ConflictTimeout      int        `json:"conflictTimeout"`   // collision "ask": seconds to wait for an answer, then skip
+	RefuseCrossDevice    bool       `json:"refuseCrossDevice"` // move: fail with EXDEV instead of copying to another filesystem
+	ExpandHome           bool       `json:"expandHome"`        // paths may start with "~", the user's home directory
+	PartSize             int64      `json:"partSize"`          // split: bytes per part
+	CreatedAt            time.Time  `json:"createdAt"`         // when the backend queued the task; see maxTaskAge
+	FileMode             string     `json:"fileMode"`          // normalize-perms: mode for files (default 644)
+	DirMode              string     `json:"dirMode"`           // normalize-perms: mode for directories (default 755)
+	Remove               bool       `json:"remove"`            // find-broken: delete the broken links found
+	RefPath              string     `json:"refPath"`           // chown-ref: file whose owner and group the tree gets
+	Copy                 bool       `json:"copy"`              // flatten: copy the files instead of moving them
+	RemoveEmpty          bool       `json:"removeEmpty"`       // flatten: remove the source directories left empty
+	CreateParents        bool       `json:"createParents"`     // copy/move: create dstDir and its missing parents first
+	NoParents            bool       `json:"noParents"`         // mkdir: fail if parentPath is missing instead of creating it
+	AutoRename           bool       `json:"autoRename"`        // move: on a taken destination pick a free name by collision, as copy does, instead of EEXIST
+	Transform            string     `json:"transform"`         // copy: rewrite each file's bytes with this transform (see transformers)
+	Pattern              string     `json:"pattern"`           // glob-delete/glob-move: base-name glob under path
+	Recursive            bool       `json:"recursive"`         // glob-delete/glob-move/clean-sidecars: match below path too
+	Patterns             []string   `json:"patterns"`          // clean-sidecars: base-name globs (default: common lock and metadata files)
+	DryRun               bool       `json:"dryRun"`            // clean-sidecars: report the matches without removing them
+	Fix                  bool       `json:"fix"`               // audit-ownership: chown the mismatches to owner and their primary group
+	PermChanges          []permEdit `json:"permChanges"`       // perms-batch: the changes, applied all or nothing
+	Token                string     `json:"token"`             // glob-delete/glob-move: token from the nasx.root.fs.glob preview
+
+	resolve func(src, dst string) string // built by handleTask for collision "ask"
+	report  func(progressInfo)           // built by handleTask; publishes progress events
+}
+
+// expandHomePaths expands "~" in every path field of the task. Validation
+// happens afterwards, in execFsTask, on the expanded paths.
+func (t *taskMsg) expandHomePaths() error {
+	paths := []*string{&t.Path, &t.ParentPath, &t.Src, &t.DstDir, &t.DestPath, &t.DestFile, &t.RefPath}
+	for i := range t.PermChanges {
+		paths = append(paths, &t.PermChanges[i].Path)
+	}
+	for _, p := range paths {
+		expanded, err := expandHome(t.LinuxUsername, *p)
+		if err != nil {
+			return err
+		}
+		*p = expanded
+	}
+	return nil
+}
+
+var defaultCopyWorkers = getenvInt("NASX_COPY_WORKERS", 1)
+
+const maxCopyWorkers = 32
+
+// copyOptions derives the copy settings for a copy/move task.
+func (t *taskMsg) copyOptions() copyOptions {
+	workers := t.Workers
+	if workers <= 0 {
+		workers = defaultCopyWorkers
+	}
+	return copyOptions{
+		limiter:         newTaskLimiter(t.RateLimit),
+		workers:         min(workers, maxCopyWorkers),
+		username:        t.LinuxUsername,
+		group:           t.RunAsGroup,
+		recreateSpecial: t.RecreateSpecial,
+		collision:       t.Collision,
+		resolve:         t.resolve,
+		refuseXDev:      t.RefuseCrossDevice,
+		autoRename:      t.AutoRename,
+		report:          t.report,
+	}
 }
 
 // syncMsg is the payload for request-reply operations.
 type syncMsg struct {
 	LinuxUsername string `json:"linuxUsername"`
 	Path          string `json:"path"`
+	DetectMime    bool   `json:"detectMime"`   // list/stat: sniff content types
+	AccessFlags   bool   `json:"accessFlags"`  // list: report readable/writable/executable per entry
+	MaxBytes      int64  `json:"maxBytes"`     // read: lower the server's NASX_MAX_READ_BYTES for this request
+	Base64        bool   `json:"base64"`       // read: reply with a JSON readBase64Result instead of raw bytes
+	ExpandHome    bool   `json:"expandHome"`   // path may start with "~", the user's home directory
+	ResolveLinks  bool   `json:"resolveLinks"` // list: report each symlink's target
+}
+
+// resolvePath expands a "~" path when ExpandHome is set, then validates it.
+func (m *syncMsg) resolvePath() error {
+	return m.resolve(&m.Path)
+}
+
+// resolve does what resolvePath does for another path of the request, such
+// as compare's otherPath.
+func (m *syncMsg) resolve(p *string) error {
+	if m.ExpandHome {
+		expanded, err := expandHome(m.LinuxUsername, *p)
+		if err != nil {
+			return err
+		}
+		*p = expanded
+	}
+	return validatePath(*p)
+}
+
+// decodeSyncMsg reads a list/stat request. Besides the JSON body, the path
+// and options may come as headers (X-Path, X-User, X-Detect-Mime, ...), which
+// gateways can route and log on without parsing the body; when X-Path is
+// set the body is ignored.
+func decodeSyncMsg(msg *nats.Msg, req *syncMsg) error {
+	if msg.Header.Get("X-Path") == "" {
+		return json.Unmarshal(msg.Data, req)
+	}
+	req.Path = msg.Header.Get("X-Path")
+	req.LinuxUsername = msg.Header.Get("X-User")
+	flags := map[string]*bool{
+		"X-Detect-Mime":   &req.DetectMime,
+		"X-Access-Flags":  &req.AccessFlags,
+		"X-Expand-Home":   &req.ExpandHome,
+		"X-Resolve-Links": &req.ResolveLinks,
+	}
+	for name, dst := range flags {
+		v := msg.Header.Get(name)
+		if v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s header %q", name, v)
+		}
+		*dst = b
+	}
+	return nil
 }
 
 // syncResponse wraps a successful result for request-reply.
@@ -53,6 +220,9 @@ type syncResponse struct {
 	Result interface{} `json:"result,omitempty"`
 	Error  string      `json:"error,omitempty"`
 	Code   string      `json:"code,omitempty"`
+	Size   int64       `json:"size,omitempty"`   // ETOOBIG: actual size of the file
+	Line   int         `json:"line,omitempty"`   // EFORMAT: where parsing failed
+	Column int         `json:"column,omitempty"` // EFORMAT
 }
 
 // jobEvent is what the worker publishes back to the backend.
@@ -61,6 +231,7 @@ type jobEvent struct {
 	Status string      `json:"status"` // completed | failed
 	Result interface{} `json:"result,omitempty"`
 	Error  string      `json:"error,omitempty"`
+	Code   string      `json:"code,omitempty"` // failed: the error code (EACCES, ESTALE, ...), when known
 }
 
 // ── Helpers ───────────────────────────────────────────────────────────────────
@@ -71,10 +242,77 @@ func replyOk(nc *nats.Conn, replySubject string, result interface{}) {
 }
 
 func replyErr(nc *nats.Conn, replySubject string, e *fsError) {
-	data, _ := json.Marshal(syncResponse{Ok: false, Error: e.Message, Code: e.Code})
+	data, _ := json.Marshal(syncResponse{Ok: false, Error: e.Message, Code: e.Code, Size: e.Size, Line: e.Line, Column: e.Column})
 	_ = nc.Publish(replySubject, data)
 }
 
+// replyRaw replies with raw bytes (not JSON-wrapped) plus optional headers,
+// for binary results such as file contents.
+func replyRaw(nc *nats.Conn, replySubject string, data []byte, header nats.Header) {
+	_ = nc.PublishMsg(&nats.Msg{Subject: replySubject, Data: data, Header: header})
+}
+
+// streamReply sends a long result as a series of messages to one reply
+// subject. Every message is an ordinary syncResponse with an X-Stream-Seq
+// header (0, 1, ...); the last one, the final result or an error, also
+// carries X-Stream-End: true. Requesters subscribe to their inbox and read
+// until X-Stream-End instead of making a single Request.
+type streamReply struct {
+	nc      *nats.Conn
+	subject string
+	seq     int
+}
+
+func (s *streamReply) publish(resp syncResponse, end bool) {
+	data, _ := json.Marshal(resp)
+	header := nats.Header{}
+	header.Set("X-Stream-Seq", strconv.Itoa(s.seq))
+	if end {
+		header.Set("X-Stream-End", "true")
+	}
+	s.seq++
+	_ = s.nc.PublishMsg(&nats.Msg{Subject: s.subject, Data: data, Header: header})
+}
+
+// send publishes one intermediate batch.
+func (s *streamReply) send(result interface{}) {
+	s.publish(syncResponse{Ok: true, Result: result}, false)
+}
+
+// end publishes the final result and closes the stream.
+func (s *streamReply) end(result interface{}) {
+	s.publish(syncResponse{Ok: true, Result: result}, true)
+}
+
+// fail closes the stream with an error.
+func (s *streamReply) fail(e *fsError) {
+	s.publish(syncResponse{Ok: false, Error: e.Message, Code: e.Code, Size: e.Size, Line: e.Line, Column: e.Column}, true)
+}
+
+// publishJobError publishes a "failed" event carrying e's code.
+func publishJobError(nc *nats.Conn, jobID string, e *fsError) {
+	event := jobEvent{JobID: jobID, Status: "failed", Error: e.Message, Code: e.Code}
+	data, _ := json.Marshal(event)
+	if err := nc.Publish("nasx.events.job."+jobID, data); err != nil {
+		log.Printf("publish event for job %s: %v", jobID, err)
+	}
+}
+
+// progressEvent is a running task's progress. It goes out on its own subject,
+// nasx.events.progress.<jobId>, so that job events keep to the Job status
+// contract (pending | running | completed | failed).
+type progressEvent struct {
+	JobID    string       `json:"jobId"`
+	Progress progressInfo `json:"progress"`
+}
+
+func publishJobProgress(nc *nats.Conn, jobID string, p progressInfo) {
+	data, _ := json.Marshal(progressEvent{JobID: jobID, Progress: p})
+	if err := nc.Publish("nasx.events.progress."+jobID, data); err != nil {
+		log.Printf("publish progress for job %s: %v", jobID, err)
+	}
+}
+
 func publishJobResult(nc *nats.Conn, jobID, status string, result interface{}, errMsg string) {
 	event := jobEvent{JobID: jobID, Status: status, Result: result, Error: errMsg}
 	data, _ := json.Marshal(event)
@@ -94,10 +332,28 @@ func resolveUserCtx(username string) (userCtx, error) {
 }
 
 func withUser(username string, fn func() error) error {
+	return withUserGroup(username, "", fn)
+}
+
+// withUserGroup is withUser with the primary gid replaced by group (a name or
+// numeric gid), as newgrp does, so that files created by fn are owned by that
+// group. The user must already be a member of it; root may pick any group.
+func withUserGroup(username, group string, fn func() error) error {
 	ctx, err := resolveUserCtx(username)
 	if err != nil {
 		return err
 	}
+	if group != "" {
+		gid, err := lookupGid(group)
+		if err != nil {
+			return &fsError{Code: "ERR", Message: err.Error()}
+		}
+		if ctx.uid != 0 && !slices.Contains(ctx.gids, gid) {
+			return &fsError{Code: "EPERM", Message: fmt.Sprintf("user %q is not a member of group %q", username, group)}
+		}
+		ctx.gid = uint32(gid)
+		return runAsUser(ctx, fn)
+	}
 	if ctx.uid == 0 {
 		return fn()
 	}
@@ -112,10 +368,27 @@ var taskSubjects = []string{
 	"nasx.root.fs.copy",
 	"nasx.root.fs.move",
 	"nasx.root.fs.rename",
+	"nasx.root.fs.flatten",
 	"nasx.root.fs.delete",
+	"nasx.root.fs.prune-empty",
+	"nasx.root.fs.clean-sidecars",
 	"nasx.root.fs.assemble",
+	"nasx.root.fs.split",
 	"nasx.root.fs.chmod",
+	"nasx.root.fs.normalize-perms",
 	"nasx.root.fs.chown",
+	"nasx.root.fs.chown-ref",
+	"nasx.root.fs.perms-batch",
+	"nasx.root.fs.audit-ownership",
+	"nasx.root.fs.setfacl",
+	"nasx.root.fs.setfacl-default",
+	"nasx.root.fs.find-dupes",
+	"nasx.root.fs.find-broken",
+	"nasx.root.fs.settimes",
+	"nasx.root.fs.trash",
+	"nasx.root.fs.restore",
+	"nasx.root.fs.glob-delete",
+	"nasx.root.fs.glob-move",
 	// Container (Docker) operations
 	"nasx.root.docker.container.create",
 	"nasx.root.docker.container.recreate",
@@ -129,17 +402,75 @@ var taskSubjects = []string{
 	"nasx.root.docker.volume.remove",
 }
 
+// Stream limits. The backend publishes every task with its job id as
+// Nats-Msg-Id, and JetStream drops a second publish of the same id within
+// the duplicates window (NASX_STREAM_DUPLICATES_SECONDS). MaxAge and MaxMsgs
+// (NASX_STREAM_MAX_AGE_SECONDS, NASX_STREAM_MAX_MSGS) bound how much
+// unconsumed work the stream keeps; 0 means unlimited.
+var (
+	streamDuplicates = time.Duration(max(getenvInt("NASX_STREAM_DUPLICATES_SECONDS", 120), 0)) * time.Second
+	streamMaxAge     = time.Duration(max(getenvInt("NASX_STREAM_MAX_AGE_SECONDS", 0), 0)) * time.Second
+	streamMaxMsgs    = max(getenvInt64("NASX_STREAM_MAX_MSGS", 0), 0)
+)
+
 func ensureStream(js nats.JetStreamContext) error {
 	cfg := &nats.StreamConfig{
-		Name:      "NASX_TASKS",
-		Subjects:  taskSubjects,
-		Retention: nats.WorkQueuePolicy,
+		Name:       "NASX_TASKS",
+		Subjects:   taskSubjects,
+		Retention:  nats.WorkQueuePolicy,
+		Duplicates: streamDuplicates,
+		MaxAge:     streamMaxAge,
+		MaxMsgs:    -1,
+	}
+	if streamMaxMsgs > 0 {
+		cfg.MaxMsgs = streamMaxMsgs
+	}
+	if cfg.MaxAge > 0 && cfg.Duplicates > cfg.MaxAge {
+		cfg.Duplicates = cfg.MaxAge // the server rejects a window longer than MaxAge
 	}
 	_, err := js.AddStream(cfg)
-	if err != nil && err.Error() != "nats: stream name already in use" {
-		// Try updating in case config changed
+	if err == nil {
+		return nil
+	}
+	// Try updating in case config changed (new subjects or limits).
+	if _, uerr := js.UpdateStream(cfg); uerr != nil {
+		if err.Error() == "nats: stream name already in use" {
+			// Usable as it is, just not with our limits; e.g. the backend
+			// created it first with a different retention policy.
+			log.Printf("warn: stream NASX_TASKS exists but could not be updated: %v", uerr)
+			return nil
+		}
+		return fmt.Errorf("ensure stream: %w", err)
+	}
+	return nil
+}
+
+// Job events go out as plain core-NATS publishes, which a backend that is
+// reconnecting never sees. With NASX_EVENTS_STREAM=1 the worker also keeps
+// them in the NASX_EVENTS stream: it captures the same subjects, so every
+// publish is stored without a second send and without slowing the live
+// path. A backend can then replay what it missed through a durable consumer.
+// Only the last few events per job are kept, for NASX_EVENTS_MAX_AGE_SECONDS;
+// progress events have their own subject and aren't kept at all.
+var (
+	eventsStream       = os.Getenv("NASX_EVENTS_STREAM") == "1"
+	eventsStreamMaxAge = time.Duration(max(getenvInt("NASX_EVENTS_MAX_AGE_SECONDS", 3600), 60)) * time.Second
+)
+
+const eventsPerJob = 4
+
+func ensureEventsStream(js nats.JetStreamContext) error {
+	cfg := &nats.StreamConfig{
+		Name:              "NASX_EVENTS",
+		Subjects:          []string{"nasx.events.job.*"},
+		Retention:         nats.LimitsPolicy,
+		MaxAge:            eventsStreamMaxAge,
+		MaxMsgsPerSubject: eventsPerJob,
+		Discard:           nats.DiscardOld,
+	}
+	if _, err := js.AddStream(cfg); err != nil {
 		if _, uerr := js.UpdateStream(cfg); uerr != nil {
-			return fmt.Errorf("ensure stream: %w", err)
+			return fmt.Errorf("ensure events stream: %w", err)
 		}
 	}
 	return nil
@@ -189,7 +520,12 @@ func handleWriteChunk(nc *nats.Conn, msg *nats.Msg) {
 		return
 	}
 
-	stagingDir := filepath.Join(meta.DestDir, ".nasx-uploads-"+meta.UploadID)
+	if !validBaseName(meta.UploadID) {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "invalid uploadId"})
+		return
+	}
+
+	stagingDir := stagingDirFor(meta.DestDir, meta.UploadID)
 	chunkPath  := filepath.Join(stagingDir, fmt.Sprintf("%d.part", meta.ChunkIndex))
 	data       := msg.Data
 
@@ -210,26 +546,30 @@ func handleWriteChunk(nc *nats.Conn, msg *nats.Msg) {
 		replyErr(nc, msg.Reply, fsErr)
 		return
 	}
-	replyOk(nc, msg.Reply, map[string]bool{"ok": true})
+	replyOk(nc, msg.Reply, map[string]interface{}{"ok": true, "stagingDir": stagingDir, "path": chunkPath})
 }
 
 func handleList(nc *nats.Conn, msg *nats.Msg) {
 	var req syncMsg
-	if err := json.Unmarshal(msg.Data, &req); err != nil {
+	if err := decodeSyncMsg(msg, &req); err != nil {
 		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
 		return
 	}
-	if err := validatePath(req.Path); err != nil {
+	if err := req.resolvePath(); err != nil {
 		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
 		return
 	}
 	var entries []listEntry
+	var partial bool
 	var fsErr *fsError
 	if err := withUser(req.LinuxUsername, func() error {
-		entries, fsErr = doList(req.Path)
+		entries, partial, fsErr = doList(req.Path, req.ResolveLinks)
 		if fsErr != nil {
 			return fsErr
 		}
+		if req.AccessFlags {
+			addAccessFlags(entries)
+		}
 		return nil
 	}); err != nil {
 		if fe, ok := err.(*fsError); ok {
@@ -243,23 +583,67 @@ func handleList(nc *nats.Conn, msg *nats.Msg) {
 		replyErr(nc, msg.Reply, fsErr)
 		return
 	}
+	if req.DetectMime {
+		detectListMimes(req.LinuxUsername, entries)
+	}
+	if partial {
+		// Same body as a full listing; the header says entries may be missing.
+		data, _ := json.Marshal(syncResponse{Ok: true, Result: entries})
+		replyRaw(nc, msg.Reply, data, nats.Header{"X-Partial": {"true"}})
+		return
+	}
 	replyOk(nc, msg.Reply, entries)
 }
 
+// handleListStream handles nasx.root.fs.list-stream (streamed request-reply,
+// see streamReply): the entries of a directory in batches as they are read,
+// in directory order rather than sorted like list, then an empty batch.
+// accessFlags is honoured; detectMime is not, as it would hold up each batch
+// on reading the files.
+func handleListStream(nc *nats.Conn, msg *nats.Msg) {
+	var req syncMsg
+	stream := &streamReply{nc: nc, subject: msg.Reply}
+	if err := decodeSyncMsg(msg, &req); err != nil {
+		stream.fail(&fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		stream.fail(&fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	perBatch := max(int(nc.MaxPayload()/2/listStreamBatchBytes), 1)
+	if err := withUser(req.LinuxUsername, func() error {
+		fsErr := doListStream(req.Path, req.ResolveLinks, perBatch, func(batch []listEntry) {
+			if req.AccessFlags {
+				addAccessFlags(batch)
+			}
+			stream.send(batch)
+		})
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		stream.fail(toFsErr(err))
+		return
+	}
+	stream.end([]listEntry{})
+}
+
 func handleStat(nc *nats.Conn, msg *nats.Msg) {
 	var req syncMsg
-	if err := json.Unmarshal(msg.Data, &req); err != nil {
+	if err := decodeSyncMsg(msg, &req); err != nil {
 		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
 		return
 	}
-	if err := validatePath(req.Path); err != nil {
+	if err := req.resolvePath(); err != nil {
 		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
 		return
 	}
 	var result *statResult
 	var fsErr *fsError
 	if err := withUser(req.LinuxUsername, func() error {
-		result, fsErr = doStat(req.Path)
+		result, fsErr = doStat(req.Path, req.DetectMime)
 		if fsErr != nil {
 			return fsErr
 		}
@@ -279,20 +663,120 @@ func handleStat(nc *nats.Conn, msg *nats.Msg) {
 	replyOk(nc, msg.Reply, result)
 }
 
-func handleRead(nc *nats.Conn, msg *nats.Msg) {
+// handleExists handles nasx.root.fs.exists (request-reply).
+func handleExists(nc *nats.Conn, msg *nats.Msg) {
+	var req syncMsg
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *existsResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doExists(req.Path)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// handleAccess handles nasx.root.fs.access (request-reply). Mode is any
+// combination of "r", "w" and "x".
+func handleAccess(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Mode string `json:"mode"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *accessResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doAccess(req.Path, req.Mode)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// handleCount handles nasx.root.fs.count (request-reply).
+func handleCount(nc *nats.Conn, msg *nats.Msg) {
 	var req syncMsg
 	if err := json.Unmarshal(msg.Data, &req); err != nil {
 		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
 		return
 	}
-	if err := validatePath(req.Path); err != nil {
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *countResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doCount(req.Path)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// readBase64Result is a read's reply with base64 set: the raw reply's
+// headers as fields, for clients that want every reply in the JSON envelope.
+// Meant for small files; base64 adds a third to the size.
+type readBase64Result struct {
+	Data      []byte `json:"data"` // base64 in JSON
+	Truncated bool   `json:"truncated"`
+	Size      int64  `json:"size"`              // -1 if unknown
+	Charset   string `json:"charset,omitempty"` // with detectEncoding
+	Bom       bool   `json:"bom,omitempty"`
+	Sha256    string `json:"sha256,omitempty"` // with sha256, as X-Sha256
+}
+
+func handleRead(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		DetectEncoding bool `json:"detectEncoding"` // report X-Charset / X-Bom headers
+		StripBom       bool `json:"stripBom"`
+		AllowTruncate  bool `json:"allowTruncate"` // return the first maxBytes of a larger file instead of ETOOBIG
+		Sha256         bool `json:"sha256"`        // report the content's SHA-256 in X-Sha256
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
 		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
 		return
 	}
-	var data []byte
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var res *readResult
 	var fsErr *fsError
 	if err := withUser(req.LinuxUsername, func() error {
-		data, fsErr = doRead(req.Path)
+		res, fsErr = doRead(req.Path, req.MaxBytes, req.AllowTruncate, req.Sha256)
 		if fsErr != nil {
 			return fsErr
 		}
@@ -311,12 +795,48 @@ func handleRead(nc *nats.Conn, msg *nats.Msg) {
 	}
 	// For binary reads, we reply with raw bytes directly (not JSON-wrapped).
 	// The backend handles binary replies specially for the download route.
-	_ = nc.Publish(msg.Reply, data)
+	// X-Truncated/X-Size let an editor refuse to save back a partial file.
+	// X-Sha256 is of the whole file as read, before any BOM stripping, and
+	// is left out of truncated replies.
+	// With base64 the same goes into a normal syncResponse instead.
+	data := res.data
+	header := nats.Header{"X-Truncated": {strconv.FormatBool(res.truncated)}}
+	if res.size >= 0 {
+		header.Set("X-Size", strconv.FormatInt(res.size, 10))
+	}
+	if res.sha256 != "" {
+		header.Set("X-Sha256", res.sha256)
+	}
+	if req.DetectEncoding || req.StripBom {
+		charset, bomLen := detectCharset(data)
+		if req.StripBom {
+			data = data[bomLen:]
+		}
+		if req.DetectEncoding {
+			header.Set("X-Charset", charset)
+			header.Set("X-Bom", strconv.FormatBool(bomLen > 0))
+		}
+	}
+	if req.Base64 {
+		replyOk(nc, msg.Reply, readBase64Result{
+			Data:      data,
+			Truncated: res.truncated,
+			Size:      res.size,
+			Charset:   header.Get("X-Charset"),
+			Bom:       header.Get("X-Bom") == "true",
+			Sha256:    header.Get("X-Sha256"),
+		})
+		return
+	}
+	replyRaw(nc, msg.Reply, data, header)
 }
 
 // ── JetStream task handler ────────────────────────────────────────────────────
 
 func handleTask(nc *nats.Conn, msg *nats.Msg) {
+	stop := startAckHeartbeat(msg)
+	defer stop()
+
 	// Route docker subjects to the docker handler before parsing the FS taskMsg.
 	if strings.HasPrefix(msg.Subject, "nasx.root.docker.") {
 		handleDockerTask(nc, msg, msg.Subject)
@@ -331,17 +851,166 @@ func handleTask(nc *nats.Conn, msg *nats.Msg) {
 	}
 
 	subject := msg.Subject
+	// A task that sat in the stream while no worker ran may act on a world
+	// that has moved on; refuse it rather than delete or move blindly.
+	if age := time.Since(task.CreatedAt); maxTaskAge > 0 && !task.CreatedAt.IsZero() && age > maxTaskAge {
+		log.Printf("task %s (%s): stale, created %s ago", task.JobID, subject, age.Round(time.Second))
+		_ = msg.Term()
+		fsErr := &fsError{Code: "ESTALE", Message: fmt.Sprintf("task is stale: created %s ago", age.Round(time.Second))}
+		publishAudit(nc, subject, &task, fsErr)
+		publishJobError(nc, task.JobID, fsErr)
+		return
+	}
+	if task.ExpandHome {
+		if err := task.expandHomePaths(); err != nil {
+			_ = msg.Term()
+			fsErr := &fsError{Code: "ERR", Message: err.Error()}
+			publishAudit(nc, subject, &task, fsErr)
+			publishJobError(nc, task.JobID, fsErr)
+			return
+		}
+	}
+	// Never let a task point prompts at worker subjects (as with watches).
+	if task.Collision == collisionAsk && task.ConflictSubject != "" && !strings.HasPrefix(task.ConflictSubject, "nasx.root.") {
+		task.resolve = newConflictResolver(nc, &task)
+	}
+	defer activeJobs.start(task.JobID, subject, task.LinuxUsername)()
+	task.report = func(p progressInfo) {
+		activeJobs.progress(task.JobID, p)
+		publishJobProgress(nc, task.JobID, p)
+	}
 
 	var result interface{}
 	var fsErr *fsError
+	for attempt := 1; ; attempt++ {
+		var known bool
+		result, fsErr, known = execFsTask(subject, &task)
+		if !known {
+			log.Printf("unknown subject: %s", subject)
+			_ = msg.Term()
+			return
+		}
+		if fsErr == nil || !isTransient(fsErr) || attempt >= retryAttempts {
+			break
+		}
+		delay := retryBackoff << (attempt - 1)
+		log.Printf("task %s (%s): transient %s, retry %d/%d in %s", task.JobID, subject, fsErr.Code, attempt, retryAttempts-1, delay)
+		time.Sleep(delay)
+	}
+
+	publishAudit(nc, subject, &task, fsErr)
+	_ = settleTask(msg, fsErr)
+	if fsErr != nil {
+		publishJobError(nc, task.JobID, fsErr)
+	} else {
+		publishJobResult(nc, task.JobID, "completed", result, "")
+	}
+}
+
+// taskAcker is the part of *nats.Msg that settles a JetStream task.
+type taskAcker interface {
+	Ack(opts ...nats.AckOpt) error
+	Nak(opts ...nats.AckOpt) error
+	Term(opts ...nats.AckOpt) error
+}
+
+// settleTask acks a task that succeeded. A failed one is Naked when the
+// failure is transient, so JetStream redelivers it, and Termed otherwise:
+// redelivery can't help with ENOENT, EACCES, EEXIST, ...
+func settleTask(m taskAcker, fsErr *fsError) error {
+	switch {
+	case fsErr == nil:
+		return m.Ack()
+	case isTransient(fsErr):
+		return m.Nak() // still failing after local retries
+	default:
+		return m.Term()
+	}
+}
+
+// maxTaskAge is how old a task (by its createdAt) may be when a worker picks
+// it up (NASX_MAX_TASK_AGE_SECONDS, default 0 = no limit). Older tasks fail
+// with ESTALE. Tasks without createdAt are never considered stale. The check
+// is off by default: tasks are fetched one at a time, so one queued behind a
+// long copy ages without any worker being down, and the age is measured
+// against the backend's clock. Set it well above the longest expected queue.
+var maxTaskAge = time.Duration(max(getenvInt("NASX_MAX_TASK_AGE_SECONDS", 0), 0)) * time.Second
+
+// ackHeartbeat is how often a running task tells JetStream it is still being
+// worked on. It must stay well under the consumer's AckWait (30s by default)
+// so that long copies, or a task waiting on a conflict answer, are not
+// redelivered to another worker mid-flight.
+var ackHeartbeat = time.Duration(max(getenvInt("NASX_ACK_HEARTBEAT_SECONDS", 10), 1)) * time.Second
+
+// startAckHeartbeat sends InProgress for msg every ackHeartbeat until the
+// returned stop function is called.
+func startAckHeartbeat(msg *nats.Msg) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(ackHeartbeat)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				_ = msg.InProgress()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// ── Transient-error retry ─────────────────────────────────────────────────────
+
+var (
+	retryAttempts = max(getenvInt("NASX_RETRY_ATTEMPTS", 3), 1)
+	retryBackoff  = time.Duration(getenvInt("NASX_RETRY_BACKOFF_MS", 100)) * time.Millisecond
+	retryCodes    = splitCodes(getenv("NASX_RETRY_CODES", "EINTR,EAGAIN,EBUSY"))
+)
+
+// splitCodes parses a comma-separated list of error codes such as
+// "EINTR, EAGAIN"; case and blanks don't matter.
+func splitCodes(v string) []string {
+	var codes []string
+	for _, c := range strings.Split(v, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			codes = append(codes, c)
+		}
+	}
+	return codes
+}
+
+// isTransient reports whether an operation failed in a way a retry may fix
+// (an interrupted syscall, a momentarily busy NFS mount): its code is one of
+// NASX_RETRY_CODES. Other errors, such as EACCES or ENOENT, are never
+// retried, locally or by redelivery.
+func isTransient(e *fsError) bool {
+	return slices.Contains(retryCodes, e.Code)
+}
 
+// execFsTask runs one filesystem task. known is false for an unrecognised
+// subject.
+func execFsTask(subject string, task *taskMsg) (result interface{}, fsErr *fsError, known bool) {
+	known = true
 	switch subject {
 	case "nasx.root.fs.mkdir":
 		fsErr = validatePaths(task.ParentPath)
+		if fsErr == nil && task.StrictNames && task.Name != "" {
+			fsErr = checkPortableName(task.Name)
+		}
+		var mode *fs.FileMode // nil: default
+		if fsErr == nil && task.Mode != "" {
+			m, err := parseMode(task.Mode)
+			if err != nil {
+				fsErr = &fsError{Code: "ERR", Message: err.Error()}
+			}
+			mode = &m
+		}
 		if fsErr == nil {
 			var res *mkdirResult
-			err := withUser(task.LinuxUsername, func() error {
-				res, fsErr = doMkdir(task.ParentPath, task.Name)
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				res, fsErr = doMkdir(task.ParentPath, task.Name, task.Collision, task.NoParents, mode)
 				if fsErr != nil {
 					return fsErr
 				}
@@ -357,11 +1026,24 @@ func handleTask(nc *nats.Conn, msg *nats.Msg) {
 		fsErr = validatePaths(task.Src, task.DstDir)
 		if fsErr == nil {
 			var res *copyResult
-			err := withUser(task.LinuxUsername, func() error {
-				res, fsErr = doCopy(task.Src, task.DstDir)
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				var created []string
+				if task.CreateParents {
+					if created, fsErr = doMkdirParents(task.DstDir); fsErr != nil {
+						return fsErr
+					}
+				}
+				opts := task.copyOptions()
+				if task.Transform != "" {
+					if opts.transform, fsErr = lookupTransform(task.Transform); fsErr != nil {
+						return fsErr
+					}
+				}
+				res, fsErr = doCopy(task.Src, task.DstDir, opts)
 				if fsErr != nil {
 					return fsErr
 				}
+				res.CreatedDirs = created
 				return nil
 			})
 			if err != nil {
@@ -371,27 +1053,63 @@ func handleTask(nc *nats.Conn, msg *nats.Msg) {
 		}
 
 	case "nasx.root.fs.move":
-		fsErr = validatePaths(task.Src, task.DstDir)
+		// DestPath names the destination itself (move and rename in one);
+		// otherwise the source keeps its name inside DstDir.
+		dstDir := task.DstDir
+		if task.DestPath != "" {
+			dstDir = filepath.Dir(task.DestPath)
+			fsErr = validatePaths(task.Src, task.DestPath)
+		} else {
+			fsErr = validatePaths(task.Src, task.DstDir)
+		}
+		var chownUid, chownGid int
+		if fsErr == nil && task.ChownTo != "" {
+			// Resolve before moving so a bad target doesn't leave a half-done op.
+			chownUid, chownGid, fsErr = resolveChownTarget(task.ChownTo)
+		}
 		if fsErr == nil {
 			var res *moveResult
-			err := withUser(task.LinuxUsername, func() error {
-				res, fsErr = doMove(task.Src, task.DstDir)
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				var created []string
+				if task.CreateParents {
+					if created, fsErr = doMkdirParents(dstDir); fsErr != nil {
+						return fsErr
+					}
+				}
+				if task.DestPath != "" {
+					res, fsErr = doMoveTo(task.Src, task.DestPath, task.copyOptions())
+				} else {
+					res, fsErr = doMove(task.Src, task.DstDir, task.copyOptions())
+				}
 				if fsErr != nil {
 					return fsErr
 				}
+				res.CreatedDirs = created
 				return nil
 			})
 			if err != nil {
 				fsErr = toFsErr(err)
 			}
+			if fsErr == nil && task.ChownTo != "" {
+				// Re-owning crosses ownership boundaries — runs as root.
+				// chownTree undoes its own changes on failure, but the move
+				// stands, so say where the tree went. EPARTIAL, never retried:
+				// running the move again would only fail on the missing src.
+				if fsErr = chownTree(res.Dst, chownUid, chownGid); fsErr != nil {
+					fsErr = &fsError{Code: "EPARTIAL", Message: fmt.Sprintf("moved to %s, but re-owning it failed and its owner is unchanged: %s", res.Dst, fsErr.Message)}
+				}
+			}
 			result = res
 		}
 
 	case "nasx.root.fs.rename":
 		fsErr = validatePaths(task.Path)
+		if fsErr == nil && task.StrictNames {
+			fsErr = checkPortableName(task.NewName)
+		}
 		if fsErr == nil {
 			var res *renameResult
-			err := withUser(task.LinuxUsername, func() error {
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
 				res, fsErr = doRename(task.Path, task.NewName)
 				if fsErr != nil {
 					return fsErr
@@ -404,11 +1122,28 @@ func handleTask(nc *nats.Conn, msg *nats.Msg) {
 			result = res
 		}
 
+	case "nasx.root.fs.flatten":
+		fsErr = validatePaths(task.Path, task.DstDir)
+		if fsErr == nil {
+			var res *flattenResult
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				res, fsErr = doFlatten(task.Path, task.DstDir, task.Copy, task.RemoveEmpty, task.copyOptions())
+				if fsErr != nil {
+					return fsErr
+				}
+				return nil
+			})
+			if err != nil {
+				fsErr = toFsErr(err)
+			}
+			result = res
+		}
+
 	case "nasx.root.fs.delete":
 		fsErr = validatePaths(task.Path)
 		if fsErr == nil {
-			err := withUser(task.LinuxUsername, func() error {
-				fsErr = doDelete(task.Path)
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				fsErr = doDelete(task.Path, task.Force)
 				if fsErr != nil {
 					return fsErr
 				}
@@ -420,13 +1155,85 @@ func handleTask(nc *nats.Conn, msg *nats.Msg) {
 			result = map[string]bool{"ok": true}
 		}
 
+	case "nasx.root.fs.glob-delete", "nasx.root.fs.glob-move":
+		fsErr = validatePaths(task.Path)
+		if fsErr == nil && subject == "nasx.root.fs.glob-move" {
+			fsErr = validatePaths(task.DstDir)
+		}
+		if fsErr == nil {
+			var res *batchResult
+			budget := newWalkBudget(task.MaxEntries, task.TimeBudget)
+			opts := task.copyOptions()
+			op, apply := "delete", func(p string) *fsError { return doDelete(p, task.Force) }
+			if subject == "nasx.root.fs.glob-move" {
+				op = "move"
+				apply = func(p string) *fsError {
+					_, fsErr := doMove(p, task.DstDir, opts)
+					return fsErr
+				}
+			}
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				res, fsErr = doGlobBatch(task.Path, task.Pattern, op, task.Recursive, task.Token, budget, apply)
+				if fsErr != nil {
+					return fsErr
+				}
+				return nil
+			})
+			if err != nil {
+				fsErr = toFsErr(err)
+			}
+			result = res
+		}
+
+	case "nasx.root.fs.prune-empty":
+		fsErr = validatePaths(task.Path)
+		if fsErr == nil {
+			var res *pruneResult
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				res, fsErr = doPruneEmpty(task.Path)
+				if fsErr != nil {
+					return fsErr
+				}
+				return nil
+			})
+			if err != nil {
+				fsErr = toFsErr(err)
+			}
+			result = res
+		}
+
+	case "nasx.root.fs.clean-sidecars":
+		fsErr = validatePaths(task.Path)
+		if fsErr == nil {
+			var res *sidecarResult
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				res, fsErr = doCleanSidecars(task.Path, task.Patterns, task.Recursive, task.DryRun)
+				if fsErr != nil {
+					return fsErr
+				}
+				return nil
+			})
+			if err != nil {
+				fsErr = toFsErr(err)
+			}
+			result = res
+		}
+
 	case "nasx.root.fs.assemble":
-		// Chunks are in /tmp (owned by nasx backend user) — readable by root.
+		// Chunks are in the upload's staging dir (see uploadStagingRoot).
 		// DestFile is in the user's destination dir — write as linuxUser.
 		fsErr = validatePaths(append([]string{task.DestFile}, task.Chunks...)...)
+		modeStr := task.Mode
+		if modeStr == "" {
+			modeStr = "644"
+		}
+		mode, err := parseMode(modeStr)
+		if fsErr == nil && err != nil {
+			fsErr = &fsError{Code: "ERR", Message: err.Error()}
+		}
 		if fsErr == nil {
-			err := withUser(task.LinuxUsername, func() error {
-				fsErr = doAssemble(task.DestFile, task.Chunks)
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				fsErr = doAssemble(task.DestFile, task.Chunks, dedicatedStaging(task.StagingDir), mode, newTaskLimiter(task.RateLimit))
 				if fsErr != nil {
 					return fsErr
 				}
@@ -446,6 +1253,23 @@ func handleTask(nc *nats.Conn, msg *nats.Msg) {
 			}
 		}
 
+	case "nasx.root.fs.split":
+		fsErr = validatePaths(task.Path, task.DstDir)
+		if fsErr == nil {
+			var res *splitResult
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				res, fsErr = doSplit(task.Path, task.DstDir, task.PartSize, task.copyOptions())
+				if fsErr != nil {
+					return fsErr
+				}
+				return nil
+			})
+			if err != nil {
+				fsErr = toFsErr(err)
+			}
+			result = res
+		}
+
 	case "nasx.root.fs.chmod":
 		// chmod runs as root, no impersonation.
 		fsErr = validatePaths(task.Path)
@@ -454,6 +1278,23 @@ func handleTask(nc *nats.Conn, msg *nats.Msg) {
 			result = map[string]bool{"ok": true}
 		}
 
+	case "nasx.root.fs.normalize-perms":
+		fsErr = validatePaths(task.Path)
+		if fsErr == nil {
+			var res *normalizeResult
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				res, fsErr = doNormalizePerms(task.Path, task.FileMode, task.DirMode, task.report)
+				if fsErr != nil {
+					return fsErr
+				}
+				return nil
+			})
+			if err != nil {
+				fsErr = toFsErr(err)
+			}
+			result = res
+		}
+
 	case "nasx.root.fs.chown":
 		// chown runs as root, no impersonation.
 		fsErr = validatePaths(task.Path)
@@ -462,19 +1303,174 @@ func handleTask(nc *nats.Conn, msg *nats.Msg) {
 			result = map[string]bool{"ok": true}
 		}
 
-	default:
-		log.Printf("unknown subject: %s", subject)
-		_ = msg.Term()
-		return
-	}
+	case "nasx.root.fs.chown-ref":
+		// Like chown, runs as root: the reference's owner is usually not the caller.
+		fsErr = validatePaths(task.Path, task.RefPath)
+		if fsErr == nil {
+			var res *chownRefResult
+			res, fsErr = doChownRef(task.Path, task.RefPath, task.report)
+			result = res
+		}
 
-	if fsErr != nil {
-		_ = msg.Nak()
-		publishJobResult(nc, task.JobID, "failed", nil, fsErr.Message)
-	} else {
-		_ = msg.Ack()
-		publishJobResult(nc, task.JobID, "completed", result, "")
+	case "nasx.root.fs.perms-batch":
+		// Runs as root, like chmod and chown.
+		paths := make([]string, len(task.PermChanges))
+		for i, c := range task.PermChanges {
+			paths[i] = c.Path
+		}
+		fsErr = validatePaths(paths...)
+		if fsErr == nil {
+			var res *permBatchResult
+			res, fsErr = doPermBatch(task.PermChanges)
+			result = res
+		}
+
+	case "nasx.root.fs.audit-ownership":
+		// Runs as root, like chown-ref: it must see and fix every entry.
+		fsErr = validatePaths(task.Path)
+		if fsErr == nil && task.Owner == "" {
+			fsErr = &fsError{Code: "ERR", Message: "owner is required"}
+		}
+		if fsErr == nil {
+			var res *ownershipAuditResult
+			res, fsErr = doAuditOwnership(task.Path, task.Owner, task.Fix, task.report)
+			result = res
+		}
+
+	case "nasx.root.fs.setfacl":
+		// Unlike chmod, only the owner may set an ACL — run as the user.
+		fsErr = validatePaths(task.Path)
+		if fsErr == nil {
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				fsErr = doSetFacl(task.Path, task.Acl)
+				if fsErr != nil {
+					return fsErr
+				}
+				return nil
+			})
+			if err != nil {
+				fsErr = toFsErr(err)
+			}
+			result = map[string]bool{"ok": true}
+		}
+
+	case "nasx.root.fs.setfacl-default":
+		// As setfacl, only the owner may set it.
+		fsErr = validatePaths(task.Path)
+		if fsErr == nil {
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				fsErr = doSetDefaultAcl(task.Path, task.Acl)
+				if fsErr != nil {
+					return fsErr
+				}
+				return nil
+			})
+			if err != nil {
+				fsErr = toFsErr(err)
+			}
+			result = map[string]bool{"ok": true}
+		}
+
+	case "nasx.root.fs.find-dupes":
+		fsErr = validatePaths(task.Path)
+		if fsErr == nil {
+			var res *dupesResult
+			budget := newWalkBudget(task.MaxEntries, task.TimeBudget)
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				res, fsErr = doFindDupes(task.Path, budget, task.ReplaceWithHardlinks)
+				if fsErr != nil {
+					return fsErr
+				}
+				return nil
+			})
+			if err != nil {
+				fsErr = toFsErr(err)
+			}
+			result = res
+		}
+
+	case "nasx.root.fs.find-broken":
+		fsErr = validatePaths(task.Path)
+		if fsErr == nil {
+			var res *brokenResult
+			budget := newWalkBudget(task.MaxEntries, task.TimeBudget)
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				res, fsErr = doFindBroken(task.Path, budget, task.Remove)
+				if fsErr != nil {
+					return fsErr
+				}
+				return nil
+			})
+			if err != nil {
+				fsErr = toFsErr(err)
+			}
+			result = res
+		}
+
+	case "nasx.root.fs.settimes":
+		fsErr = validatePaths(task.Path)
+		if fsErr == nil {
+			var res *setTimesResult
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				res, fsErr = doSetTimes(task.Path, task.Mtime, task.Atime)
+				if fsErr != nil {
+					return fsErr
+				}
+				return nil
+			})
+			if err != nil {
+				fsErr = toFsErr(err)
+			}
+			result = res
+		}
+
+	case "nasx.root.fs.trash":
+		fsErr = validatePaths(task.Path)
+		var trashDir string
+		if fsErr == nil {
+			// Set up the trash as root; the move itself runs as the user.
+			trashDir, fsErr = ensureTrashDir(filepath.Dir(task.Path), task.LinuxUsername)
+		}
+		if fsErr == nil {
+			var res *trashInfo
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				res, fsErr = doTrash(task.Path, trashDir)
+				if fsErr != nil {
+					return fsErr
+				}
+				return nil
+			})
+			if err != nil {
+				fsErr = toFsErr(err)
+			}
+			result = res
+		}
+
+	case "nasx.root.fs.restore":
+		fsErr = validatePaths(task.Path)
+		var trashDir string
+		if fsErr == nil {
+			trashDir, fsErr = ensureTrashDir(task.Path, task.LinuxUsername)
+		}
+		if fsErr == nil {
+			var res *restoreResult
+			err := withUserGroup(task.LinuxUsername, task.RunAsGroup, func() error {
+				res, fsErr = doRestore(trashDir, task.TrashID)
+				if fsErr != nil {
+					return fsErr
+				}
+				return nil
+			})
+			if err != nil {
+				fsErr = toFsErr(err)
+			}
+			result = res
+		}
+
+	default:
+		return nil, nil, false
 	}
+	return result, fsErr, known
 }
 
 func validatePaths(paths ...string) *fsError {
@@ -495,7 +1491,24 @@ func toFsErr(err error) *fsError {
 
 // ── Main ──────────────────────────────────────────────────────────────────────
 
+// queueGroup is the NATS queue group of the request-reply subscriptions
+// (NASX_QUEUE_GROUP). Workers in the same group share sync requests the way
+// the durable pull consumer shares tasks, so N workers can run side by side.
+// Any instance may serve any request: all of them must run as root against
+// the same user database and mounts so that impersonation resolves
+// identically. Watches are the exception: a watch lives on the instance that
+// created it, which alone listens for its renewal and unwatch (see watch.go).
+var queueGroup = getenv("NASX_QUEUE_GROUP", "nasx-workers")
+
+// instanceID tells this worker apart from the others in its queue group. It
+// leads the ids of the watches it holds and tags its control replies.
+var instanceID = nuid.Next()
+
 func main() {
+	if err := checkImpersonation(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	natsURL  := getenv("NATS_URL", "nats://127.0.0.1:4222")
 	natsUser := getenv("NATS_USER", "worker")
 	natsPass := getenv("NATS_PASS", "nasx-worker-dev")
@@ -528,13 +1541,88 @@ func main() {
 
 	ensureConsumer(js)
 
+	if eventsStream {
+		if err := ensureEventsStream(js); err != nil {
+			log.Printf("warn: %v; job events will not be replayable", err)
+		}
+	}
+
 	// ── Request-reply subscriptions (sync ops) ─────────────────────────────
 	for subj, handler := range map[string]func(*nats.Conn, *nats.Msg){
 		"nasx.root.fs.list":                     handleList,
+		"nasx.root.fs.list-stream":              handleListStream,
 		"nasx.root.fs.stat":                     handleStat,
+		"nasx.root.fs.exists":                   handleExists,
+		"nasx.root.fs.access":                   handleAccess,
+		"nasx.root.fs.count":                    handleCount,
+		"nasx.root.fs.resolve-link":             handleResolveLink,
+		"nasx.root.fs.realpath":                 handleRealpath,
 		"nasx.root.fs.read":                     handleRead,
 		"nasx.root.fs.write-chunk":              handleWriteChunk,
+		"nasx.root.fs.getfacl":                  handleGetFacl,
+		"nasx.root.fs.getfacl-default":          handleGetDefaultAcl,
+		"nasx.root.fs.create-file":              handleCreateFile,
+		"nasx.root.fs.create-from-template":     handleCreateFromTemplate,
+		"nasx.root.fs.upload-small":             handleUploadSmall,
+		"nasx.root.fs.write-at":                 handleWriteAt,
+		"nasx.root.fs.write-at-complete":        handleWriteAtComplete,
+		"nasx.root.fs.finalize-upload":          handleFinalizeUpload,
+		"nasx.root.fs.replace-file":             handleReplaceFile,
+		"nasx.root.fs.read-structured":          handleReadStructured,
+		"nasx.root.fs.write-structured":         handleWriteStructured,
+		"nasx.root.fs.pre-upload":               handlePreUpload,
+		"nasx.root.fs.preallocate":              handlePreallocate,
+		"nasx.root.fs.check-writable":           handleCheckWritable,
+		"nasx.root.fs.quota":                    handleQuota,
+		"nasx.root.fs.groups":                   handleListGroups,
+		"nasx.root.fs.group-members":            handleGroupMembers,
+		"nasx.root.fs.list-trash":               handleListTrash,
+		"nasx.root.fs.ismount":                  handleIsMount,
+		"nasx.root.fs.islocked":                 handleIsLocked,
+		"nasx.root.fs.fstype":                   handleFsType,
+		"nasx.root.fs.glob":                     handleGlob,
+		"nasx.root.fs.watch":                    handleWatch,
+		"nasx.root.fs.unwatch":                  handleUnwatch,
+		"nasx.root.fs.thumbnail":                handleThumbnail,
+		"nasx.root.fs.mediainfo":                handleMediaInfo,
+		"nasx.root.control.throttle":            handleThrottle,
+		"nasx.root.control.jobs":                handleJobs,
+		"nasx.root.fs.head":                     handleHead,
+		"nasx.root.fs.tail":                     handleTail,
+		"nasx.root.fs.read-lines":               handleReadLines,
+		"nasx.root.fs.probe":                    handleProbe,
+		"nasx.root.fs.immutable":                handleSetImmutable,
+		"nasx.root.fs.special-bits":             handleSpecialBits,
+		"nasx.root.fs.hidden":                   handleSetHidden,
+		"nasx.root.fs.compare":                  handleCompare,
+		"nasx.root.fs.tree":                     handleTree,
+		"nasx.root.fs.usage-breakdown":          handleUsageBreakdown,
+		"nasx.root.fs.manifest":                 handleManifest,
+		"nasx.root.fs.changed-since":            handleChangedSince,
+		"nasx.root.fs.signature":                handleSignature,
+		"nasx.root.fs.patch":                    handlePatch,
 		"nasx.root.docker.container.inspect":    handleDockerInspect,
+	} {
+		h := handler // capture
+		cb := func(msg *nats.Msg) { h(nc, msg) }
+		var err error
+		if strings.HasPrefix(subj, "nasx.root.control.") {
+			// Control ops address every instance, not one of them. A plain
+			// request only sees the first reply; to hear from every instance
+			// collect the replies on an inbox until a timeout.
+			_, err = nc.Subscribe(subj, cb)
+		} else {
+			_, err = nc.QueueSubscribe(subj, queueGroup, cb)
+		}
+		if err != nil {
+			log.Fatalf("subscribe %s: %v", subj, err)
+		}
+	}
+	// A watch is renewed and stopped on subjects naming it, which only the
+	// instance holding it listens on.
+	for subj, handler := range map[string]func(*nats.Conn, *nats.Msg){
+		"nasx.root.fs.watch." + instanceID + ".*":   handleWatch,
+		"nasx.root.fs.unwatch." + instanceID + ".*": handleUnwatch,
 	} {
 		h := handler // capture
 		if _, err := nc.Subscribe(subj, func(msg *nats.Msg) { h(nc, msg) }); err != nil {
@@ -573,6 +1661,8 @@ func main() {
 		}
 	}()
 
+	startSpaceMonitor(nc)
+
 	log.Println("nasx-root-worker ready")
 
 	sig := make(chan os.Signal, 1)
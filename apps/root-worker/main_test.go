@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"slices"
+	"syscall"
+	"testing"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// fakeAcker records how settleTask settled a task.
+type fakeAcker struct{ settled []string }
+
+func (a *fakeAcker) Ack(...nats.AckOpt) error  { a.settled = append(a.settled, "Ack"); return nil }
+func (a *fakeAcker) Nak(...nats.AckOpt) error  { a.settled = append(a.settled, "Nak"); return nil }
+func (a *fakeAcker) Term(...nats.AckOpt) error { a.settled = append(a.settled, "Term"); return nil }
+
+// TestSettleTask checks, per error class, that a failed task is Naked for
+// redelivery only when the failure is transient and Termed otherwise, and
+// that handleTask's local retries agree.
+func TestSettleTask(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code string
+		want string
+	}{
+		{syscall.EINTR, "EINTR", "Nak"},
+		{syscall.EAGAIN, "EAGAIN", "Nak"},
+		{syscall.EBUSY, "EBUSY", "Nak"},
+		{syscall.EACCES, "EACCES", "Term"},
+		{syscall.EPERM, "EACCES", "Term"},
+		{syscall.ENOENT, "ENOENT", "Term"},
+		{syscall.EEXIST, "EEXIST", "Term"},
+		{syscall.ENOTEMPTY, "EEXIST", "Term"},
+		{syscall.EROFS, "EROFS", "Term"},
+		{syscall.ENOSPC, "ENOSPC", "Term"},
+		{syscall.EDQUOT, "EDQUOT", "Term"},
+		{syscall.EIO, "EIO", "Term"},
+		{errors.New("something else"), "ERR", "Term"},
+		{&fsError{Code: "EDEPTH"}, "EDEPTH", "Term"},
+		{&fsError{Code: "ESTALE"}, "ESTALE", "Term"},
+	} {
+		fsErr := mapOsErr(&fs.PathError{Op: "open", Path: "/x", Err: tc.err})
+		if fsErr.Code != tc.code {
+			t.Errorf("%v: code %s, want %s", tc.err, fsErr.Code, tc.code)
+		}
+		var a fakeAcker
+		_ = settleTask(&a, fsErr)
+		if len(a.settled) != 1 || a.settled[0] != tc.want {
+			t.Errorf("%v (%s): settled with %v, want %s", tc.err, fsErr.Code, a.settled, tc.want)
+		}
+		if retried := isTransient(fsErr); retried != (tc.want == "Nak") {
+			t.Errorf("%v (%s): retried locally = %v", tc.err, fsErr.Code, retried)
+		}
+	}
+	var a fakeAcker
+	_ = settleTask(&a, nil)
+	if len(a.settled) != 1 || a.settled[0] != "Ack" {
+		t.Errorf("success: settled with %v, want Ack", a.settled)
+	}
+}
+
+// TestSplitCodes checks the parsing of NASX_RETRY_CODES.
+func TestSplitCodes(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{"EINTR,EAGAIN,EBUSY", []string{"EINTR", "EAGAIN", "EBUSY"}},
+		{" eintr , EIO,, ", []string{"EINTR", "EIO"}},
+		{"", nil},
+	} {
+		if got := splitCodes(tc.in); !slices.Equal(got, tc.want) {
+			t.Errorf("splitCodes(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
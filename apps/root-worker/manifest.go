@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/fs"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ── Manifest ──────────────────────────────────────────────────────────────────
+
+const manifestTimeFormat = "2006-01-02T15:04:05.000000000Z07:00"
+
+type manifestEntry struct {
+	RelPath string `json:"relPath"`
+	Size    int64  `json:"size"`
+	Mtime   string `json:"mtime"`
+	Hash    string `json:"hash,omitempty"` // hex; absent for algo "none"
+}
+
+// manifestSummary is the final message of a manifest stream.
+type manifestSummary struct {
+	Algo  string   `json:"algo"`
+	Files int      `json:"files"`
+	Bytes int64    `json:"bytes"`
+	Notes []string `json:"notes,omitempty"` // entries skipped, with reason
+}
+
+// newManifestHash returns the hash for algo; nil for "none".
+func newManifestHash(algo string) (func() hash.Hash, error) {
+	switch algo {
+	case "", "sha256":
+		return sha256.New, nil
+	case "sha1":
+		return sha1.New, nil
+	case "sha512":
+		return sha512.New, nil
+	case "md5":
+		return md5.New, nil
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", algo)
+}
+
+// doManifest walks root and hands every regular file to emit as a
+// manifestEntry, in walk order. Symlinks and special files are not listed;
+// unreadable files and directories are skipped with a note, so the manifest
+// of a partly unreadable tree is still usable for a diff.
+func doManifest(root, algo string, emit func(manifestEntry)) (*manifestSummary, *fsError) {
+	newHash, err := newManifestHash(algo)
+	if err != nil {
+		return nil, &fsError{Code: "ERR", Message: err.Error()}
+	}
+	if algo == "" {
+		algo = "sha256"
+	}
+	sum := &manifestSummary{Algo: algo}
+	guard := newDirGuard()
+	walkErr := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			sum.Notes = append(sum.Notes, fmt.Sprintf("%s: %s", p, mapOsErr(err).Message))
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			return guard.enter(info, relDepth(root, p))
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		e := manifestEntry{
+			RelPath: filepath.ToSlash(rel),
+			Size:    info.Size(),
+			Mtime:   info.ModTime().UTC().Format(manifestTimeFormat),
+		}
+		if newHash != nil {
+			if e.Hash, err = hashFile(newHash, p); err != nil {
+				sum.Notes = append(sum.Notes, fmt.Sprintf("%s: %s", p, mapOsErr(err).Message))
+				return nil
+			}
+		}
+		sum.Files++
+		sum.Bytes += e.Size
+		emit(e)
+		return nil
+	})
+	if walkErr != nil {
+		return nil, mapOsErr(walkErr)
+	}
+	return sum, nil
+}
+
+// handleManifest handles nasx.root.fs.manifest (request-reply, streamed):
+// batches of {entries} sized to fit the payload limit, then the summary.
+func handleManifest(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Algo string `json:"algo"` // sha256 (default) | sha1 | sha512 | md5 | none
+	}
+	// Even an early error must end the stream, or the requester keeps reading.
+	stream := &streamReply{nc: nc, subject: msg.Reply}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		stream.fail(&fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		stream.fail(&fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+
+	// Leave room for the envelope and the JSON of the last entry added.
+	limit := nc.MaxPayload()/2 - 1024
+	var batch []manifestEntry
+	var batchBytes int64
+	flush := func() {
+		if len(batch) > 0 {
+			stream.send(map[string]interface{}{"entries": batch})
+			batch, batchBytes = nil, 0
+		}
+	}
+	var sum *manifestSummary
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		sum, fsErr = doManifest(req.Path, req.Algo, func(e manifestEntry) {
+			batch = append(batch, e)
+			batchBytes += int64(len(e.RelPath)+len(e.Hash)) + 80
+			if batchBytes >= limit {
+				flush()
+			}
+		})
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		stream.fail(toFsErr(err))
+		return
+	}
+	flush()
+	stream.end(sum)
+}
+
+// ── Changed since ─────────────────────────────────────────────────────────────
+
+type changedEntry struct {
+	RelPath string `json:"relPath"`
+	Type    string `json:"type"` // dir | file | symlink | other
+	Size    int64  `json:"size"`
+	Mtime   string `json:"mtime"`
+	Ctime   string `json:"ctime"`
+}
+
+// changedSummary is the final message of a changed-since stream.
+type changedSummary struct {
+	Entries int      `json:"entries"`
+	Partial bool     `json:"partial"` // the walk budget ran out; later changes may be missing
+	Notes   []string `json:"notes,omitempty"`
+}
+
+// doChangedSince walks root and hands emit every entry whose mtime or ctime
+// is after since; ctime also catches files moved in or chmodded, and files
+// restored with an old mtime. Deletions leave nothing to find. The only
+// trace of one is its parent directory, listed as changed, so a client
+// should re-list the changed directories, or diff a fresh manifest, to
+// notice removals.
+func doChangedSince(root string, since time.Time, budget *walkBudget, emit func(changedEntry)) (*changedSummary, *fsError) {
+	sum := &changedSummary{}
+	guard := newDirGuard()
+	walkErr := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			sum.Notes = append(sum.Notes, fmt.Sprintf("%s: %s", p, mapOsErr(err).Message))
+			return nil
+		}
+		if budget.tick() {
+			sum.Partial = true
+			return filepath.SkipAll
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if err := guard.enter(info, relDepth(root, p)); err != nil {
+				return err
+			}
+		}
+		mtime, ctime := info.ModTime(), info.ModTime()
+		if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+			ctime = time.Unix(sys.Ctim.Unix())
+		}
+		if !mtime.After(since) && !ctime.After(since) {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		e := changedEntry{
+			RelPath: filepath.ToSlash(rel),
+			Type:    "other",
+			Size:    info.Size(),
+			Mtime:   mtime.UTC().Format(manifestTimeFormat),
+			Ctime:   ctime.UTC().Format(manifestTimeFormat),
+		}
+		switch {
+		case info.IsDir():
+			e.Type, e.Size = "dir", 0
+		case info.Mode().IsRegular():
+			e.Type = "file"
+		case info.Mode()&fs.ModeSymlink != 0:
+			e.Type = "symlink"
+		}
+		sum.Entries++
+		emit(e)
+		return nil
+	})
+	if walkErr != nil {
+		return nil, mapOsErr(walkErr)
+	}
+	return sum, nil
+}
+
+// handleChangedSince handles nasx.root.fs.changed-since (request-reply,
+// streamed): batches of {entries}, then the summary.
+func handleChangedSince(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Since      string `json:"since"` // RFC 3339
+		MaxEntries int    `json:"maxEntries"`
+		TimeBudget int    `json:"timeBudget"`
+	}
+	stream := &streamReply{nc: nc, subject: msg.Reply}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		stream.fail(&fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		stream.fail(&fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	since, err := time.Parse(time.RFC3339, req.Since)
+	if err != nil {
+		stream.fail(&fsError{Code: "ERR", Message: "since: " + err.Error()})
+		return
+	}
+
+	limit := nc.MaxPayload()/2 - 1024
+	var batch []changedEntry
+	var batchBytes int64
+	flush := func() {
+		if len(batch) > 0 {
+			stream.send(map[string]interface{}{"entries": batch})
+			batch, batchBytes = nil, 0
+		}
+	}
+	var sum *changedSummary
+	budget := newWalkBudget(req.MaxEntries, req.TimeBudget)
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		sum, fsErr = doChangedSince(req.Path, since, budget, func(e changedEntry) {
+			batch = append(batch, e)
+			batchBytes += int64(len(e.RelPath)) + 160
+			if batchBytes >= limit {
+				flush()
+			}
+		})
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		stream.fail(toFsErr(err))
+		return
+	}
+	flush()
+	stream.end(sum)
+}
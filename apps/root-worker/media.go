@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	// Decoders register themselves with image.Decode.
+	_ "image/gif"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// ── Thumbnails ────────────────────────────────────────────────────────────────
+
+const (
+	thumbDefaultDim  = 256
+	thumbMaxDim      = 2048
+	thumbMaxSource   = 64 << 20  // refuse to decode sources larger than 64 MB
+	thumbMaxPixels   = 100 << 20 // ~100 megapixels — guards against decompression bombs
+	thumbDecodeLimit = 10 * time.Second
+)
+
+var errUnsupported = &fsError{Code: "EUNSUPPORTED", Message: "unsupported or undecodable image"}
+
+// readThumbSource reads an image file for thumbnailing. It runs as the target
+// user; decoding happens afterwards, outside the impersonated thread.
+func readThumbSource(path string) ([]byte, *fsError) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errUnsupported
+	}
+	if info.Size() > thumbMaxSource {
+		return nil, &fsError{Code: "ETOOBIG", Message: fmt.Sprintf("image larger than %d bytes", thumbMaxSource)}
+	}
+	data, err := io.ReadAll(io.LimitReader(f, thumbMaxSource))
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	return data, nil
+}
+
+// doThumbnail decodes src (jpeg/png/gif/webp), scales it to fit within
+// maxDim×maxDim preserving aspect ratio, and returns JPEG bytes. A decode that
+// exceeds thumbDecodeLimit is abandoned (Go can't kill the goroutine; the
+// pixel cap checked up front bounds how much work it can still do).
+func doThumbnail(src []byte, maxDim int) ([]byte, *fsError) {
+	if maxDim <= 0 {
+		maxDim = thumbDefaultDim
+	}
+	if maxDim > thumbMaxDim {
+		maxDim = thumbMaxDim
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil {
+		return nil, errUnsupported
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > thumbMaxPixels {
+		return nil, errUnsupported
+	}
+
+	type decoded struct {
+		img image.Image
+		err error
+	}
+	ch := make(chan decoded, 1)
+	go func() {
+		img, _, err := image.Decode(bytes.NewReader(src))
+		ch <- decoded{img, err}
+	}()
+	var img image.Image
+	select {
+	case d := <-ch:
+		if d.err != nil {
+			return nil, errUnsupported
+		}
+		img = d.img
+	case <-time.After(thumbDecodeLimit):
+		return nil, &fsError{Code: "ETIMEDOUT", Message: "image decode timed out"}
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > maxDim || h > maxDim {
+		if w >= h {
+			h = max(1, h*maxDim/w)
+			w = maxDim
+		} else {
+			w = max(1, w*maxDim/h)
+			h = maxDim
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, &fsError{Code: "ERR", Message: err.Error()}
+	}
+	return out.Bytes(), nil
+}
+
+// handleThumbnail handles nasx.root.fs.thumbnail (request-reply).
+// Like handleRead, a successful reply is the raw JPEG bytes.
+func handleThumbnail(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		MaxDim int `json:"maxDim"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var src []byte
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		src, fsErr = readThumbSource(req.Path)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	data, fsErr := doThumbnail(src, req.MaxDim)
+	if fsErr != nil {
+		replyErr(nc, msg.Reply, fsErr)
+		return
+	}
+	_ = nc.Publish(msg.Reply, data)
+}
+
+// ── Media metadata ────────────────────────────────────────────────────────────
+
+const (
+	mediaInfoMaxBytes = 1 << 20 // EXIF lives near the start of the file
+	ffprobeTimeout    = 10 * time.Second
+)
+
+// doMediaInfo extracts capture metadata from an image's EXIF block, or from a
+// video's container via ffprobe when that is installed. GPS coordinates are
+// only included when includeGPS is set. Files without metadata yield an empty
+// map, not an error.
+func doMediaInfo(path string, includeGPS bool) (map[string]interface{}, *fsError) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	head, err := io.ReadAll(io.LimitReader(f, mediaInfoMaxBytes))
+	f.Close()
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+
+	info := map[string]interface{}{}
+	if cfg, format, err := image.DecodeConfig(bytes.NewReader(head)); err == nil {
+		info["format"] = format
+		info["width"] = cfg.Width
+		info["height"] = cfg.Height
+		if x, err := exif.Decode(bytes.NewReader(head)); err == nil {
+			addExifFields(info, x, includeGPS)
+		}
+		return info, nil
+	}
+
+	if _, err := exec.LookPath("ffprobe"); err == nil {
+		addProbeFields(info, path)
+	}
+	return info, nil
+}
+
+func addExifFields(info map[string]interface{}, x *exif.Exif, includeGPS bool) {
+	str := func(key string, name exif.FieldName) {
+		if t, err := x.Get(name); err == nil {
+			if v, err := t.StringVal(); err == nil && strings.TrimSpace(v) != "" {
+				info[key] = strings.TrimSpace(strings.TrimRight(v, "\x00"))
+			}
+		}
+	}
+	num := func(key string, name exif.FieldName) {
+		if t, err := x.Get(name); err == nil {
+			if v, err := t.Float(0); err == nil {
+				info[key] = v
+			} else if v, err := t.Int(0); err == nil {
+				info[key] = v
+			}
+		}
+	}
+	str("cameraMake", exif.Make)
+	str("cameraModel", exif.Model)
+	str("lensModel", exif.LensModel)
+	str("software", exif.Software)
+	num("orientation", exif.Orientation)
+	num("fNumber", exif.FNumber)
+	num("focalLength", exif.FocalLength)
+	num("iso", exif.ISOSpeedRatings)
+	if t, err := x.Get(exif.ExposureTime); err == nil {
+		if n, d, err := t.Rat2(0); err == nil && d != 0 {
+			info["exposureTime"] = fmt.Sprintf("%d/%d", n, d)
+		}
+	}
+	if tm, err := x.DateTime(); err == nil {
+		info["dateTaken"] = tm.Format(time.RFC3339)
+	}
+	if includeGPS {
+		if lat, long, err := x.LatLong(); err == nil {
+			info["gps"] = map[string]float64{"lat": lat, "long": long}
+		}
+	}
+}
+
+// addProbeFields runs ffprobe on path. It is called on the impersonated
+// thread, and ffprobe runs as that thread's user with every id dropped (see
+// startAsThreadUser), since it parses untrusted media.
+func addProbeFields(info map[string]interface{}, path string) {
+	ctx, cancel := context.WithTimeout(context.Background(), ffprobeTimeout)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "quiet", "-print_format", "json",
+		"-show_format", "-show_streams", "--", path)
+	cmd.Stdout = &out
+	if err := startAsThreadUser(cmd); err != nil {
+		return
+	}
+	if err := cmd.Wait(); err != nil {
+		return
+	}
+	var probe struct {
+		Format struct {
+			FormatName string            `json:"format_name"`
+			Duration   string            `json:"duration"`
+			Tags       map[string]string `json:"tags"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &probe); err != nil {
+		return
+	}
+	info["format"] = probe.Format.FormatName
+	if d, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		info["duration"] = d
+	}
+	if ct := probe.Format.Tags["creation_time"]; ct != "" {
+		info["dateTaken"] = ct
+	}
+	for _, s := range probe.Streams {
+		switch s.CodecType {
+		case "video":
+			if _, ok := info["videoCodec"]; !ok {
+				info["videoCodec"] = s.CodecName
+				info["width"] = s.Width
+				info["height"] = s.Height
+			}
+		case "audio":
+			if _, ok := info["audioCodec"]; !ok {
+				info["audioCodec"] = s.CodecName
+			}
+		}
+	}
+}
+
+// handleMediaInfo handles nasx.root.fs.mediainfo (request-reply).
+func handleMediaInfo(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		IncludeGPS bool `json:"includeGps"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result map[string]interface{}
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doMediaInfo(req.Path, req.IncludeGPS)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
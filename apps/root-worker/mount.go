@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	nats "github.com/nats-io/nats.go"
+	"golang.org/x/sys/unix"
+)
+
+// ── Mounts ────────────────────────────────────────────────────────────────────
+
+// mountOf returns the mount point and source device of the mount containing
+// path, from /proc/self/mountinfo.
+func mountOf(path string) (mountPoint, source string, err error) {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", "", err
+	}
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	best := ""
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(sc.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		mp := unescapeMountPath(fields[4])
+		if real != mp && !strings.HasPrefix(real, strings.TrimSuffix(mp, "/")+"/") {
+			continue
+		}
+		if len(mp) >= len(best) {
+			best, source = mp, fields[sep+2]
+		}
+	}
+	if source == "" {
+		return "", "", &os.PathError{Op: "mountinfo", Path: path, Err: unix.ENODEV}
+	}
+	return best, source, nil
+}
+
+// unescapeMountPath undoes mountinfo's octal escaping (\040 for space etc.).
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// sameDevice reports whether a (not following a final symlink) and the
+// directory b live on the same filesystem, i.e. whether a rename from one to
+// the other can avoid EXDEV.
+func sameDevice(a, b string) (bool, error) {
+	var sa, sb syscall.Stat_t
+	if err := syscall.Lstat(a, &sa); err != nil {
+		return false, &os.PathError{Op: "lstat", Path: a, Err: err}
+	}
+	if err := syscall.Stat(b, &sb); err != nil {
+		return false, &os.PathError{Op: "stat", Path: b, Err: err}
+	}
+	return sa.Dev == sb.Dev, nil
+}
+
+type isMountResult struct {
+	Mount      bool   `json:"mount"`
+	MountPoint string `json:"mountPoint"` // the mount containing path (path itself when Mount is true)
+	Source     string `json:"source"`
+}
+
+// doIsMount reports whether path is a mount point. A different st_dev from
+// the parent is the classic test; mountinfo additionally catches bind mounts
+// of the same filesystem, which share their parent's st_dev.
+func doIsMount(path string) (*isMountResult, *fsError) {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(real, &st); err != nil {
+		return nil, mapOsErr(&os.PathError{Op: "stat", Path: real, Err: err})
+	}
+	if err := syscall.Stat(filepath.Dir(real), &parent); err != nil {
+		return nil, mapOsErr(&os.PathError{Op: "stat", Path: filepath.Dir(real), Err: err})
+	}
+	mp, source, err := mountOf(real)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	return &isMountResult{
+		Mount:      st.Dev != parent.Dev || mp == real,
+		MountPoint: mp,
+		Source:     source,
+	}, nil
+}
+
+// handleIsMount handles nasx.root.fs.ismount (request-reply). Runs as root so
+// that the answer doesn't depend on the user's access to the parent.
+func handleIsMount(nc *nats.Conn, msg *nats.Msg) {
+	var req syncMsg
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	result, fsErr := doIsMount(req.Path)
+	if fsErr != nil {
+		replyErr(nc, msg.Reply, fsErr)
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// ── filesystem type ───────────────────────────────────────────────────────────
+
+// fsTypeNames maps statfs f_type magics to the names mount(8) uses. ext2, ext3
+// and ext4 share one magic and are all reported as ext4. ZFS and NTFS magics
+// aren't in x/sys/unix, hence the literals.
+var fsTypeNames = map[int64]string{
+	unix.EXT4_SUPER_MAGIC:      "ext4",
+	unix.XFS_SUPER_MAGIC:       "xfs",
+	unix.BTRFS_SUPER_MAGIC:     "btrfs",
+	0x2fc12fc1:                 "zfs",
+	unix.TMPFS_MAGIC:           "tmpfs",
+	unix.RAMFS_MAGIC:           "ramfs",
+	unix.NFS_SUPER_MAGIC:       "nfs",
+	unix.CIFS_SUPER_MAGIC:      "cifs",
+	unix.SMB2_SUPER_MAGIC:      "smb2",
+	unix.F2FS_SUPER_MAGIC:      "f2fs",
+	unix.EXFAT_SUPER_MAGIC:     "exfat",
+	unix.MSDOS_SUPER_MAGIC:     "vfat",
+	0x5346544e:                 "ntfs",
+	unix.FUSE_SUPER_MAGIC:      "fuse",
+	unix.OVERLAYFS_SUPER_MAGIC: "overlay",
+	unix.SQUASHFS_MAGIC:        "squashfs",
+	unix.ISOFS_SUPER_MAGIC:     "iso9660",
+	unix.UDF_SUPER_MAGIC:       "udf",
+	unix.CEPH_SUPER_MAGIC:      "ceph",
+	unix.V9FS_MAGIC:            "9p",
+	unix.REISERFS_SUPER_MAGIC:  "reiserfs",
+	unix.PROC_SUPER_MAGIC:      "proc",
+	unix.SYSFS_MAGIC:           "sysfs",
+}
+
+type fsTypeResult struct {
+	Type  string `json:"type"`  // "unknown" when the magic isn't in fsTypeNames
+	Magic string `json:"magic"` // raw f_type, hex
+}
+
+// doFsType reports the type of the filesystem holding path, from statfs(2).
+func doFsType(path string) (*fsTypeResult, *fsError) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return nil, mapOsErr(&os.PathError{Op: "statfs", Path: path, Err: err})
+	}
+	magic := int64(st.Type) & 0xffffffff // f_type is signed on some arches
+	name, ok := fsTypeNames[magic]
+	if !ok {
+		name = "unknown"
+	}
+	return &fsTypeResult{Type: name, Magic: "0x" + strconv.FormatInt(magic, 16)}, nil
+}
+
+// handleFsType handles nasx.root.fs.fstype (request-reply).
+func handleFsType(nc *nats.Conn, msg *nats.Msg) {
+	var req syncMsg
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *fsTypeResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doFsType(req.Path)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
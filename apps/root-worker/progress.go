@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ── Progress ──────────────────────────────────────────────────────────────────
+
+// progressInterval is the minimum gap between two progress events of a task.
+var progressInterval = time.Duration(max(getenvInt("NASX_PROGRESS_INTERVAL_MS", 1000), 100)) * time.Millisecond
+
+type progressInfo struct {
+	BytesDone  int64 `json:"bytesDone"`
+	BytesTotal int64 `json:"bytesTotal"`          // 0 when unknown
+	ItemsDone  int64 `json:"itemsDone,omitempty"` // entries processed, for per-entry operations
+}
+
+// copyProgress counts the bytes copied by a (possibly parallel) copy, or the
+// entries a per-entry operation has processed, and hands them to report at
+// most once per progressInterval. A nil *copyProgress counts nothing.
+type copyProgress struct {
+	report func(progressInfo)
+
+	mu   sync.Mutex
+	info progressInfo
+	last time.Time
+}
+
+func newCopyProgress(total int64, report func(progressInfo)) *copyProgress {
+	if report == nil {
+		return nil
+	}
+	return &copyProgress{report: report, info: progressInfo{BytesTotal: total}}
+}
+
+func (p *copyProgress) add(n int64) {
+	p.bump(n, 0)
+}
+
+// addItem counts one processed entry.
+func (p *copyProgress) addItem() {
+	p.bump(0, 1)
+}
+
+func (p *copyProgress) bump(bytes, items int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.info.BytesDone += bytes
+	p.info.ItemsDone += items
+	info, due := p.info, time.Since(p.last) >= progressInterval
+	if due {
+		p.last = time.Now()
+	}
+	p.mu.Unlock()
+	if due {
+		p.report(info)
+	}
+}
+
+// reader wraps r so that everything read from it is counted.
+func (p *copyProgress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, p: p}
+}
+
+// progressChunk is how much copy moves between two progress counts.
+const progressChunk = 16 << 20
+
+// copy copies src to dst, counting the bytes. When src is a plain file it
+// goes in chunks of io.CopyN rather than through reader, which would hide the
+// file from io.Copy and so lose copy_file_range.
+func (p *copyProgress) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if _, ok := src.(*os.File); !ok || p == nil {
+		return io.Copy(dst, p.reader(src))
+	}
+	var total int64
+	for {
+		n, err := io.CopyN(dst, src, progressChunk)
+		total += n
+		p.add(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *copyProgress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	if n > 0 {
+		pr.p.add(int64(n))
+	}
+	return n, err
+}
+
+// treeBytes sums the sizes of the regular files under root (root itself if
+// it is a file), for a progress total. Unreadable entries are skipped.
+func treeBytes(root string) int64 {
+	var total int64
+	_ = filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+	"unsafe"
+
+	nats "github.com/nats-io/nats.go"
+	"golang.org/x/sys/unix"
+)
+
+// ── Disk quotas ───────────────────────────────────────────────────────────────
+
+const (
+	qGetQuota      = 0x800007 // Q_GETQUOTA
+	usrQuota       = 0        // USRQUOTA
+	quotaBlockSize = 1024     // QIF_DQBLKSIZE: unit of the block limits
+)
+
+// ifDqblk mirrors the kernel's struct if_dqblk. Space is in bytes, block
+// limits are in quotaBlockSize units, times are Unix seconds.
+type ifDqblk struct {
+	BHardLimit uint64
+	BSoftLimit uint64
+	CurSpace   uint64
+	IHardLimit uint64
+	ISoftLimit uint64
+	CurInodes  uint64
+	BTime      uint64
+	ITime      uint64
+	Valid      uint32
+	_          uint32
+}
+
+type quotaResult struct {
+	Enabled bool `json:"enabled"` // false when the filesystem has no user quotas
+	// Byte and inode figures; a zero limit means unlimited.
+	BytesUsed   int64  `json:"bytesUsed"`
+	BytesSoft   int64  `json:"bytesSoft"`
+	BytesHard   int64  `json:"bytesHard"`
+	InodesUsed  int64  `json:"inodesUsed"`
+	InodesSoft  int64  `json:"inodesSoft"`
+	InodesHard  int64  `json:"inodesHard"`
+	BytesGrace  string `json:"bytesGrace,omitempty"` // soft-limit grace expiry, when over it
+	InodesGrace string `json:"inodesGrace,omitempty"`
+}
+
+// getUserQuota reads uid's quota on the filesystem holding path. It uses
+// quotactl_fd (Linux 5.14+) and falls back to quotactl on the filesystem's
+// source device for older kernels. Querying one's own uid needs no privilege.
+func getUserQuota(path string, uid int) (*ifDqblk, error) {
+	var dq ifDqblk
+	cmd := uintptr(qGetQuota<<8 | usrQuota)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL_FD, f.Fd(), cmd, uintptr(uid), uintptr(unsafe.Pointer(&dq)), 0, 0)
+	f.Close()
+	if errno == unix.ENOSYS {
+		_, dev, err := mountOf(path)
+		if err != nil {
+			return nil, err
+		}
+		special, err := unix.BytePtrFromString(dev)
+		if err != nil {
+			return nil, err
+		}
+		_, _, errno = unix.Syscall6(unix.SYS_QUOTACTL, cmd, uintptr(unsafe.Pointer(special)), uintptr(uid), uintptr(unsafe.Pointer(&dq)), 0, 0)
+	}
+	if errno != 0 {
+		return nil, &os.PathError{Op: "quotactl", Path: path, Err: errno}
+	}
+	return &dq, nil
+}
+
+// quotaOff reports whether err from getUserQuota means "no quotas here"
+// rather than a real failure.
+func quotaOff(err error) bool {
+	var errno unix.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case unix.ESRCH, unix.EOPNOTSUPP, unix.ENOSYS, unix.ENOTBLK, unix.ENODEV:
+		return true
+	}
+	return false
+}
+
+func graceTime(t uint64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
+
+// doQuota reports username's block and inode usage and limits on the
+// filesystem holding path. Must run as root to query other users.
+func doQuota(path, username string) (*quotaResult, *fsError) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, &fsError{Code: "ERR", Message: "unknown user " + strconv.Quote(username)}
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	dq, err := getUserQuota(path, uid)
+	if err != nil {
+		if quotaOff(err) {
+			return &quotaResult{Enabled: false}, nil
+		}
+		return nil, mapOsErr(err)
+	}
+	return &quotaResult{
+		Enabled:     true,
+		BytesUsed:   int64(dq.CurSpace),
+		BytesSoft:   int64(dq.BSoftLimit) * quotaBlockSize,
+		BytesHard:   int64(dq.BHardLimit) * quotaBlockSize,
+		InodesUsed:  int64(dq.CurInodes),
+		InodesSoft:  int64(dq.ISoftLimit),
+		InodesHard:  int64(dq.IHardLimit),
+		BytesGrace:  graceTime(dq.BTime),
+		InodesGrace: graceTime(dq.ITime),
+	}, nil
+}
+
+// handleQuota handles nasx.root.fs.quota (request-reply). Path is any path on
+// the filesystem of interest; linuxUsername is whose quota to report. Runs as
+// root since quotactl on another user's id requires privilege.
+func handleQuota(nc *nats.Conn, msg *nats.Msg) {
+	var req syncMsg
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if req.LinuxUsername == "" {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "linuxUsername is required"})
+		return
+	}
+	result, fsErr := doQuota(req.Path, req.LinuxUsername)
+	if fsErr != nil {
+		replyErr(nc, msg.Reply, fsErr)
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
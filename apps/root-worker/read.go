@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ── head ──────────────────────────────────────────────────────────────────────
+
+const defaultHeadBytes = 4096
+
+// doHead reads at most n bytes from the start of path. truncated reports
+// whether the file had more.
+func doHead(path string, n int64) ([]byte, bool, *fsError) {
+	if n <= 0 {
+		n = defaultHeadBytes
+	}
+	if n > maxReadBytes {
+		n = maxReadBytes
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, mapOsErr(err)
+	}
+	defer f.Close()
+	// Read one extra byte to tell "exactly n" from "more than n".
+	data, err := io.ReadAll(io.LimitReader(throttle(f, nil), n+1))
+	if err != nil {
+		return nil, false, mapOsErr(err)
+	}
+	if int64(len(data)) > n {
+		return data[:n], true, nil
+	}
+	return data, false, nil
+}
+
+// handleHead handles nasx.root.fs.head (request-reply). Like handleRead, a
+// successful reply is the raw bytes; the "X-Truncated" header says whether
+// the file continues past them.
+func handleHead(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Bytes int64 `json:"bytes"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var data []byte
+	var truncated bool
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		data, truncated, fsErr = doHead(req.Path, req.Bytes)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyRaw(nc, msg.Reply, data, nats.Header{"X-Truncated": {strconv.FormatBool(truncated)}})
+}
+
+// ── tail ──────────────────────────────────────────────────────────────────────
+
+const (
+	defaultTailLines = 100
+	maxTailLines     = 10_000
+	tailBlockSize    = 64 * 1024
+	maxTailScan      = 8 << 20 // stop scanning backwards after 8 MB
+)
+
+type tailResult struct {
+	Lines []string `json:"lines"`
+	// Partial is set when the scan cap was hit before enough lines were
+	// found (e.g. a huge single-line file); the oldest line may be cut.
+	Partial bool `json:"partial"`
+}
+
+// doTail returns the last n lines of path, reading backwards from the end in
+// blocks so only the tail of the file is touched. A missing trailing newline
+// is fine: the final unterminated text counts as a line.
+func doTail(path string, n int) (*tailResult, *fsError) {
+	if n <= 0 {
+		n = defaultTailLines
+	}
+	if n > maxTailLines {
+		n = maxTailLines
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+
+	pos := info.Size()
+	var buf []byte
+	newlines := 0
+	for pos > 0 && newlines <= n && int64(len(buf)) < maxTailScan {
+		sz := min(int64(tailBlockSize), pos)
+		pos -= sz
+		block := make([]byte, sz)
+		if _, err := f.ReadAt(block, pos); err != nil && err != io.EOF {
+			return nil, mapOsErr(err)
+		}
+		for _, c := range block {
+			if c == '\n' {
+				newlines++
+			}
+		}
+		buf = append(block, buf...)
+	}
+
+	text := strings.TrimSuffix(string(buf), "\n")
+	res := &tailResult{Lines: []string{}}
+	if text == "" && pos == 0 {
+		return res, nil
+	}
+	lines := strings.Split(text, "\n")
+	if pos > 0 && len(lines) <= n {
+		// We stopped at the scan cap mid-line; the first piece is incomplete.
+		res.Partial = true
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	for i, l := range lines {
+		lines[i] = strings.TrimSuffix(l, "\r")
+	}
+	res.Lines = lines
+	return res, nil
+}
+
+// handleTail handles nasx.root.fs.tail (request-reply).
+func handleTail(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Lines int `json:"lines"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *tailResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doTail(req.Path, req.Lines)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// ── lines ─────────────────────────────────────────────────────────────────────
+
+const (
+	maxLineRange = 5_000
+	maxLineBytes = 1 << 20 // a longer "line" is almost certainly not source code
+)
+
+type readLinesResult struct {
+	Lines      []string `json:"lines"`
+	StartLine  int      `json:"startLine"` // 1-based, inclusive
+	EndLine    int      `json:"endLine"`   // last line actually returned; < startLine when none
+	TotalLines int      `json:"totalLines"`
+}
+
+// doReadLines returns lines startLine..endLine (1-based, inclusive) of path
+// and the file's total line count. The whole file is scanned for the count,
+// but only the requested range is kept. endLine <= 0 means startLine plus
+// maxLineRange; wider ranges are clamped. A line longer than maxLineBytes
+// fails the request with ETOOBIG rather than being cut.
+func doReadLines(path string, startLine, endLine int) (*readLinesResult, *fsError) {
+	if startLine <= 0 {
+		startLine = 1
+	}
+	if endLine <= 0 || endLine-startLine >= maxLineRange {
+		endLine = startLine + maxLineRange - 1
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	defer f.Close()
+
+	res := &readLinesResult{Lines: []string{}, StartLine: startLine}
+	sc := bufio.NewScanner(throttle(f, nil))
+	sc.Buffer(make([]byte, 64*1024), maxLineBytes)
+	n := 0
+	for sc.Scan() {
+		n++
+		if n >= startLine && n <= endLine {
+			res.Lines = append(res.Lines, strings.TrimSuffix(sc.Text(), "\r"))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, &fsError{Code: "ETOOBIG", Message: fmt.Sprintf("line %d is longer than %d bytes", n+1, maxLineBytes)}
+		}
+		return nil, mapOsErr(err)
+	}
+	res.TotalLines = n
+	res.EndLine = startLine + len(res.Lines) - 1
+	return res, nil
+}
+
+// handleReadLines handles nasx.root.fs.read-lines (request-reply).
+func handleReadLines(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		StartLine int `json:"startLine"`
+		EndLine   int `json:"endLine"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *readLinesResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doReadLines(req.Path, req.StartLine, req.EndLine)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	data, _ := json.Marshal(syncResponse{Ok: true, Result: result})
+	if int64(len(data)) > nc.MaxPayload() {
+		replyErr(nc, msg.Reply, &fsError{Code: "ETOOBIG", Message: "line range exceeds maximum payload size; request fewer lines"})
+		return
+	}
+	_ = nc.Publish(msg.Reply, data)
+}
+
+// ── probe ─────────────────────────────────────────────────────────────────────
+
+const (
+	defaultProbeBytes = 8 * 1024
+	maxProbeBytes     = 64 * 1024
+)
+
+type probeResult struct {
+	IsBinary     bool   `json:"isBinary"`
+	DetectedMime string `json:"detectedMime"`
+	Charset      string `json:"charset,omitempty"`    // see detectCharset; empty when binary
+	SampleText   string `json:"sampleText,omitempty"` // the sample decoded to UTF-8; empty when binary
+	Truncated    bool   `json:"truncated"`            // the file is longer than the sample
+}
+
+// looksBinary reports whether sample, already judged by detectCharset to be
+// some text encoding, is still mostly control characters, as in binaries
+// that happen to have no NUL in their first bytes.
+func looksBinary(sample []byte) bool {
+	ctrl := 0
+	for _, c := range sample {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != '\f' && c != 0x1b || c == 0x7f {
+			ctrl++
+		}
+	}
+	return ctrl*10 > len(sample)
+}
+
+// doProbe reads the first n bytes of path (default 8 KB, at most 64 KB) and
+// decides whether it is text, so a viewer can choose between rendering and
+// offering a download without fetching the file.
+func doProbe(path string, n int) (*probeResult, *fsError) {
+	if n <= 0 {
+		n = defaultProbeBytes
+	}
+	n = min(n, maxProbeBytes)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, &fsError{Code: "ERR", Message: "not a regular file"}
+	}
+	buf := make([]byte, n)
+	read, err := io.ReadFull(throttle(f, nil), buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, mapOsErr(err)
+	}
+	buf = buf[:read]
+
+	res := &probeResult{DetectedMime: http.DetectContentType(buf), Truncated: info.Size() > int64(read)}
+	if res.Truncated {
+		// Don't let a UTF-8 character cut by the sample end make it invalid.
+		for i := 1; i < utf8.UTFMax && i <= len(buf); i++ {
+			if utf8.RuneStart(buf[len(buf)-i]) {
+				if !utf8.FullRune(buf[len(buf)-i:]) {
+					buf = buf[:len(buf)-i]
+				}
+				break
+			}
+		}
+	}
+	charset, bomLen := detectCharset(buf)
+	text := buf[bomLen:]
+	if charset == "binary" || charset != "utf-16le" && charset != "utf-16be" && looksBinary(text) {
+		res.IsBinary = true
+		return res, nil
+	}
+	res.Charset = charset
+	if enc, _ := lookupEncoding(charset); enc != nil {
+		if text, err = enc.NewDecoder().Bytes(text); err != nil {
+			res.IsBinary, res.Charset = true, ""
+			return res, nil
+		}
+	}
+	res.SampleText = string(text)
+	return res, nil
+}
+
+// handleProbe handles nasx.root.fs.probe (request-reply).
+func handleProbe(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Bytes int `json:"bytes"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *probeResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doProbe(req.Path, req.Bytes)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// ── compare ───────────────────────────────────────────────────────────────────
+
+type compareResult struct {
+	Identical bool `json:"identical"`
+	// FirstDiffOffset is the byte offset of the first difference; omitted
+	// when the files are identical or when their sizes already differ (the
+	// contents aren't read in that case).
+	FirstDiffOffset *int64 `json:"firstDiffOffset,omitempty"`
+	SizeMismatch    bool   `json:"sizeMismatch"`
+}
+
+// doCompare reports whether two files have identical contents. Sizes are
+// compared first; otherwise both files are streamed in lockstep and the scan
+// stops at the first differing byte.
+func doCompare(pathA, pathB string) (*compareResult, *fsError) {
+	a, err := os.Open(pathA)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	defer a.Close()
+	b, err := os.Open(pathB)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	defer b.Close()
+	ia, err := a.Stat()
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	ib, err := b.Stat()
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if !ia.Mode().IsRegular() || !ib.Mode().IsRegular() {
+		return nil, &fsError{Code: "ERR", Message: "can only compare regular files"}
+	}
+	if ia.Size() != ib.Size() {
+		return &compareResult{SizeMismatch: true}, nil
+	}
+
+	ra, rb := throttle(a, nil), throttle(b, nil)
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, 64*1024)
+	var off int64
+	for {
+		na, errA := io.ReadFull(ra, bufA)
+		nb, errB := io.ReadFull(rb, bufB)
+		n := min(na, nb)
+		for i := 0; i < n; i++ {
+			if bufA[i] != bufB[i] {
+				diff := off + int64(i)
+				return &compareResult{FirstDiffOffset: &diff}, nil
+			}
+		}
+		if na != nb {
+			// A file changed size under us.
+			diff := off + int64(n)
+			return &compareResult{FirstDiffOffset: &diff}, nil
+		}
+		off += int64(n)
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return &compareResult{Identical: true}, nil
+		}
+		if errA != nil {
+			return nil, mapOsErr(errA)
+		}
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return nil, mapOsErr(errB)
+		}
+	}
+}
+
+// handleCompare handles nasx.root.fs.compare (request-reply).
+func handleCompare(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		OtherPath string `json:"otherPath"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	for _, p := range []*string{&req.Path, &req.OtherPath} {
+		if err := req.resolve(p); err != nil {
+			replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+			return
+		}
+	}
+	var result *compareResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doCompare(req.Path, req.OtherPath)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
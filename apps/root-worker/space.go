@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"golang.org/x/sys/unix"
+)
+
+// ── free space monitor ────────────────────────────────────────────────────────
+//
+// Every NASX_SPACE_WATCH_INTERVAL_SECONDS the worker statfs's each mount in
+// NASX_SPACE_WATCH (comma-separated; empty, the default, disables the
+// monitor) and publishes to nasx.alerts.space when one runs low and again
+// when it recovers. Low is less than NASX_SPACE_LOW_BYTES free if that is
+// set, else less than NASX_SPACE_LOW_PERCENT of the volume. To keep a mount
+// hovering at the threshold from flapping, recovery needs a further
+// NASX_SPACE_HYSTERESIS_PERCENT of the volume free. Every worker instance
+// runs its own monitor, so subscribers should key alerts on the mount.
+
+const spaceAlertSubject = "nasx.alerts.space"
+
+var (
+	spaceWatchMounts       = getenv("NASX_SPACE_WATCH", "")
+	spaceWatchInterval     = time.Duration(max(getenvInt("NASX_SPACE_WATCH_INTERVAL_SECONDS", 60), 5)) * time.Second
+	spaceLowBytes          = getenvInt64("NASX_SPACE_LOW_BYTES", 0)
+	spaceLowPercent        = getenvInt("NASX_SPACE_LOW_PERCENT", 5)
+	spaceHysteresisPercent = getenvInt("NASX_SPACE_HYSTERESIS_PERCENT", 1)
+)
+
+type spaceAlert struct {
+	Mount          string `json:"mount"`
+	State          string `json:"state"` // low | ok
+	FreeBytes      int64  `json:"freeBytes"`
+	TotalBytes     int64  `json:"totalBytes"`
+	ThresholdBytes int64  `json:"thresholdBytes"`
+	At             string `json:"at"`
+}
+
+// spaceThreshold is the free space below which a volume of total bytes is low.
+func spaceThreshold(total int64) int64 {
+	if spaceLowBytes > 0 {
+		return spaceLowBytes
+	}
+	return total / 100 * int64(spaceLowPercent)
+}
+
+// checkSpace statfs's mount and returns the alert to publish, if its state
+// changed from wasLow. Free space counts only what unprivileged users can
+// use, as df does.
+func checkSpace(mount string, wasLow bool) (alert *spaceAlert, low bool, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(mount, &st); err != nil {
+		return nil, wasLow, err
+	}
+	total := int64(st.Blocks) * st.Bsize
+	free := int64(st.Bavail) * st.Bsize
+	threshold := spaceThreshold(total)
+	low = wasLow
+	if !wasLow && free < threshold {
+		low = true
+	} else if wasLow && free >= threshold+total/100*int64(spaceHysteresisPercent) {
+		low = false
+	}
+	if low == wasLow {
+		return nil, low, nil
+	}
+	alert = &spaceAlert{Mount: mount, State: "ok", FreeBytes: free, TotalBytes: total, ThresholdBytes: threshold, At: time.Now().UTC().Format(time.RFC3339)}
+	if low {
+		alert.State = "low"
+	}
+	return alert, low, nil
+}
+
+// startSpaceMonitor runs the monitor in the background if any mount is
+// configured.
+func startSpaceMonitor(nc *nats.Conn) {
+	var mounts []string
+	for _, m := range strings.Split(spaceWatchMounts, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			mounts = append(mounts, m)
+		}
+	}
+	if len(mounts) == 0 {
+		return
+	}
+	log.Printf("space monitor: watching %s every %s", strings.Join(mounts, ", "), spaceWatchInterval)
+	go func() {
+		low := map[string]bool{}
+		failing := map[string]bool{} // log a failing statfs once, not every interval
+		for {
+			for _, m := range mounts {
+				alert, isLow, err := checkSpace(m, low[m])
+				if err != nil {
+					if !failing[m] {
+						log.Printf("space monitor: statfs %s: %v", m, err)
+					}
+					failing[m] = true
+					continue
+				}
+				failing[m], low[m] = false, isLow
+				if alert == nil {
+					continue
+				}
+				data, _ := json.Marshal(alert)
+				if err := nc.Publish(spaceAlertSubject, data); err != nil {
+					log.Printf("space monitor: publish: %v", err)
+				}
+			}
+			time.Sleep(spaceWatchInterval)
+		}
+	}()
+}
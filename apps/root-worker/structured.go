@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// ── structured config ─────────────────────────────────────────────────────────
+//
+// Config files read and parsed here rather than by each client, so the
+// settings UI gets either a decoded structure or a parse error it can point
+// at, and written back only once they serialise cleanly (and, optionally,
+// match a schema). JSON, YAML and TOML are understood; whatever the file's
+// format, clients see its content as JSON.
+
+var maxStructuredBytes = getenvInt64("NASX_MAX_STRUCTURED_BYTES", 1024*1024) // 1 MB
+
+// structuredFormat normalises format, inferring it from path's extension
+// when empty.
+func structuredFormat(path, format string) (string, *fsError) {
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(path), ".")
+	}
+	switch strings.ToLower(format) {
+	case "json":
+		return "json", nil
+	case "yaml", "yml":
+		return "yaml", nil
+	case "toml":
+		return "toml", nil
+	}
+	return "", &fsError{Code: "ERR", Message: fmt.Sprintf("unknown format %q (json, yaml or toml)", format)}
+}
+
+// formatError is an EFORMAT for a parse error at byte offset off of data.
+func formatError(data []byte, off int64, msg string) *fsError {
+	off = min(max(off, 0), int64(len(data)))
+	before := data[:off]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := utf8.RuneCount(before[bytes.LastIndexByte(before, '\n')+1:])
+	return formatErrorAt(line, max(col, 1), msg)
+}
+
+// formatErrorAt is an EFORMAT at line and col; col 0 means unknown.
+func formatErrorAt(line, col int, msg string) *fsError {
+	where := fmt.Sprintf("line %d", line)
+	if col > 0 {
+		where += fmt.Sprintf(", column %d", col)
+	}
+	return &fsError{Code: "EFORMAT", Message: where + ": " + msg, Line: line, Column: col}
+}
+
+// parseJSON decodes data as a single JSON value. Numbers are kept as
+// json.Number so large integers survive the round trip to the client.
+func parseJSON(data []byte) (interface{}, *fsError) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		var syntaxErr *json.SyntaxError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return nil, formatError(data, syntaxErr.Offset, syntaxErr.Error())
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			return nil, formatError(data, int64(len(data)), "unexpected end of input")
+		}
+		return nil, formatError(data, dec.InputOffset(), err.Error())
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, formatError(data, dec.InputOffset(), "unexpected data after the top-level value")
+	}
+	return v, nil
+}
+
+// yamlErrLine matches yaml.v3's errors, which give a line but no column.
+var yamlErrLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// parseYAML decodes the first document of data.
+func parseYAML(data []byte) (interface{}, *fsError) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		msg := err.Error()
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) && len(typeErr.Errors) > 0 {
+			msg = typeErr.Errors[0]
+		}
+		if m := yamlErrLine.FindStringSubmatch(msg); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			return nil, formatErrorAt(line, 0, m[2])
+		}
+		return nil, &fsError{Code: "EFORMAT", Message: strings.TrimPrefix(msg, "yaml: ")}
+	}
+	return v, nil
+}
+
+// parseTOML decodes data as a TOML document.
+func parseTOML(data []byte) (interface{}, *fsError) {
+	var v map[string]interface{}
+	if err := toml.Unmarshal(data, &v); err != nil {
+		var decErr *toml.DecodeError
+		if errors.As(err, &decErr) {
+			line, col := decErr.Position()
+			return nil, formatErrorAt(line, col, strings.TrimPrefix(decErr.Error(), "toml: "))
+		}
+		return nil, &fsError{Code: "EFORMAT", Message: err.Error()}
+	}
+	return v, nil
+}
+
+// jsonSafe makes a YAML or TOML value marshalable as JSON: map keys become
+// strings, and NaN and infinities, which JSON can't carry, are refused.
+func jsonSafe(v interface{}) (interface{}, *fsError) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			e, fsErr := jsonSafe(e)
+			if fsErr != nil {
+				return nil, fsErr
+			}
+			v[k] = e
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			e, fsErr := jsonSafe(e)
+			if fsErr != nil {
+				return nil, fsErr
+			}
+			m[fmt.Sprint(k)] = e
+		}
+		return m, nil
+	case []interface{}:
+		for i, e := range v {
+			e, fsErr := jsonSafe(e)
+			if fsErr != nil {
+				return nil, fsErr
+			}
+			v[i] = e
+		}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, &fsError{Code: "EFORMAT", Message: fmt.Sprintf("%v can't be represented in JSON", v)}
+		}
+	}
+	return v, nil
+}
+
+type structuredResult struct {
+	Path   string      `json:"path"`
+	Format string      `json:"format"`
+	Data   interface{} `json:"data"`
+}
+
+// doReadStructured reads path, at most maxStructuredBytes of it, and parses
+// it as format (empty = by extension). Malformed content is EFORMAT, with
+// the line and column where parsing failed (YAML reports only the line).
+// Of a multi-document YAML file only the first document is read.
+func doReadStructured(path, format string) (*structuredResult, *fsError) {
+	format, fsErr := structuredFormat(path, format)
+	if fsErr != nil {
+		return nil, fsErr
+	}
+	res, fsErr := doRead(path, maxStructuredBytes, false, false)
+	if fsErr != nil {
+		return nil, fsErr
+	}
+	data := bytes.TrimPrefix(res.data, bomUTF8)
+	var v interface{}
+	switch format {
+	case "json":
+		v, fsErr = parseJSON(data)
+	case "yaml":
+		v, fsErr = parseYAML(data)
+	case "toml":
+		v, fsErr = parseTOML(data)
+	}
+	if fsErr == nil && format != "json" {
+		v, fsErr = jsonSafe(v)
+	}
+	if fsErr != nil {
+		return nil, fsErr
+	}
+	return &structuredResult{Path: path, Format: format, Data: v}, nil
+}
+
+// handleReadStructured handles nasx.root.fs.read-structured (request-reply).
+func handleReadStructured(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Format string `json:"format"` // json | yaml | toml; empty = by extension
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *structuredResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doReadStructured(req.Path, req.Format)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// schemasDir holds the named schemas a structured write can be checked
+// against (NASX_SCHEMAS_DIR), as <name>.json.
+var schemasDir = getenv("NASX_SCHEMAS_DIR", "/etc/nasx/schemas")
+
+const maxSchemaViolations = 10
+
+// configSchema is the subset of JSON Schema config files are checked with:
+// type, enum, required, properties, additionalProperties, items, minimum,
+// maximum, minLength and maxLength. Other keywords are ignored.
+type configSchema struct {
+	Type                 schemaTypes              `json:"type"`
+	Enum                 []interface{}            `json:"enum"`
+	Required             []string                 `json:"required"`
+	Properties           map[string]*configSchema `json:"properties"`
+	AdditionalProperties *extraProperties         `json:"additionalProperties"`
+	Items                *configSchema            `json:"items"`
+	Minimum              *float64                 `json:"minimum"`
+	Maximum              *float64                 `json:"maximum"`
+	MinLength            *int                     `json:"minLength"`
+	MaxLength            *int                     `json:"maxLength"`
+}
+
+// schemaTypes accepts "type" as either one name or a list of them.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(t))
+}
+
+// extraProperties is additionalProperties: false, true, or a schema the
+// properties not named in "properties" must match.
+type extraProperties struct {
+	closed bool
+	schema *configSchema
+}
+
+func (x *extraProperties) UnmarshalJSON(data []byte) error {
+	var b bool
+	if err := json.Unmarshal(data, &b); err == nil {
+		x.closed = !b
+		return nil
+	}
+	return decodeSchema(data, &x.schema)
+}
+
+// decodeSchema decodes a schema keeping numbers as json.Number, so enum
+// values compare equal to parsed data.
+func decodeSchema(data []byte, s **configSchema) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(s)
+}
+
+// loadSchema reads the schema called name from schemasDir.
+func loadSchema(name string) (*configSchema, *fsError) {
+	if !validBaseName(name) {
+		return nil, &fsError{Code: "ERR", Message: "invalid schema name"}
+	}
+	data, err := os.ReadFile(filepath.Join(schemasDir, name+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &fsError{Code: "ENOENT", Message: "no such schema"}
+		}
+		return nil, mapOsErr(err)
+	}
+	var s *configSchema
+	if err := decodeSchema(data, &s); err != nil || s == nil {
+		return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("bad schema: %v", err)}
+	}
+	return s, nil
+}
+
+func jsonTypeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			return "number"
+		}
+		return "integer"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// validate appends to errs a description of each way v, at JSON pointer
+// ptr, breaks s.
+func (s *configSchema) validate(v interface{}, ptr string, errs *[]string) {
+	fail := func(format string, args ...interface{}) {
+		at := ptr
+		if at == "" {
+			at = "/"
+		}
+		*errs = append(*errs, at+": "+fmt.Sprintf(format, args...))
+	}
+	typ := jsonTypeOf(v)
+	if len(s.Type) > 0 {
+		ok := false
+		for _, want := range s.Type {
+			ok = ok || want == typ || (want == "number" && typ == "integer")
+		}
+		if !ok {
+			fail("expected %s, got %s", strings.Join(s.Type, " or "), typ)
+			return
+		}
+	}
+	if len(s.Enum) > 0 {
+		ok := false
+		for _, e := range s.Enum {
+			ok = ok || reflect.DeepEqual(e, v)
+		}
+		if !ok {
+			fail("not one of the allowed values")
+		}
+	}
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			fail("%s is below the minimum %v", v, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			fail("%s is above the maximum %v", v, *s.Maximum)
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("shorter than %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("longer than %d characters", *s.MaxLength)
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, fmt.Sprintf("%s/%d", ptr, i), errs)
+			}
+		}
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := v[key]; !ok {
+				fail("missing required property %q", key)
+			}
+		}
+		extra := s.AdditionalProperties
+		if extra == nil {
+			extra = &extraProperties{}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			child := ptr + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+			if ps, ok := s.Properties[key]; ok {
+				ps.validate(v[key], child, errs)
+			} else if extra.closed {
+				fail("unexpected property %q", key)
+			} else if extra.schema != nil {
+				extra.schema.validate(v[key], child, errs)
+			}
+		}
+	}
+}
+
+// yamlNode converts the next JSON value from dec into a YAML node, keeping
+// the order of object keys, which a map would lose.
+func yamlNode(dec *json.Decoder) (*yaml.Node, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		if t == '{' {
+			n = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		for dec.More() {
+			if n.Kind == yaml.MappingNode {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.(string)})
+			}
+			e, err := yamlNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, e)
+		}
+		if _, err := dec.Token(); err != nil { // the closing delimiter
+			return nil, err
+		}
+		return n, nil
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: t}, nil
+	case json.Number:
+		if _, err := t.Int64(); err == nil {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: t.String()}, nil
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: t.String()}, nil
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(t)}, nil
+	default:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	}
+}
+
+// encodeYAML renders JSON data as a YAML document, object keys in the order
+// they came in.
+func encodeYAML(data []byte) ([]byte, *fsError) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	node, err := yamlNode(dec)
+	if err != nil {
+		return nil, &fsError{Code: "EFORMAT", Message: err.Error()}
+	}
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return nil, &fsError{Code: "EFORMAT", Message: err.Error()}
+	}
+	if err := enc.Close(); err != nil {
+		return nil, &fsError{Code: "EFORMAT", Message: err.Error()}
+	}
+	return out.Bytes(), nil
+}
+
+// tomlValue converts a parsed JSON value, at JSON pointer ptr, into one
+// go-toml encodes as the same TOML type. TOML has no null, so a null
+// anywhere is refused.
+func tomlValue(v interface{}, ptr string) (interface{}, *fsError) {
+	at := ptr
+	if at == "" {
+		at = "/"
+	}
+	switch v := v.(type) {
+	case nil:
+		return nil, &fsError{Code: "EFORMAT", Message: at + ": toml has no null"}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, &fsError{Code: "EFORMAT", Message: fmt.Sprintf("%s: %v", at, err)}
+		}
+		return f, nil
+	case map[string]interface{}:
+		for k, e := range v {
+			e, fsErr := tomlValue(e, ptr+"/"+strings.NewReplacer("~", "~0", "/", "~1").Replace(k))
+			if fsErr != nil {
+				return nil, fsErr
+			}
+			v[k] = e
+		}
+	case []interface{}:
+		for i, e := range v {
+			e, fsErr := tomlValue(e, fmt.Sprintf("%s/%d", ptr, i))
+			if fsErr != nil {
+				return nil, fsErr
+			}
+			v[i] = e
+		}
+	}
+	return v, nil
+}
+
+// encodeTOML renders v, which must be an object, as a TOML document. Keys
+// come out sorted: go-toml encodes maps that way.
+func encodeTOML(v interface{}) ([]byte, *fsError) {
+	if _, ok := v.(map[string]interface{}); !ok {
+		return nil, &fsError{Code: "EFORMAT", Message: "a toml document must be an object"}
+	}
+	v, fsErr := tomlValue(v, "")
+	if fsErr != nil {
+		return nil, fsErr
+	}
+	out, err := toml.Marshal(v)
+	if err != nil {
+		return nil, &fsError{Code: "EFORMAT", Message: err.Error()}
+	}
+	return out, nil
+}
+
+// doWriteStructured serialises data as format (empty = by path's extension)
+// and atomically replaces path with it, keeping the file's mode and owner as
+// replace-file does. With a schema, data that doesn't match is refused with
+// ESCHEMA listing the violations, and path is left untouched. Data TOML
+// can't hold (a null, a top level that isn't an object) is EFORMAT.
+func doWriteStructured(path, format string, data json.RawMessage, schema *configSchema) (*replaceFileResult, *fsError) {
+	format, fsErr := structuredFormat(path, format)
+	if fsErr != nil {
+		return nil, fsErr
+	}
+	v, fsErr := parseJSON(data)
+	if fsErr != nil {
+		return nil, fsErr
+	}
+	if schema != nil {
+		var errs []string
+		schema.validate(v, "", &errs)
+		if len(errs) > 0 {
+			msg := strings.Join(errs[:min(len(errs), maxSchemaViolations)], "; ")
+			if len(errs) > maxSchemaViolations {
+				msg += fmt.Sprintf("; and %d more", len(errs)-maxSchemaViolations)
+			}
+			return nil, &fsError{Code: "ESCHEMA", Message: msg}
+		}
+	}
+	var out []byte
+	switch format {
+	case "json":
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, data, "", "  "); err != nil {
+			return nil, &fsError{Code: "EFORMAT", Message: err.Error()}
+		}
+		buf.WriteByte('\n')
+		out = buf.Bytes()
+	case "yaml":
+		out, fsErr = encodeYAML(data)
+	case "toml":
+		out, fsErr = encodeTOML(v)
+	}
+	if fsErr != nil {
+		return nil, fsErr
+	}
+	return doReplaceFile(path, out, false)
+}
+
+// handleWriteStructured handles nasx.root.fs.write-structured
+// (request-reply). The schema is loaded by the worker itself, the file is
+// written as the user. The reply is the final path (symlinks resolved) and
+// the bytes written.
+func handleWriteStructured(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Format string          `json:"format"` // json | yaml | toml; empty = by extension
+		Data   json.RawMessage `json:"data"`
+		Schema string          `json:"schema"` // optional, see schemasDir
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if len(req.Data) == 0 {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "data is required"})
+		return
+	}
+	var schema *configSchema
+	if req.Schema != "" {
+		var fsErr *fsError
+		if schema, fsErr = loadSchema(req.Schema); fsErr != nil {
+			replyErr(nc, msg.Reply, fsErr)
+			return
+		}
+	}
+	var result *replaceFileResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doWriteStructured(req.Path, req.Format, req.Data, schema)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
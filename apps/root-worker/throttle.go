@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+
+	nats "github.com/nats-io/nats.go"
+	"golang.org/x/time/rate"
+)
+
+// ── I/O throttling ────────────────────────────────────────────────────────────
+//
+// Bulk data paths (copy, assemble, read, hashing) pass their source through
+// throttle, which waits on a process-wide limiter (NASX_IO_RATE_LIMIT
+// bytes/sec, 0 = unlimited, adjustable at runtime on
+// nasx.root.control.throttle) and on an optional per-task limiter. Because
+// every read consults the global limiter, lowering it takes effect on
+// transfers already in flight.
+//
+// Trade-off: a wrapped reader defeats io.Copy's copy_file_range fast path
+// (and with it reflinks and server-side copies), so throttle only wraps when
+// a limit applies. A transfer that started unlimited stays unlimited when a
+// global cap is set later; new transfers pick the cap up.
+
+const throttleBurst = 256 * 1024
+
+var globalLimiter = rate.NewLimiter(rateLimitFor(getenvInt64("NASX_IO_RATE_LIMIT", 0)), throttleBurst)
+
+func rateLimitFor(bytesPerSec int64) rate.Limit {
+	if bytesPerSec <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(bytesPerSec)
+}
+
+// newTaskLimiter returns a limiter for a per-task rate, or nil for none.
+func newTaskLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), throttleBurst)
+}
+
+type throttledReader struct {
+	r    io.Reader
+	task *rate.Limiter // may be nil
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleBurst {
+		p = p[:throttleBurst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		_ = globalLimiter.WaitN(context.Background(), n)
+		if t.task != nil {
+			_ = t.task.WaitN(context.Background(), n)
+		}
+	}
+	return n, err
+}
+
+// throttle wraps r so reads are paced by the global and task limiters. With
+// neither limited r is returned as it is.
+func throttle(r io.Reader, task *rate.Limiter) io.Reader {
+	if task == nil && globalLimiter.Limit() == rate.Inf {
+		return r
+	}
+	return &throttledReader{r: r, task: task}
+}
+
+// handleThrottle handles nasx.root.control.throttle (request-reply): sets the
+// global I/O cap in bytes/sec (0 = unlimited) and replies with the new value.
+func handleThrottle(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		BytesPerSec int64 `json:"bytesPerSec"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	globalLimiter.SetLimit(rateLimitFor(req.BytesPerSec))
+	log.Printf("I/O rate limit set to %d bytes/sec", req.BytesPerSec)
+	replyOk(nc, msg.Reply, map[string]int64{"bytesPerSec": max(req.BytesPerSec, 0)})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ── copy transforms ───────────────────────────────────────────────────────────
+//
+// A copy task may name a transform that rewrites each file's bytes on the
+// way to the destination: recompressing images, stripping metadata. The
+// built-in "jpeg-recompress" re-encodes JPEGs; other transforms are external
+// commands configured as NASX_TRANSFORM_CMD_<NAME>, which read the source on
+// stdin and write the result to stdout; for example
+//
+//	NASX_TRANSFORM_CMD_STRIP_EXIF="exiftool -all= -"
+//
+// registers "strip-exif". Commands are split on spaces and run without a
+// shell, as the user the copy runs as, with no way back to root (see
+// startAsThreadUser): they parse whatever the user's files contain.
+
+// transformer copies in to out, rewriting it. It must stop when ctx is done.
+type transformer func(ctx context.Context, in io.Reader, out io.Writer) error
+
+var (
+	transformTimeout  = time.Duration(getenvInt("NASX_TRANSFORM_TIMEOUT_SECONDS", 300)) * time.Second
+	transformMaxBytes = getenvInt64("NASX_TRANSFORM_MAX_BYTES", 4<<30) // per output file
+	jpegQuality       = min(max(getenvInt("NASX_TRANSFORM_JPEG_QUALITY", 85), 1), 100)
+
+	transformers = loadTransformers()
+)
+
+const transformEnvPrefix = "NASX_TRANSFORM_CMD_"
+
+func loadTransformers() map[string]transformer {
+	t := map[string]transformer{"jpeg-recompress": recompressJpeg}
+	for _, kv := range os.Environ() {
+		key, cmd, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(key, transformEnvPrefix)
+		if !ok || name == "" || len(strings.Fields(cmd)) == 0 {
+			continue
+		}
+		t[strings.ReplaceAll(strings.ToLower(name), "_", "-")] = commandTransformer(strings.Fields(cmd))
+	}
+	return t
+}
+
+// lookupTransform returns the transform registered under name.
+func lookupTransform(name string) (transformer, *fsError) {
+	if t, ok := transformers[name]; ok {
+		return t, nil
+	}
+	names := make([]string, 0, len(transformers))
+	for n := range transformers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("unknown transform %q (have %s)", name, strings.Join(names, ", "))}
+}
+
+var errTransformTooBig = &fsError{Code: "ETOOBIG", Message: "transform output exceeds NASX_TRANSFORM_MAX_BYTES"}
+
+// cappedWriter fails once more than n bytes have been written to it.
+type cappedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > c.n {
+		return 0, errTransformTooBig
+	}
+	c.n -= int64(len(p))
+	return c.w.Write(p)
+}
+
+// runTransform applies t with the configured time and size limits.
+func runTransform(t transformer, in io.Reader, out io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), transformTimeout)
+	defer cancel()
+	err := t(ctx, in, &cappedWriter{w: out, n: transformMaxBytes})
+	if ctx.Err() == context.DeadlineExceeded {
+		return &fsError{Code: "ETIMEDOUT", Message: fmt.Sprintf("transform took longer than %s", transformTimeout)}
+	}
+	return err
+}
+
+func commandTransformer(argv []string) transformer {
+	return func(ctx context.Context, in io.Reader, out io.Writer) error {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		cmd.Stdin, cmd.Stdout = in, out
+		cmd.Stderr = &cappedWriter{w: &stderr, n: 4096}
+		err := startAsThreadUser(cmd)
+		if err == nil {
+			err = cmd.Wait()
+		}
+		if err != nil {
+			var fe *fsError
+			if errors.As(err, &fe) {
+				return fe
+			}
+			msg := strings.TrimSpace(stderr.String())
+			if msg == "" {
+				msg = err.Error()
+			}
+			return &fsError{Code: "ERR", Message: fmt.Sprintf("transform %s: %s", argv[0], msg)}
+		}
+		return nil
+	}
+}
+
+// recompressJpeg re-encodes JPEGs at NASX_TRANSFORM_JPEG_QUALITY, which
+// also drops their EXIF. Anything else, and images too large to decode
+// safely (see thumbMaxSource), is copied unchanged, so the transform can
+// be applied to a whole folder.
+func recompressJpeg(ctx context.Context, in io.Reader, out io.Writer) error {
+	head, err := io.ReadAll(io.LimitReader(in, thumbMaxSource+1))
+	if err != nil {
+		return err
+	}
+	passThrough := func() error {
+		if _, err := out.Write(head); err != nil {
+			return err
+		}
+		_, err := io.Copy(out, in)
+		return err
+	}
+	if len(head) > thumbMaxSource {
+		return passThrough()
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(head))
+	if err != nil || format != "jpeg" || cfg.Width*cfg.Height > thumbMaxPixels {
+		return passThrough()
+	}
+	img, err := jpeg.Decode(bytes.NewReader(head))
+	if err != nil {
+		return passThrough()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return jpeg.Encode(out, img, &jpeg.Options{Quality: jpegQuality})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// ── Trash ─────────────────────────────────────────────────────────────────────
+//
+// Each filesystem gets its own trash at <mount point>/.nasx-trash/<uid>, so
+// trashing is always a rename, never a copy. Inside it, files/<id> holds the
+// trashed item under a generated id (two report.pdf from different folders
+// never collide) and info/<id>.json is its sidecar, recording where it came
+// from so it can be restored.
+
+const trashDirName = ".nasx-trash"
+
+type trashInfo struct {
+	ID           string `json:"id"`
+	OriginalPath string `json:"originalPath"`
+	Name         string `json:"name"`
+	DeletedAt    string `json:"deletedAt"`
+	Type         string `json:"type"` // dir | file
+}
+
+// checkTrashDir makes sure p is a real directory, not a symlink, owned by
+// uid. The trash is set up as root at a path a user may have prepared, e.g.
+// a symlink planted at .nasx-trash/<uid>/files that the chown would follow.
+func checkTrashDir(p string, uid uint32) *fsError {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return mapOsErr(err)
+	}
+	if !info.IsDir() {
+		return &fsError{Code: "EACCES", Message: fmt.Sprintf("unsafe trash: %s is not a directory", p)}
+	}
+	if owner := info.Sys().(*syscall.Stat_t).Uid; owner != uid {
+		return &fsError{Code: "EACCES", Message: fmt.Sprintf("unsafe trash: %s is owned by uid %d, not %d", p, owner, uid)}
+	}
+	return nil
+}
+
+// ensureTrashDir returns the user's trash for the filesystem holding dir,
+// creating it if needed. It runs as root: the shared .nasx-trash directory
+// at the mount point is root's and isn't writable by users, and each user's
+// directory in it is theirs and private to them. Every level is checked to
+// be just that before it is used.
+func ensureTrashDir(dir, username string) (string, *fsError) {
+	ctx, err := resolveUserCtx(username)
+	if err != nil {
+		return "", &fsError{Code: "ERR", Message: err.Error()}
+	}
+	mp, _, err := mountOf(dir)
+	if err != nil {
+		return "", mapOsErr(err)
+	}
+	shared := filepath.Join(mp, trashDirName)
+	if err := os.Mkdir(shared, 0711); err != nil && !os.IsExist(err) {
+		return "", mapOsErr(err)
+	}
+	if fsErr := checkTrashDir(shared, 0); fsErr != nil {
+		return "", fsErr
+	}
+	if info, err := os.Lstat(shared); err == nil && info.Mode().Perm()&0022 != 0 {
+		return "", &fsError{Code: "EACCES", Message: fmt.Sprintf("unsafe trash: %s is writable by others", shared)}
+	}
+	trashDir := filepath.Join(shared, strconv.Itoa(int(ctx.uid)))
+	for _, sub := range []string{trashDir, filepath.Join(trashDir, "files"), filepath.Join(trashDir, "info")} {
+		err := os.Mkdir(sub, 0700)
+		if err == nil {
+			err = os.Lchown(sub, int(ctx.uid), int(ctx.gid))
+		} else if os.IsExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return "", mapOsErr(err)
+		}
+		if fsErr := checkTrashDir(sub, ctx.uid); fsErr != nil {
+			return "", fsErr
+		}
+	}
+	return trashDir, nil
+}
+
+// doTrash moves path into trashDir. The sidecar is written first, so a crash
+// in between leaves at worst an info file with nothing to restore, which
+// doListTrash skips.
+func doTrash(path, trashDir string) (*trashInfo, *fsError) {
+	path = filepath.Clean(path)
+	if strings.HasPrefix(path+"/", filepath.Dir(trashDir)+"/") {
+		return nil, &fsError{Code: "ERR", Message: "already in the trash"}
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	ti := &trashInfo{
+		ID:           nuid.Next(),
+		OriginalPath: path,
+		Name:         filepath.Base(path),
+		DeletedAt:    time.Now().UTC().Format(time.RFC3339),
+		Type:         "file",
+	}
+	if info.IsDir() {
+		ti.Type = "dir"
+	}
+	data, _ := json.Marshal(ti)
+	sidecar := filepath.Join(trashDir, "info", ti.ID+".json")
+	if err := writeFileAtomic(sidecar, data, 0600); err != nil {
+		return nil, mapOsErr(err)
+	}
+	if err := os.Rename(path, filepath.Join(trashDir, "files", ti.ID)); err != nil {
+		_ = os.Remove(sidecar)
+		return nil, mapOsErr(err)
+	}
+	return ti, nil
+}
+
+func readTrashInfo(trashDir, id string) (*trashInfo, *fsError) {
+	if !validBaseName(id) {
+		return nil, &fsError{Code: "ERR", Message: "invalid trash id"}
+	}
+	data, err := os.ReadFile(filepath.Join(trashDir, "info", id+".json"))
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	var ti trashInfo
+	if err := json.Unmarshal(data, &ti); err != nil {
+		return nil, &fsError{Code: "ERR", Message: "corrupt trash entry: " + err.Error()}
+	}
+	return &ti, nil
+}
+
+type restoreResult struct {
+	Path string `json:"path"` // where the item was restored; differs from the original if that was taken
+}
+
+// doRestore puts a trashed item back at its original path, recreating
+// missing parent directories. If something now occupies that path the item
+// is restored next to it under a " (n)" name instead.
+func doRestore(trashDir, id string) (*restoreResult, *fsError) {
+	ti, fsErr := readTrashInfo(trashDir, id)
+	if fsErr != nil {
+		return nil, fsErr
+	}
+	parent := filepath.Dir(ti.OriginalPath)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, mapOsErr(err)
+	}
+	dst, fsErr := uniqueDst(ti.OriginalPath, parent, collisionParens)
+	if fsErr != nil {
+		return nil, fsErr
+	}
+	if err := renameNoReplace(filepath.Join(trashDir, "files", id), dst); err != nil {
+		return nil, mapOsErr(err)
+	}
+	_ = os.Remove(filepath.Join(trashDir, "info", id+".json"))
+	return &restoreResult{Path: dst}, nil
+}
+
+// doListTrash returns the restorable entries, most recently deleted first.
+func doListTrash(trashDir string) ([]trashInfo, *fsError) {
+	entries, err := os.ReadDir(filepath.Join(trashDir, "info"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []trashInfo{}, nil
+		}
+		return nil, mapOsErr(err)
+	}
+	items := []trashInfo{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(trashDir, "files", id)); err != nil {
+			continue
+		}
+		if ti, fsErr := readTrashInfo(trashDir, id); fsErr == nil {
+			items = append(items, *ti)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt > items[j].DeletedAt })
+	return items, nil
+}
+
+// handleListTrash handles nasx.root.fs.list-trash (request-reply). Path is
+// any path on the filesystem whose trash to list.
+func handleListTrash(nc *nats.Conn, msg *nats.Msg) {
+	var req syncMsg
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	trashDir, fsErr := ensureTrashDir(req.Path, req.LinuxUsername)
+	if fsErr != nil {
+		replyErr(nc, msg.Reply, fsErr)
+		return
+	}
+	var result []trashInfo
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doListTrash(trashDir)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
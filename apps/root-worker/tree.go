@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ── Directory tree ────────────────────────────────────────────────────────────
+
+const (
+	treeDefaultDepth   = 2
+	treeMaxDepth       = 8
+	treeDefaultEntries = 2_000
+	treeMaxEntries     = 10_000
+)
+
+// treeNode is deliberately minimal so that a few thousand nodes stay well
+// inside the NATS payload limit. Children is absent for directories that
+// weren't expanded (beyond maxDepth, or cut off by the entry cap); compare it
+// with ChildCount to tell whether a node is fully loaded.
+type treeNode struct {
+	Name       string      `json:"name"`
+	Type       string      `json:"type"` // dir | file | symlink
+	ChildCount int         `json:"childCount,omitempty"`
+	Children   []*treeNode `json:"children,omitempty"`
+}
+
+type treeResult struct {
+	Root    *treeNode `json:"root"`
+	Entries int       `json:"entries"`
+	Partial bool      `json:"partial"` // entry cap hit before the tree was complete
+}
+
+func treeNodeType(d os.DirEntry) string {
+	switch {
+	case d.IsDir():
+		return "dir"
+	case d.Type()&os.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "file"
+	}
+}
+
+// doTree returns the directories under root (and files too, with
+// includeFiles) down to maxDepth levels. The tree is built breadth-first, so
+// when the entry cap is hit the shallow levels the UI shows first are the
+// ones that are complete. Symlinks are reported but never followed.
+func doTree(root string, maxDepth, maxEntries int, includeFiles bool) (*treeResult, *fsError) {
+	if maxDepth <= 0 {
+		maxDepth = treeDefaultDepth
+	}
+	maxDepth = min(maxDepth, treeMaxDepth, maxWalkDepth)
+	if maxEntries <= 0 {
+		maxEntries = treeDefaultEntries
+	}
+	maxEntries = min(maxEntries, treeMaxEntries)
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if !info.IsDir() {
+		return nil, &fsError{Code: "ERR", Message: "not a directory"}
+	}
+
+	type pending struct {
+		node  *treeNode
+		path  string
+		depth int
+	}
+	res := &treeResult{Root: &treeNode{Name: filepath.Base(root), Type: "dir"}}
+	queue := []pending{{node: res.Root, path: root}}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		entries, err := os.ReadDir(cur.path)
+		if err != nil {
+			if cur.node == res.Root {
+				return nil, mapOsErr(err)
+			}
+			continue // unreadable subdirectory: leave it unexpanded
+		}
+		var shown []os.DirEntry
+		for _, e := range entries {
+			if includeFiles || e.IsDir() {
+				shown = append(shown, e)
+			}
+		}
+		cur.node.ChildCount = len(shown)
+		if cur.depth >= maxDepth || res.Partial {
+			continue
+		}
+		for _, e := range shown {
+			if res.Entries >= maxEntries {
+				res.Partial = true
+				break
+			}
+			child := &treeNode{Name: e.Name(), Type: treeNodeType(e)}
+			cur.node.Children = append(cur.node.Children, child)
+			res.Entries++
+			if child.Type == "dir" {
+				queue = append(queue, pending{node: child, path: filepath.Join(cur.path, e.Name()), depth: cur.depth + 1})
+			}
+		}
+	}
+	return res, nil
+}
+
+// handleTree handles nasx.root.fs.tree (request-reply).
+func handleTree(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		MaxDepth     int  `json:"maxDepth"`
+		MaxEntries   int  `json:"maxEntries"`
+		IncludeFiles bool `json:"includeFiles"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *treeResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doTree(req.Path, req.MaxDepth, req.MaxEntries, req.IncludeFiles)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	data, _ := json.Marshal(syncResponse{Ok: true, Result: result})
+	if int64(len(data)) > nc.MaxPayload() {
+		replyErr(nc, msg.Reply, &fsError{Code: "ETOOBIG", Message: "tree exceeds maximum payload size; lower maxEntries or maxDepth"})
+		return
+	}
+	_ = nc.Publish(msg.Reply, data)
+}
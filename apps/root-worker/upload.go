@@ -0,0 +1,983 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+
+	nats "github.com/nats-io/nats.go"
+	"golang.org/x/sys/unix"
+)
+
+// ── chunk staging ─────────────────────────────────────────────────────────────
+
+// uploadStagingRoot is where chunked uploads are staged (NASX_UPLOAD_STAGING).
+// Empty, the default, stages in place in a ".nasx-uploads-<id>" directory
+// inside the destination: nothing to set up and assembly never crosses a
+// filesystem, but the dot-dir shows in the user's folder while the upload
+// runs. A dedicated root keeps folders clean and lets uploads stage while the
+// destination is being prepared; it must be writable by every uploading user
+// (mode 1777, like /tmp, but not under /tmp itself: the unit runs with
+// PrivateTmp), and on another filesystem than the destination assembly costs
+// a full copy instead of a rename.
+var uploadStagingRoot = os.Getenv("NASX_UPLOAD_STAGING")
+
+// stagingDirFor returns where the chunks of uploadID for destDir are kept.
+func stagingDirFor(destDir, uploadID string) string {
+	if uploadStagingRoot != "" {
+		return filepath.Join(uploadStagingRoot, uploadID)
+	}
+	return filepath.Join(destDir, ".nasx-uploads-"+uploadID)
+}
+
+// dedicatedStaging returns dir if it is an upload's directory in the
+// dedicated staging root, and "" for in-place staging.
+func dedicatedStaging(dir string) string {
+	if uploadStagingRoot == "" || dir == "" || filepath.Dir(filepath.Clean(dir)) != filepath.Clean(uploadStagingRoot) {
+		return ""
+	}
+	return dir
+}
+
+// ── create file ───────────────────────────────────────────────────────────────
+
+type createFileResult struct {
+	Path string `json:"path"`
+	Name string `json:"name"`
+}
+
+// validBaseName rejects names that would escape the parent directory.
+func validBaseName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+func doCreateFile(parent, name string, data []byte, modeStr string) (*createFileResult, *fsError) {
+	if modeStr == "" {
+		modeStr = "644"
+	}
+	mode, err := parseMode(modeStr)
+	if err != nil {
+		return nil, &fsError{Code: "ERR", Message: err.Error()}
+	}
+	tmpName, err := writeTemp(parent, data, mode)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	defer os.Remove(tmpName) // no-op once renamed
+	// renameNoReplace rather than a plain rename: a file created at the free
+	// name since uniqueDst looked is never overwritten, another name is
+	// picked instead.
+	for attempt := 0; ; attempt++ {
+		target, fsErr := uniqueDst(filepath.Join(parent, name), parent, collisionParens)
+		if fsErr != nil {
+			return nil, fsErr
+		}
+		err := renameNoReplace(tmpName, target)
+		if err == nil {
+			return &createFileResult{Path: target, Name: filepath.Base(target)}, nil
+		}
+		if !errors.Is(err, syscall.EEXIST) || attempt == 10 {
+			return nil, mapOsErr(err)
+		}
+	}
+}
+
+// handleCreateFile handles nasx.root.fs.create-file (request-reply).
+// Metadata arrives in the "X-Meta" NATS header; the file content in msg.Data,
+// at most maxInlineUploadBytes of it. An existing file is never overwritten:
+// the name gets a " (n)" suffix.
+func handleCreateFile(nc *nats.Conn, msg *nats.Msg) {
+	type createMeta struct {
+		Parent        string `json:"parent"`
+		Name          string `json:"name"`
+		Mode          string `json:"mode"`
+		Encoding      string `json:"encoding"` // transcode the UTF-8 content to this encoding
+		Bom           bool   `json:"bom"`      // write a byte-order mark
+		LinuxUsername string `json:"linuxUsername"`
+	}
+
+	metaJSON := msg.Header.Get("X-Meta")
+	if metaJSON == "" {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "missing X-Meta header"})
+		return
+	}
+	var meta createMeta
+	if err := json.Unmarshal([]byte(metaJSON), &meta); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "bad X-Meta: " + err.Error()})
+		return
+	}
+	if err := validatePath(meta.Parent); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if !validBaseName(meta.Name) {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "invalid name"})
+		return
+	}
+	if int64(len(msg.Data)) > maxInlineUploadBytes {
+		replyErr(nc, msg.Reply, &fsError{Code: "ETOOBIG", Message: fmt.Sprintf("content exceeds %d bytes", maxInlineUploadBytes), Size: int64(len(msg.Data))})
+		return
+	}
+	data := msg.Data
+	if meta.Encoding != "" || meta.Bom {
+		var fsErr *fsError
+		if data, fsErr = encodeText(data, meta.Encoding, meta.Bom); fsErr != nil {
+			replyErr(nc, msg.Reply, fsErr)
+			return
+		}
+	}
+
+	var result *createFileResult
+	if err := withUser(meta.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doCreateFile(meta.Parent, meta.Name, data, meta.Mode)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// ── create from template ──────────────────────────────────────────────────────
+
+// templatesDir holds the file templates users can instantiate
+// (NASX_TEMPLATES_DIR). Only files directly in it can be named.
+var templatesDir = getenv("NASX_TEMPLATES_DIR", "/etc/nasx/templates")
+
+const maxTemplateBytes = 1 << 20
+
+// renderTemplate loads the template called name from templatesDir and
+// executes it with vars. A variable the template uses but vars lacks is an
+// error rather than a silent "<no value>".
+func renderTemplate(name string, vars map[string]string) ([]byte, *fsError) {
+	if !validBaseName(name) {
+		return nil, &fsError{Code: "ERR", Message: "invalid template name"}
+	}
+	f, err := os.Open(filepath.Join(templatesDir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &fsError{Code: "ENOENT", Message: "no such template"}
+		}
+		return nil, mapOsErr(err)
+	}
+	defer f.Close()
+	src, err := io.ReadAll(io.LimitReader(f, maxTemplateBytes+1))
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if len(src) > maxTemplateBytes {
+		return nil, &fsError{Code: "ETOOBIG", Message: "template too large"}
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(src))
+	if err != nil {
+		return nil, &fsError{Code: "ERR", Message: "bad template: " + err.Error()}
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, vars); err != nil {
+		return nil, &fsError{Code: "ERR", Message: "render template: " + err.Error()}
+	}
+	return out.Bytes(), nil
+}
+
+// handleCreateFromTemplate handles nasx.root.fs.create-from-template
+// (request-reply). The template is read by the worker itself, the file is
+// created as the user; like create-file, an existing name gets a " (n)"
+// suffix.
+func handleCreateFromTemplate(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		LinuxUsername string            `json:"linuxUsername"`
+		Parent        string            `json:"parent"`
+		Name          string            `json:"name"`
+		Mode          string            `json:"mode"`
+		Template      string            `json:"template"`
+		Vars          map[string]string `json:"vars"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := validatePath(req.Parent); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if !validBaseName(req.Name) {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "invalid name"})
+		return
+	}
+	data, fsErr := renderTemplate(req.Template, req.Vars)
+	if fsErr != nil {
+		replyErr(nc, msg.Reply, fsErr)
+		return
+	}
+
+	var result *createFileResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doCreateFile(req.Parent, req.Name, data, req.Mode)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// ── small upload ──────────────────────────────────────────────────────────────
+
+type uploadSmallResult struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// maxInlineUploadBytes caps the content of a one-message upload. The NATS
+// server's max_payload caps it too, but a message over that is refused by
+// the server and never gets here, so it can't be checked for.
+var maxInlineUploadBytes = getenvInt64("NASX_MAX_INLINE_UPLOAD_BYTES", 8*1024*1024) // 8 MB
+
+// handleUploadSmall handles nasx.root.fs.upload-small (request-reply): a
+// whole upload in one message, written atomically to its final location
+// without the write-chunk → assemble staging. Like assemble, an existing
+// destFile is replaced, and the file gets mode (default 644) exactly.
+// Content over maxInlineUploadBytes gets ETOOBIG so the backend falls back
+// to chunked mode.
+func handleUploadSmall(nc *nats.Conn, msg *nats.Msg) {
+	type uploadMeta struct {
+		DestFile      string `json:"destFile"`
+		Mode          string `json:"mode"` // octal, as for assemble
+		LinuxUsername string `json:"linuxUsername"`
+	}
+
+	metaJSON := msg.Header.Get("X-Meta")
+	if metaJSON == "" {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "missing X-Meta header"})
+		return
+	}
+	var meta uploadMeta
+	if err := json.Unmarshal([]byte(metaJSON), &meta); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "bad X-Meta: " + err.Error()})
+		return
+	}
+	if err := validatePath(meta.DestFile); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if int64(len(msg.Data)) > maxInlineUploadBytes {
+		replyErr(nc, msg.Reply, &fsError{Code: "ETOOBIG", Message: fmt.Sprintf("content exceeds %d bytes", maxInlineUploadBytes), Size: int64(len(msg.Data))})
+		return
+	}
+	if meta.Mode == "" {
+		meta.Mode = "644"
+	}
+	mode, err := parseMode(meta.Mode)
+	if err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+
+	if err := withUser(meta.LinuxUsername, func() error {
+		return writeFileAtomic(meta.DestFile, msg.Data, mode)
+	}); err != nil {
+		replyErr(nc, msg.Reply, mapOsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, &uploadSmallResult{Path: meta.DestFile, Size: int64(len(msg.Data))})
+}
+
+// ── write at offset ───────────────────────────────────────────────────────────
+//
+// Random-access uploads write straight into the destination file, each
+// request at its own byte offset, so parallel ranged PUTs need no assemble
+// step; gaps stay sparse until filled. Every successful write also drops an
+// empty "<offset>-<length>" marker in the upload's staging directory. Markers
+// are separate files, so concurrent writers (on any worker) never contend for
+// a shared range list, and write-at-complete checks them for gaps.
+
+type writeAtResult struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Length int    `json:"length"`
+}
+
+// doWriteAt writes data into destFile at offset, creating the file if
+// needed, and records the range in stagingDir.
+func doWriteAt(destFile, stagingDir string, offset int64, data []byte) *fsError {
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		return mapOsErr(err)
+	}
+	f, err := os.OpenFile(destFile, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return mapOsErr(err)
+	}
+	if _, err := f.WriteAt(data, offset); err != nil {
+		f.Close()
+		return mapOsErr(err)
+	}
+	if err := f.Close(); err != nil {
+		return mapOsErr(err)
+	}
+	marker := filepath.Join(stagingDir, fmt.Sprintf("%d-%d", offset, len(data)))
+	if err := os.WriteFile(marker, nil, 0644); err != nil {
+		return mapOsErr(err)
+	}
+	return nil
+}
+
+// handleWriteAt handles nasx.root.fs.write-at (request-reply). Metadata is in
+// the X-Meta header like write-chunk; msg.Data is written at offset.
+func handleWriteAt(nc *nats.Conn, msg *nats.Msg) {
+	type writeAtMeta struct {
+		UploadID      string `json:"uploadId"`
+		DestFile      string `json:"destFile"`
+		Offset        int64  `json:"offset"`
+		LinuxUsername string `json:"linuxUsername"`
+	}
+
+	metaJSON := msg.Header.Get("X-Meta")
+	if metaJSON == "" {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "missing X-Meta header"})
+		return
+	}
+	var meta writeAtMeta
+	if err := json.Unmarshal([]byte(metaJSON), &meta); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "bad X-Meta: " + err.Error()})
+		return
+	}
+	if err := validatePath(meta.DestFile); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if !validBaseName(meta.UploadID) {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "invalid uploadId"})
+		return
+	}
+	if meta.Offset < 0 {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "negative offset"})
+		return
+	}
+
+	stagingDir := stagingDirFor(filepath.Dir(meta.DestFile), meta.UploadID)
+	if err := withUser(meta.LinuxUsername, func() error {
+		if fsErr := doWriteAt(meta.DestFile, stagingDir, meta.Offset, msg.Data); fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, &writeAtResult{Path: meta.DestFile, Offset: meta.Offset, Length: len(msg.Data)})
+}
+
+type byteRange struct{ start, end int64 } // [start, end)
+
+// missingRanges reads the markers in stagingDir and returns the parts of
+// [0, size) no write covered.
+func missingRanges(stagingDir string, size int64) ([]byteRange, error) {
+	entries, err := os.ReadDir(stagingDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var written []byteRange
+	for _, e := range entries {
+		off, n, ok := strings.Cut(e.Name(), "-")
+		if !ok {
+			continue
+		}
+		start, err1 := strconv.ParseInt(off, 10, 64)
+		length, err2 := strconv.ParseInt(n, 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		written = append(written, byteRange{start, start + length})
+	}
+	sort.Slice(written, func(i, j int) bool { return written[i].start < written[j].start })
+	var gaps []byteRange
+	pos := int64(0)
+	for _, r := range written {
+		if r.start > pos {
+			gaps = append(gaps, byteRange{pos, min(r.start, size)})
+		}
+		pos = max(pos, r.end)
+		if pos >= size {
+			break
+		}
+	}
+	if pos < size {
+		gaps = append(gaps, byteRange{pos, size})
+	}
+	return gaps, nil
+}
+
+type writeAtCompleteResult struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// doWriteAtComplete checks that every byte of destFile up to size was
+// written, trims anything beyond it and removes the range markers. With gaps
+// left it fails with EGAPS, naming the first few, and keeps the markers so
+// the client can fill them and complete again.
+func doWriteAtComplete(destFile, stagingDir string, size int64) (*writeAtCompleteResult, *fsError) {
+	gaps, err := missingRanges(stagingDir, size)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if len(gaps) > 0 {
+		var desc []string
+		for _, g := range gaps[:min(len(gaps), 5)] {
+			desc = append(desc, fmt.Sprintf("%d-%d", g.start, g.end-1))
+		}
+		if len(gaps) > 5 {
+			desc = append(desc, fmt.Sprintf("and %d more", len(gaps)-5))
+		}
+		return nil, &fsError{Code: "EGAPS", Message: "missing byte ranges: " + strings.Join(desc, ", ")}
+	}
+	if err := os.Truncate(destFile, size); err != nil {
+		return nil, mapOsErr(err)
+	}
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return nil, mapOsErr(err)
+	}
+	return &writeAtCompleteResult{Path: destFile, Size: size}, nil
+}
+
+// handleWriteAtComplete handles nasx.root.fs.write-at-complete (request-reply).
+func handleWriteAtComplete(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		LinuxUsername string `json:"linuxUsername"`
+		UploadID      string `json:"uploadId"`
+		DestFile      string `json:"destFile"`
+		Size          int64  `json:"size"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := validatePath(req.DestFile); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if !validBaseName(req.UploadID) {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "invalid uploadId"})
+		return
+	}
+	if req.Size < 0 {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "negative size"})
+		return
+	}
+
+	stagingDir := stagingDirFor(filepath.Dir(req.DestFile), req.UploadID)
+	var result *writeAtCompleteResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doWriteAtComplete(req.DestFile, stagingDir, req.Size)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// ── finalize upload ───────────────────────────────────────────────────────────
+//
+// finalize-upload replaces the assemble task for chunked uploads with one
+// synchronous call: it checks the chunks, assembles, verifies and moves the
+// file into place, so the client learns the outcome in the reply instead of
+// racing the last write-chunk against a queued job.
+
+type finalizeUploadResult struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256,omitempty"` // as verified
+}
+
+// uploadChunks returns the chunk files of stagingDir in order, failing
+// unless they are exactly 0.part to count-1.part.
+func uploadChunks(stagingDir string, count int) ([]string, *fsError) {
+	entries, err := os.ReadDir(stagingDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &fsError{Code: "EGAPS", Message: "no chunks received for this upload"}
+		}
+		return nil, mapOsErr(err)
+	}
+	have := map[int]bool{}
+	for _, e := range entries {
+		n, ok := strings.CutSuffix(e.Name(), ".part")
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		if i, err := strconv.Atoi(n); err == nil && i >= 0 {
+			have[i] = true
+		}
+	}
+	var missing []string
+	chunks := make([]string, count)
+	for i := range chunks {
+		if !have[i] && len(missing) < 5 {
+			missing = append(missing, strconv.Itoa(i))
+		}
+		delete(have, i)
+		chunks[i] = filepath.Join(stagingDir, fmt.Sprintf("%d.part", i))
+	}
+	if len(missing) > 0 {
+		return nil, &fsError{Code: "EGAPS", Message: "missing chunks: " + strings.Join(missing, ", ")}
+	}
+	if len(have) > 0 {
+		return nil, &fsError{Code: "ERR", Message: fmt.Sprintf("%d chunks beyond the expected %d", len(have), count)}
+	}
+	return chunks, nil
+}
+
+// doFinalizeUpload assembles the count chunks in stagingDir into destFile
+// through a temp file (see assembleAtomic), so destFile never holds a
+// partial or unverified upload, then removes the staging directory. A
+// failed check leaves the chunks for the client to resend or retry.
+func doFinalizeUpload(destFile, stagingDir string, count int, wantSha256 string, mode fs.FileMode) (*finalizeUploadResult, *fsError) {
+	chunks, fsErr := uploadChunks(stagingDir, count)
+	if fsErr != nil {
+		return nil, fsErr
+	}
+	if err := assembleAtomic(destFile, chunks, stagingDir, mode, nil, wantSha256); err != nil {
+		return nil, mapOsErr(err)
+	}
+	info, err := os.Stat(destFile)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	_ = os.RemoveAll(stagingDir) // the upload is in place; a leftover is only clutter
+	return &finalizeUploadResult{Path: destFile, Size: info.Size(), Sha256: strings.ToLower(wantSha256)}, nil
+}
+
+// handleFinalizeUpload handles nasx.root.fs.finalize-upload (request-reply).
+func handleFinalizeUpload(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		LinuxUsername string `json:"linuxUsername"`
+		UploadID      string `json:"uploadId"`
+		DestDir       string `json:"destDir"`
+		Name          string `json:"name"`
+		ChunkCount    int    `json:"chunkCount"`
+		Sha256        string `json:"sha256"` // optional
+		Mode          string `json:"mode"`   // default 644
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := validatePath(req.DestDir); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if !validBaseName(req.UploadID) {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "invalid uploadId"})
+		return
+	}
+	if !validBaseName(req.Name) {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "invalid name"})
+		return
+	}
+	if req.ChunkCount <= 0 {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "chunkCount must be positive"})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = "644"
+	}
+	mode, err := parseMode(req.Mode)
+	if err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+
+	stagingDir := stagingDirFor(req.DestDir, req.UploadID)
+	var result *finalizeUploadResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doFinalizeUpload(filepath.Join(req.DestDir, req.Name), stagingDir, req.ChunkCount, req.Sha256, mode)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// ── replace file ──────────────────────────────────────────────────────────────
+
+type replaceFileResult struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Created bool   `json:"created"`
+}
+
+// doReplaceFile atomically replaces the contents of path with data: the new
+// content goes to a sibling temp file, is fsynced and given the original's
+// mode and ownership, then renamed over the target. Symlinks are resolved
+// first so the link itself survives. If the original's owner can't be kept
+// (the caller isn't root and doesn't own the file) the save is refused
+// rather than silently changing who owns it.
+func doReplaceFile(path string, data []byte, mustExist bool) (*replaceFileResult, *fsError) {
+	target := path
+	mode := fs.FileMode(0644)
+	uid, gid := -1, -1
+	created := false
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		target = real
+		info, err := os.Stat(target)
+		if err != nil {
+			return nil, mapOsErr(err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil, &fsError{Code: "ERR", Message: "not a regular file"}
+		}
+		mode = info.Mode() & (fs.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		sys := info.Sys().(*syscall.Stat_t)
+		uid, gid = int(sys.Uid), int(sys.Gid)
+	} else if !os.IsNotExist(err) || mustExist {
+		return nil, mapOsErr(err)
+	} else {
+		created = true
+	}
+
+	dir := filepath.Dir(target)
+	tmpName, err := writeTemp(dir, data, mode)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	defer os.Remove(tmpName) // no-op once renamed
+	if uid >= 0 {
+		if err := os.Lchown(tmpName, uid, gid); err != nil {
+			return nil, &fsError{Code: "EACCES", Message: "cannot preserve file ownership"}
+		}
+		// chown clears setuid/setgid; put them back.
+		if mode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			if err := os.Chmod(tmpName, mode); err != nil {
+				return nil, mapOsErr(err)
+			}
+		}
+	}
+	if err := os.Rename(tmpName, target); err != nil {
+		return nil, mapOsErr(err)
+	}
+	// Make the rename itself durable.
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return &replaceFileResult{Path: target, Size: int64(len(data)), Created: created}, nil
+}
+
+// handleReplaceFile handles nasx.root.fs.replace-file (request-reply).
+// Metadata arrives in the "X-Meta" NATS header; the new content in msg.Data.
+func handleReplaceFile(nc *nats.Conn, msg *nats.Msg) {
+	type replaceMeta struct {
+		Path          string `json:"path"`
+		MustExist     bool   `json:"mustExist"`
+		Encoding      string `json:"encoding"` // transcode the UTF-8 content to this encoding
+		Bom           bool   `json:"bom"`      // write a byte-order mark
+		LinuxUsername string `json:"linuxUsername"`
+	}
+
+	metaJSON := msg.Header.Get("X-Meta")
+	if metaJSON == "" {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "missing X-Meta header"})
+		return
+	}
+	var meta replaceMeta
+	if err := json.Unmarshal([]byte(metaJSON), &meta); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: "bad X-Meta: " + err.Error()})
+		return
+	}
+	if err := validatePath(meta.Path); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	data := msg.Data
+	if meta.Encoding != "" || meta.Bom {
+		var fsErr *fsError
+		if data, fsErr = encodeText(data, meta.Encoding, meta.Bom); fsErr != nil {
+			replyErr(nc, msg.Reply, fsErr)
+			return
+		}
+	}
+
+	var result *replaceFileResult
+	if err := withUser(meta.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doReplaceFile(meta.Path, data, meta.MustExist)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// ── writable check ────────────────────────────────────────────────────────────
+
+type checkWritableResult struct {
+	Writable bool   `json:"writable"`
+	Code     string `json:"code,omitempty"` // why not: EACCES, EROFS, ENOSPC, EDQUOT, ...
+	Message  string `json:"message,omitempty"`
+}
+
+// doCheckWritable finds out whether the caller can write into dir by doing
+// it: a temp file is created and removed again. Unlike checking mode bits
+// this honours ACLs, read-only mounts, immutable directories and a full disk
+// or quota. Must run as the user the upload will be written as.
+func doCheckWritable(dir string) (*checkWritableResult, *fsError) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if !info.IsDir() {
+		return nil, &fsError{Code: "ERR", Message: "not a directory"}
+	}
+	f, err := os.CreateTemp(dir, ".nasx-probe-*")
+	if err != nil {
+		fe := mapOsErr(err)
+		return &checkWritableResult{Code: fe.Code, Message: fe.Message}, nil
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return &checkWritableResult{Writable: true}, nil
+}
+
+// handleCheckWritable handles nasx.root.fs.check-writable (request-reply).
+// A directory that can't be written is an ok reply with writable=false.
+func handleCheckWritable(nc *nats.Conn, msg *nats.Msg) {
+	var req syncMsg
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *checkWritableResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doCheckWritable(req.Path)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// ── pre-upload check ──────────────────────────────────────────────────────────
+
+type preUploadResult struct {
+	Ok        bool   `json:"ok"`
+	Required  int64  `json:"required"`  // bytes the upload will need at its peak
+	Available int64  `json:"available"` // bytes the user can still write there
+	Reason    string `json:"reason,omitempty"`
+}
+
+// availableBytes is how much the effective user can still write to the
+// filesystem of path, whose statfs is st: the free space not reserved for
+// root, or less if a hard block quota is tighter.
+func availableBytes(path string, st *unix.Statfs_t) int64 {
+	avail := int64(st.Bavail) * st.Bsize
+	if dq, err := getUserQuota(path, os.Geteuid()); err == nil && dq.BHardLimit > 0 {
+		left := max(int64(dq.BHardLimit)*quotaBlockSize-int64(dq.CurSpace), 0)
+		avail = min(avail, left)
+	}
+	return avail
+}
+
+// doPreUpload reports whether an upload of size bytes into dir can succeed.
+// A chunked upload briefly needs twice its size: the staged chunks live next
+// to the destination until assemble has written the final file. It must run
+// as the uploading user: statfs's available count already excludes the
+// blocks reserved for root, the write check uses the effective ids, and the
+// user's own hard quota, if any, caps what is available.
+func doPreUpload(dir string, size int64) (*preUploadResult, *fsError) {
+	if size < 0 {
+		return nil, &fsError{Code: "ERR", Message: "invalid size"}
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	if !info.IsDir() {
+		return nil, &fsError{Code: "ERR", Message: "not a directory"}
+	}
+	res := &preUploadResult{Ok: true, Required: 2 * size}
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return nil, mapOsErr(&os.PathError{Op: "statfs", Path: dir, Err: err})
+	}
+	res.Available = availableBytes(dir, &st)
+	if err := unix.Faccessat(unix.AT_FDCWD, dir, unix.W_OK, unix.AT_EACCESS); err != nil {
+		res.Ok, res.Reason = false, "permission denied"
+		return res, nil
+	}
+	if res.Required > res.Available {
+		res.Ok, res.Reason = false, "not enough free space or quota"
+	}
+	return res, nil
+}
+
+// handlePreUpload handles nasx.root.fs.pre-upload (request-reply). Path is
+// the destination directory; a refusal is an ok reply with ok=false.
+func handlePreUpload(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Size int64 `json:"size"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *preUploadResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doPreUpload(req.Path, req.Size)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
+
+// ── preallocate ───────────────────────────────────────────────────────────────
+
+type preallocateResult struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`   // the file's size now
+	Sparse bool   `json:"sparse"` // only the size was set: the space is not reserved
+}
+
+// doPreallocate reserves size bytes for path with fallocate, creating it if
+// needed, so that a large upload finds out about ENOSPC before it starts
+// and gets contiguous blocks. The file is never shrunk. Where fallocate
+// isn't supported (NFS before 4.2, some FUSE filesystems) allowSparse sets
+// the size with ftruncate instead, which reserves nothing; otherwise that
+// fails with EUNSUPPORTED. Like pre-upload it must run as the user, whose
+// free space and quota it checks first.
+func doPreallocate(path string, size int64, allowSparse bool) (*preallocateResult, *fsError) {
+	if size <= 0 {
+		return nil, &fsError{Code: "ERR", Message: "size must be positive"}
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(filepath.Dir(path), &st); err != nil {
+		return nil, mapOsErr(&os.PathError{Op: "statfs", Path: filepath.Dir(path), Err: err})
+	}
+	need := size
+	if info, err := os.Stat(path); err == nil {
+		if !info.Mode().IsRegular() {
+			return nil, &fsError{Code: "ERR", Message: "not a regular file"}
+		}
+		need -= info.Sys().(*syscall.Stat_t).Blocks * 512
+	}
+	if avail := availableBytes(filepath.Dir(path), &st); need > avail {
+		return nil, &fsError{Code: "ENOSPC", Message: fmt.Sprintf("%d more bytes needed, %d available (free space or quota)", need, avail)}
+	}
+
+	_, statErr := os.Lstat(path)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, mapOsErr(err)
+	}
+	res := &preallocateResult{Path: path, Size: size}
+	err = unix.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		if !allowSparse {
+			err = &fsError{Code: "EUNSUPPORTED", Message: "filesystem does not support preallocation"}
+		} else if info, statErr := f.Stat(); statErr != nil {
+			err = statErr
+		} else {
+			err = nil
+			if info.Size() < size {
+				err = f.Truncate(size)
+			}
+			res.Sparse = true
+		}
+	} else if err != nil {
+		err = &os.PathError{Op: "fallocate", Path: path, Err: err}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if os.IsNotExist(statErr) {
+			_ = os.Remove(path)
+		}
+		return nil, mapOsErr(err)
+	}
+	if info, err := os.Stat(path); err == nil {
+		res.Size = info.Size() // larger than asked if it already was
+	}
+	return res, nil
+}
+
+// handlePreallocate handles nasx.root.fs.preallocate (request-reply).
+func handlePreallocate(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Size        int64 `json:"size"`
+		AllowSparse bool  `json:"allowSparse"` // fall back to setting the size where fallocate is unsupported
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	var result *preallocateResult
+	if err := withUser(req.LinuxUsername, func() error {
+		var fsErr *fsError
+		result, fsErr = doPreallocate(req.Path, req.Size, req.AllowSparse)
+		if fsErr != nil {
+			return fsErr
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
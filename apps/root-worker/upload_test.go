@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// TestMissingRanges writes range markers as write-at does and checks the
+// gaps left in [0, 10).
+func TestMissingRanges(t *testing.T) {
+	const size = 10
+	for _, tc := range []struct {
+		name    string
+		markers []string
+		want    []byteRange
+	}{
+		{"nothing written", nil, []byteRange{{0, 10}}},
+		{"whole file", []string{"0-10"}, nil},
+		{"adjacent", []string{"0-5", "5-5"}, nil},
+		{"overlapping", []string{"0-6", "4-4"}, []byteRange{{8, 10}}},
+		{"contained", []string{"0-10", "2-3"}, nil},
+		{"out of order", []string{"6-4", "0-3"}, []byteRange{{3, 6}}},
+		{"two gaps", []string{"2-2", "6-2"}, []byteRange{{0, 2}, {4, 6}, {8, 10}}},
+		{"ends past size", []string{"0-3", "8-10"}, []byteRange{{3, 8}}},
+		{"starts past size", []string{"0-4", "12-3"}, []byteRange{{4, 10}}},
+		{"not markers", []string{"0-10x", "a-1", "5", "5.part"}, []byteRange{{0, 10}}},
+	} {
+		dir := t.TempDir()
+		for _, m := range tc.markers {
+			if err := os.WriteFile(filepath.Join(dir, m), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := missingRanges(dir, size)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: gaps %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	got, err := missingRanges(filepath.Join(t.TempDir(), "missing"), size)
+	if err != nil || !slices.Equal(got, []byteRange{{0, 10}}) {
+		t.Errorf("no staging directory: gaps %v, %v; want [{0 10}]", got, err)
+	}
+}
+
+// TestUploadChunks checks that finalize-upload only accepts exactly the
+// chunks 0 to count-1.
+func TestUploadChunks(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files []string
+		count int
+		code  string // "" = ok
+	}{
+		{"all there", []string{"0.part", "1.part", "2.part"}, 3, ""},
+		{"other files ignored", []string{"0.part", "1.part", "0-10", "x.part", "-1.part"}, 2, ""},
+		{"first missing", []string{"1.part", "2.part"}, 3, "EGAPS"},
+		{"middle missing", []string{"0.part", "2.part"}, 3, "EGAPS"},
+		{"last missing", []string{"0.part", "1.part"}, 3, "EGAPS"},
+		{"none", nil, 2, "EGAPS"},
+		{"extra chunk", []string{"0.part", "1.part", "2.part"}, 2, "ERR"},
+		{"chunk far beyond", []string{"0.part", "1.part", "9.part"}, 2, "ERR"},
+	} {
+		dir := t.TempDir()
+		for _, f := range tc.files {
+			if err := os.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		chunks, fsErr := uploadChunks(dir, tc.count)
+		switch {
+		case tc.code == "" && fsErr != nil:
+			t.Errorf("%s: %v", tc.name, fsErr)
+		case tc.code != "" && (fsErr == nil || fsErr.Code != tc.code):
+			t.Errorf("%s: got %v, want %s", tc.name, fsErr, tc.code)
+		case tc.code == "" && len(chunks) != tc.count:
+			t.Errorf("%s: %d chunks, want %d", tc.name, len(chunks), tc.count)
+		}
+		for i, c := range chunks {
+			if want := filepath.Join(dir, strconv.Itoa(i)+".part"); c != want {
+				t.Errorf("%s: chunk %d is %s, want %s", tc.name, i, c, want)
+			}
+		}
+	}
+
+	if _, fsErr := uploadChunks(filepath.Join(t.TempDir(), "missing"), 1); fsErr == nil || fsErr.Code != "EGAPS" {
+		t.Errorf("no staging directory: got %v, want EGAPS", fsErr)
+	}
+}
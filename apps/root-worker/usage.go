@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ── Disk usage ────────────────────────────────────────────────────────────────
+
+const defaultUsageWorkers = 4
+
+// duResult is the recursive size of one tree.
+type duResult struct {
+	Bytes   int64
+	Files   int64
+	Partial bool // budget ran out before the walk finished
+}
+
+// du sums the apparent sizes of the regular files under root, counting a
+// hardlinked file once. Unreadable subtrees are skipped.
+func du(root string, budget *walkBudget) (duResult, error) {
+	var res duResult
+	seen := map[[2]uint64]bool{}
+	guard := newDirGuard()
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			return nil
+		}
+		if budget.expired() {
+			res.Partial = true
+			return filepath.SkipAll
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			return guard.enter(info, relDepth(root, p))
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		sys := info.Sys().(*syscall.Stat_t)
+		if sys.Nlink > 1 {
+			key := [2]uint64{sys.Dev, sys.Ino}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		res.Bytes += info.Size()
+		res.Files++
+		return nil
+	})
+	return res, err
+}
+
+type usageEntry struct {
+	Name       string `json:"name"`
+	TotalBytes int64  `json:"totalBytes"`
+	FileCount  int64  `json:"fileCount"`
+	Error      string `json:"error,omitempty"` // the subdirectory couldn't be read
+}
+
+type usageResult struct {
+	Dirs       []usageEntry `json:"dirs"`       // largest first
+	FilesBytes int64        `json:"filesBytes"` // files directly in the directory
+	FileCount  int64        `json:"fileCount"`
+	Partial    bool         `json:"partial"` // time budget hit; totals are lower bounds
+}
+
+// doUsageBreakdown sizes every immediate subdirectory of dir, for a
+// treemap. The per-child walks run on up to workers goroutines, each of
+// which impersonates username itself, and share one time budget.
+func doUsageBreakdown(dir, username, group string, workers int, budget *walkBudget) (*usageResult, *fsError) {
+	var entries []os.DirEntry
+	res := &usageResult{Dirs: []usageEntry{}}
+	if err := withUserGroup(username, group, func() error {
+		var err error
+		if entries, err = os.ReadDir(dir); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() {
+				continue
+			}
+			if info, err := e.Info(); err == nil {
+				res.FilesBytes += info.Size()
+				res.FileCount++
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, mapOsErr(err)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			entry := usageEntry{Name: name}
+			var r duResult
+			if err := withUserGroup(username, group, func() error {
+				var err error
+				r, err = du(filepath.Join(dir, name), budget)
+				return err
+			}); err != nil {
+				entry.Error = mapOsErr(err).Message
+			}
+			entry.TotalBytes, entry.FileCount = r.Bytes, r.Files
+			mu.Lock()
+			res.Dirs = append(res.Dirs, entry)
+			res.Partial = res.Partial || r.Partial
+			mu.Unlock()
+		}(e.Name())
+	}
+	wg.Wait()
+	if budget.expired() {
+		res.Partial = true
+	}
+	sort.Slice(res.Dirs, func(a, b int) bool { return res.Dirs[a].TotalBytes > res.Dirs[b].TotalBytes })
+	return res, nil
+}
+
+// handleUsageBreakdown handles nasx.root.fs.usage-breakdown (request-reply).
+func handleUsageBreakdown(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		RunAsGroup string `json:"runAsGroup"`
+		Workers    int    `json:"workers"`    // parallel subdirectory walks, 0 = server default
+		TimeBudget int    `json:"timeBudget"` // seconds, 0 = server default
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	workers := req.Workers
+	if workers <= 0 {
+		workers = defaultUsageWorkers
+	}
+	budget := newWalkBudget(0, req.TimeBudget)
+	result, fsErr := doUsageBreakdown(req.Path, req.LinuxUsername, req.RunAsGroup, min(workers, maxCopyWorkers), budget)
+	if fsErr != nil {
+		replyErr(nc, msg.Reply, fsErr)
+		return
+	}
+	replyOk(nc, msg.Reply, result)
+}
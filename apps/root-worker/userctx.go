@@ -1,17 +1,27 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"os/exec"
 	"os/user"
+	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"slices"
 	"strconv"
+	"strings"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 type userCtx struct {
 	uid  uint32
 	gid  uint32
 	gids []int
+	home string
 }
 
 // resolveUser looks up uid, primary gid, and supplementary gids for a Linux username.
@@ -39,48 +49,265 @@ func resolveUser(username string) (userCtx, error) {
 			gids = append(gids, n)
 		}
 	}
-	return userCtx{uid: uint32(uid), gid: uint32(gid), gids: gids}, nil
+	return userCtx{uid: uint32(uid), gid: uint32(gid), gids: gids, home: u.HomeDir}, nil
+}
+
+// expandHome expands a leading "~" in p to the home directory in username's
+// passwd entry. Other paths are returned unchanged; "~otheruser" is not
+// supported. The result still has to go through validatePath.
+func expandHome(username, p string) (string, error) {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p, nil
+	}
+	if username == "" {
+		return "", errors.New("invalid path: ~ needs a linuxUsername")
+	}
+	ctx, err := resolveUser(username)
+	if err != nil {
+		return "", err
+	}
+	if ctx.home == "" {
+		return "", fmt.Errorf("invalid path: user %q has no home directory", username)
+	}
+	return filepath.Join(ctx.home, p[1:]), nil
+}
+
+// impersonationSlots caps concurrent runAsUser calls (NASX_MAX_IMPERSONATIONS).
+// Each holds an OS thread for as long as fn runs, so without a cap a burst of
+// requests turns into a burst of threads. Callers over the cap wait. The
+// floor is 2: a parallel copy keeps its task's slot while its workers, each
+// impersonating on its own, queue for the others.
+var impersonationSlots = make(chan struct{}, max(getenvInt("NASX_MAX_IMPERSONATIONS", 64), 2))
+
+// rootGroups are the supplementary groups the process started with, which
+// runAsUser puts back on the thread afterwards.
+var rootGroups, _ = unix.Getgroups()
+
+// The credential syscalls are made raw on purpose. syscall.Setresuid and
+// friends (and x/sys/unix's, which wrap them) apply to every thread of the
+// process since Go 1.16, which would hand one request's uid to all the
+// others running concurrently. The raw syscalls change only the calling
+// thread, which is what impersonation needs. setgroups(2) via unix.Setgroups
+// is already per-thread.
+func setresuidThread(r, e, s int) error {
+	if _, _, errno := unix.RawSyscall(unix.SYS_SETRESUID, uintptr(r), uintptr(e), uintptr(s)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setresgidThread(r, e, s int) error {
+	if _, _, errno := unix.RawSyscall(unix.SYS_SETRESGID, uintptr(r), uintptr(e), uintptr(s)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// restoreRoot puts the calling thread back to root's credentials and reports
+// whether it verifiably got there.
+func restoreRoot() bool {
+	// uid first (saved uid = 0 allows this without CAP_SETUID), then gid
+	// and groups, which need the euid 0 back.
+	if setresuidThread(0, 0, 0) != nil || setresgidThread(0, 0, 0) != nil || unix.Setgroups(rootGroups) != nil {
+		return false
+	}
+	ruid, euid, suid := unix.Getresuid()
+	rgid, egid, sgid := unix.Getresgid()
+	groups, err := unix.Getgroups()
+	return err == nil && ruid|euid|suid|rgid|egid|sgid == 0 && slices.Equal(groups, rootGroups)
+}
+
+// verifyDropped reads back the calling thread's credentials and checks they
+// are ctx's. A set*id call that returned success without taking effect (an
+// odd kernel, a seccomp filter faking success) would otherwise run fn as
+// root against the user's files.
+func verifyDropped(ctx userCtx) error {
+	_, euid, _ := unix.Getresuid()
+	rgid, egid, _ := unix.Getresgid()
+	if euid != int(ctx.uid) || rgid != int(ctx.gid) || egid != int(ctx.gid) {
+		return fmt.Errorf("privilege drop did not take effect: euid %d, gid %d/%d, want uid %d, gid %d", euid, rgid, egid, ctx.uid, ctx.gid)
+	}
+	groups, err := unix.Getgroups()
+	if err != nil {
+		return fmt.Errorf("getgroups: %w", err)
+	}
+	want := slices.Clone(ctx.gids)
+	slices.Sort(want)
+	slices.Sort(groups)
+	if !slices.Equal(slices.Compact(groups), slices.Compact(want)) {
+		return fmt.Errorf("privilege drop did not take effect: groups %v, want %v", groups, want)
+	}
+	return nil
+}
+
+// callRecovering runs fn, turning a panic into an error so that runAsUser
+// still restores the thread's credentials and answers its caller.
+func callRecovering(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic while impersonating: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("internal error: %v", r)
+		}
+	}()
+	return fn()
 }
 
 // runAsUser executes fn with the effective uid/gid of the given user context.
 //
 // Implementation notes:
-//   - LockOSThread pins the goroutine to a single OS thread so that uid/gid
-//     changes (which are per-thread on Linux) do not bleed into other goroutines.
-//   - We intentionally do NOT call UnlockOSThread: when the goroutine exits the
-//     runtime destroys the OS thread, preventing any credential leak.
+//   - LockOSThread pins the goroutine to a single OS thread; the credential
+//     changes are per-thread (see setresuidThread), so they do not bleed into
+//     other goroutines.
 //   - Order: set supplementary groups and gid first (while still root), then
 //     drop to effective uid. Restore in reverse order.
+//   - A panic in fn is recovered (callRecovering) and returned as an error,
+//     after the credentials are restored, rather than killing the worker.
+//   - Thread reuse: once the thread is verifiably back to root's uid, gids
+//     and groups it is unlocked and returns to the runtime's pool, saving a
+//     thread creation per call. If the restore can't be verified the thread
+//     stays locked and the runtime destroys it when the goroutine exits;
+//     that costs a new thread next time but can never leak credentials.
 func runAsUser(ctx userCtx, fn func() error) error {
+	impersonationSlots <- struct{}{}
+	defer func() { <-impersonationSlots }()
+
 	ch := make(chan error, 1)
 	go func() {
 		runtime.LockOSThread()
 
 		// 1. Supplementary groups (requires CAP_SETGID, still root here).
-		if err := syscall.Setgroups(ctx.gids); err != nil {
+		if err := unix.Setgroups(ctx.gids); err != nil {
 			ch <- fmt.Errorf("setgroups: %w", err)
 			return
 		}
 		// 2. Primary gid (keep saved gid = 0 to allow restore).
-		if err := syscall.Setresgid(int(ctx.gid), int(ctx.gid), 0); err != nil {
+		if err := setresgidThread(int(ctx.gid), int(ctx.gid), 0); err != nil {
 			ch <- fmt.Errorf("setresgid: %w", err)
 			return
 		}
 		// 3. Effective uid — drop root (keep real uid = 0, saved uid = 0).
-		if err := syscall.Setresuid(0, int(ctx.uid), 0); err != nil {
+		if err := setresuidThread(0, int(ctx.uid), 0); err != nil {
 			ch <- fmt.Errorf("setresuid: %w", err)
 			return
 		}
+		// 4. Check the drop took effect before touching anything as the user.
+		if err := verifyDropped(ctx); err != nil {
+			restoreRoot() // the thread stays locked and is discarded
+			ch <- err
+			return
+		}
 
-		err := fn()
-
-		// Restore: uid first (saved uid = 0 allows this without CAP_SETUID).
-		_ = syscall.Setresuid(0, 0, 0)
-		// Then gid (now euid = 0, CAP_SETGID restored).
-		_ = syscall.Setresgid(0, 0, 0)
-		_ = syscall.Setgroups([]int{0})
+		err := callRecovering(fn)
 
+		if restoreRoot() {
+			runtime.UnlockOSThread()
+		}
 		ch <- err
 	}()
 	return <-ch
 }
+
+// ── child processes ───────────────────────────────────────────────────────────
+
+// threadCredential returns the calling thread's effective uid, gid and
+// groups: inside runAsUser's fn, the user's.
+func threadCredential() (*syscall.Credential, error) {
+	_, euid, _ := unix.Getresuid()
+	_, egid, _ := unix.Getresgid()
+	groups, err := unix.Getgroups()
+	if err != nil {
+		return nil, fmt.Errorf("getgroups: %w", err)
+	}
+	cred := &syscall.Credential{Uid: uint32(euid), Gid: uint32(egid), Groups: make([]uint32, len(groups))}
+	for i, g := range groups {
+		cred.Groups[i] = uint32(g)
+	}
+	return cred, nil
+}
+
+// startAsThreadUser starts cmd as the calling thread's effective user, with
+// real, effective and saved ids all dropped. Forked straight from an
+// impersonated thread the child would keep runAsUser's real and saved uid
+// 0, so it could setresuid back to root, and execve would hand it a full
+// permitted capability set besides. Instead the fork happens from a
+// goroutine of its own, which runs on an unlocked thread and so as root,
+// and the child sets all its ids to the user's before exec.
+func startAsThreadUser(cmd *exec.Cmd) error {
+	cred, err := threadCredential()
+	if err != nil {
+		return err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = cred
+	ch := make(chan error, 1)
+	go func() { ch <- cmd.Start() }()
+	return <-ch
+}
+
+// ── startup self-check ────────────────────────────────────────────────────────
+
+// Capability bits runAsUser depends on, from linux/capability.h.
+const (
+	capSetgid = 6
+	capSetuid = 7
+)
+
+// checkImpersonation verifies at startup that runAsUser can work, so that a
+// worker deployed without root or without CAP_SETUID/CAP_SETGID fails once,
+// loudly, instead of on every request. It logs the effective capabilities,
+// then drops a throwaway thread to nobody's ids and back.
+func checkImpersonation() error {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("capget: %w", err)
+	}
+	eff := uint64(data[1].Effective)<<32 | uint64(data[0].Effective)
+	nnp, _ := unix.PrctlRetInt(unix.PR_GET_NO_NEW_PRIVS, 0, 0, 0, 0)
+	log.Printf("credentials: euid %d, effective capabilities %#x, no_new_privs %d", unix.Geteuid(), eff, nnp)
+	if unix.Geteuid() != 0 {
+		return fmt.Errorf("the worker must run as root (euid is %d)", unix.Geteuid())
+	}
+	for _, c := range []struct {
+		bit  uint
+		name string
+	}{{capSetuid, "CAP_SETUID"}, {capSetgid, "CAP_SETGID"}} {
+		if eff&(1<<c.bit) == 0 {
+			return fmt.Errorf("missing %s, needed to impersonate users", c.name)
+		}
+	}
+
+	const nobody = 65534
+	ch := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread() // never unlocked: the thread is discarded
+		ctx := userCtx{uid: nobody, gid: nobody, gids: []int{nobody}}
+		if err := unix.Setgroups(ctx.gids); err != nil {
+			ch <- fmt.Errorf("setgroups: %w", err)
+			return
+		}
+		if err := setresgidThread(nobody, nobody, 0); err != nil {
+			ch <- fmt.Errorf("setresgid: %w", err)
+			return
+		}
+		if err := setresuidThread(0, nobody, 0); err != nil {
+			ch <- fmt.Errorf("setresuid: %w", err)
+			return
+		}
+		if err := verifyDropped(ctx); err != nil {
+			ch <- err
+			return
+		}
+		if !restoreRoot() {
+			ch <- errors.New("could not restore root credentials after a test drop")
+			return
+		}
+		ch <- nil
+	}()
+	if err := <-ch; err != nil {
+		return fmt.Errorf("impersonation self-check: %w", err)
+	}
+	return nil
+}
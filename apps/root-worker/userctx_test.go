@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// requireRoot skips tests that impersonate: only root can change its ids.
+func requireRoot(t *testing.T) {
+	t.Helper()
+	if unix.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+}
+
+// checkThreadRoot fails unless the calling thread has root's ids and groups.
+func checkThreadRoot() error {
+	ruid, euid, suid := unix.Getresuid()
+	rgid, egid, sgid := unix.Getresgid()
+	groups, err := unix.Getgroups()
+	if err != nil {
+		return err
+	}
+	if ruid|euid|suid|rgid|egid|sgid != 0 || !slices.Equal(groups, rootGroups) {
+		return fmt.Errorf("thread not root: uid %d/%d/%d, gid %d/%d/%d, groups %v", ruid, euid, suid, rgid, egid, sgid, groups)
+	}
+	return nil
+}
+
+// TestRunAsUserNoCredentialLeak runs many impersonations with distinct ids
+// side by side with goroutines that don't impersonate, and checks that each
+// sees only its own credentials: no fn runs with another's ids, and no
+// thread goes back to the pool still carrying a user's.
+func TestRunAsUserNoCredentialLeak(t *testing.T) {
+	requireRoot(t)
+
+	const users, rounds = 32, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, users*rounds*2)
+	for i := 0; i < users; i++ {
+		ctx := userCtx{uid: uint32(60000 + i), gid: uint32(61000 + i), gids: []int{61000 + i, 62000}}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				err := runAsUser(ctx, func() error {
+					runtime.Gosched()
+					return verifyDropped(ctx)
+				})
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				runtime.Gosched()
+				if err := checkThreadRoot(); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestRunAsUserRecoversPanic checks that a panic in fn reaches the caller as
+// an error, and that runAsUser still works afterwards.
+func TestRunAsUserRecoversPanic(t *testing.T) {
+	requireRoot(t)
+
+	ctx := userCtx{uid: 65534, gid: 65534, gids: []int{65534}}
+	err := runAsUser(ctx, func() error { panic("boom") })
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("runAsUser after a panic: got %v, want an error mentioning the panic", err)
+	}
+	if err := runAsUser(ctx, func() error { return verifyDropped(ctx) }); err != nil {
+		t.Fatalf("runAsUser after a recovered panic: %v", err)
+	}
+	if err := checkThreadRoot(); err != nil {
+		t.Fatal(err)
+	}
+}
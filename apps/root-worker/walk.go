@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ── Walk budgets ──────────────────────────────────────────────────────────────
+
+const (
+	defaultWalkMaxEntries = 100_000
+	defaultWalkBudget     = 60 * time.Second
+	maxWalkBudget         = 30 * time.Minute
+)
+
+// walkBudget bounds how much work a tree walk may do. A zero request value
+// picks the server default; requests can't exceed the server maximum.
+type walkBudget struct {
+	maxEntries int
+	deadline   time.Time
+	entries    int
+}
+
+func newWalkBudget(maxEntries, seconds int) *walkBudget {
+	if maxEntries <= 0 || maxEntries > defaultWalkMaxEntries*10 {
+		maxEntries = defaultWalkMaxEntries
+	}
+	d := time.Duration(seconds) * time.Second
+	if d <= 0 {
+		d = defaultWalkBudget
+	}
+	if d > maxWalkBudget {
+		d = maxWalkBudget
+	}
+	return &walkBudget{maxEntries: maxEntries, deadline: time.Now().Add(d)}
+}
+
+// tick counts one entry and reports whether the budget is exhausted.
+func (b *walkBudget) tick() bool {
+	b.entries++
+	return b.entries > b.maxEntries || time.Now().After(b.deadline)
+}
+
+func (b *walkBudget) expired() bool {
+	return time.Now().After(b.deadline)
+}
+
+// ── Depth and cycle guard ─────────────────────────────────────────────────────
+
+var maxWalkDepth = getenvInt("NASX_MAX_DEPTH", 256)
+
+// dirGuard bounds how deep a recursive operation may descend and catches
+// directory cycles. Walks never follow symlinks, but a bind mount can still
+// make a directory its own descendant, so the (dev, ino) of every directory
+// entered is recorded and a revisit fails with ELOOP.
+type dirGuard struct {
+	mu   sync.Mutex
+	seen map[[2]uint64]bool
+}
+
+func newDirGuard() *dirGuard {
+	return &dirGuard{seen: map[[2]uint64]bool{}}
+}
+
+// enter records the directory described by info, depth levels below the
+// operation's root (the root itself is depth 0).
+func (g *dirGuard) enter(info fs.FileInfo, depth int) error {
+	if depth > maxWalkDepth {
+		return &fsError{Code: "EDEPTH", Message: fmt.Sprintf("directory depth exceeds %d", maxWalkDepth)}
+	}
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	key := [2]uint64{sys.Dev, sys.Ino}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.seen[key] {
+		return &fsError{Code: "ELOOP", Message: "directory cycle detected"}
+	}
+	g.seen[key] = true
+	return nil
+}
+
+// relDepth returns how many levels p lies below root.
+func relDepth(root, p string) int {
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == "." {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// checkTree walks root with a fresh guard so that a destructive operation
+// can fail with EDEPTH or ELOOP before it has touched anything.
+func checkTree(root string) *fsError {
+	g := newDirGuard()
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return g.enter(info, relDepth(root, p))
+	})
+	if err != nil {
+		return mapOsErr(err)
+	}
+	return nil
+}
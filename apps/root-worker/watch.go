@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// ── Directory watches (inotify) ───────────────────────────────────────────────
+//
+// A client asks to watch a directory on nasx.root.fs.watch, giving a subject
+// on which it wants events. The worker publishes a watchEvent there for every
+// create/delete/modify/rename/chmod inside the directory until the client
+// sends nasx.root.fs.unwatch, the watch sits idle for too long, or the watched
+// directory itself goes away (in which case a final "gone" event is sent).
+//
+// A watch lives on the worker instance that set it up, while the shared
+// subjects go to whichever instance the queue group picks. So a watch is
+// renewed (its idle timer reset) by a watch request on
+// nasx.root.fs.watch.<watchId> and stopped on nasx.root.fs.unwatch.<watchId>,
+// subjects only its instance listens on: watch ids start with the instance's
+// id. Only the user who set a watch up can renew or stop it.
+
+var (
+	maxWatches       = getenvInt("NASX_MAX_WATCHES", 64)
+	watchIdleTimeout = time.Duration(getenvInt("NASX_WATCH_IDLE_SECONDS", 600)) * time.Second
+
+	watchMu sync.Mutex
+	watches = map[string]*dirWatch{}
+)
+
+type watchEvent struct {
+	WatchID string `json:"watchId"`
+	Op      string `json:"op"` // create | delete | modify | rename | chmod | gone
+	Path    string `json:"path"`
+}
+
+// watchSubjectPrefixes are where a client may have events sent: its own
+// inbox, or a subject under nasx.events.watch. Anything else might be a
+// subject some handler acts on; an event payload carries a "path" field.
+var watchSubjectPrefixes = []string{"_INBOX.", "nasx.events.watch."}
+
+// validWatchSubject reports whether events may be published on subject.
+func validWatchSubject(subject string) bool {
+	if strings.ContainsAny(subject, "*> \t\r\n") {
+		return false
+	}
+	for _, prefix := range watchSubjectPrefixes {
+		if len(subject) > len(prefix) && strings.HasPrefix(subject, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type dirWatch struct {
+	id      string
+	owner   string // linuxUsername that set the watch up
+	path    string
+	subject string
+	watcher *fsnotify.Watcher
+	idle    *time.Timer
+	once    sync.Once
+}
+
+func (w *dirWatch) stop() {
+	w.once.Do(func() {
+		watchMu.Lock()
+		delete(watches, w.id)
+		watchMu.Unlock()
+		w.idle.Stop()
+		_ = w.watcher.Close()
+	})
+}
+
+func (w *dirWatch) publish(nc *nats.Conn, op, path string) {
+	data, _ := json.Marshal(watchEvent{WatchID: w.id, Op: op, Path: path})
+	if err := nc.Publish(w.subject, data); err != nil {
+		log.Printf("watch %s: publish: %v", w.id, err)
+	}
+}
+
+func (w *dirWatch) run(nc *nats.Conn) {
+	defer w.stop()
+	for {
+		select {
+		case ev, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.idle.Reset(watchIdleTimeout)
+			if ev.Name == w.path && ev.Has(fsnotify.Remove|fsnotify.Rename) {
+				w.publish(nc, "gone", w.path)
+				return
+			}
+			w.publish(nc, watchOp(ev.Op), ev.Name)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("watch %s: %v", w.id, err)
+		}
+	}
+}
+
+func watchOp(op fsnotify.Op) string {
+	switch {
+	case op.Has(fsnotify.Create):
+		return "create"
+	case op.Has(fsnotify.Remove):
+		return "delete"
+	case op.Has(fsnotify.Rename):
+		return "rename"
+	case op.Has(fsnotify.Write):
+		return "modify"
+	default:
+		return "chmod"
+	}
+}
+
+// startWatch sets up the inotify watch. It must be called as the target user
+// so that the kernel's read-permission check on the directory applies.
+func startWatch(path, subject string) (*dirWatch, error) {
+	path = filepath.Clean(path) // events carry the path as added
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(path); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return &dirWatch{id: instanceID + "." + nuid.Next(), path: path, subject: subject, watcher: watcher}, nil
+}
+
+// handleWatch handles nasx.root.fs.watch[.<watchId>] (request-reply).
+func handleWatch(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		syncMsg
+		Subject string `json:"subject"`
+		WatchID string `json:"watchId"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if id, ok := strings.CutPrefix(msg.Subject, "nasx.root.fs.watch."); ok {
+		req.WatchID = id
+	}
+
+	if req.WatchID != "" {
+		w, ok := ownWatch(req.WatchID, req.LinuxUsername)
+		if !ok {
+			replyErr(nc, msg.Reply, noSuchWatch(req.WatchID))
+			return
+		}
+		w.idle.Reset(watchIdleTimeout)
+		replyOk(nc, msg.Reply, map[string]string{"watchId": w.id})
+		return
+	}
+
+	if err := req.resolvePath(); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if !validWatchSubject(req.Subject) {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: fmt.Sprintf("invalid subject: must start with %s", strings.Join(watchSubjectPrefixes, " or "))})
+		return
+	}
+
+	var w *dirWatch
+	if err := withUser(req.LinuxUsername, func() error {
+		var err error
+		w, err = startWatch(req.Path, req.Subject)
+		if err != nil {
+			return mapOsErr(err)
+		}
+		return nil
+	}); err != nil {
+		replyErr(nc, msg.Reply, toFsErr(err))
+		return
+	}
+
+	watchMu.Lock()
+	if len(watches) >= maxWatches {
+		watchMu.Unlock()
+		_ = w.watcher.Close()
+		replyErr(nc, msg.Reply, &fsError{Code: "ELIMIT", Message: fmt.Sprintf("too many watches (max %d)", maxWatches)})
+		return
+	}
+	w.owner = req.LinuxUsername
+	w.idle = time.AfterFunc(watchIdleTimeout, w.stop)
+	watches[w.id] = w
+	watchMu.Unlock()
+	go w.run(nc)
+
+	replyOk(nc, msg.Reply, map[string]string{"watchId": w.id})
+}
+
+// noSuchWatch is the error for a watch id this instance doesn't hold. When
+// another instance issued the id, it names the subjects that reach it.
+func noSuchWatch(id string) *fsError {
+	if instance, _, _ := strings.Cut(id, "."); instance != instanceID {
+		return &fsError{Code: "ENOENT", Message: fmt.Sprintf("watch held by another worker: use nasx.root.fs.watch.%s or nasx.root.fs.unwatch.%s", id, id)}
+	}
+	return &fsError{Code: "ENOENT", Message: "no such watch"}
+}
+
+// ownWatch returns the watch id if username set it up. Someone else's
+// watch is reported as missing, as if it didn't exist.
+func ownWatch(id, username string) (*dirWatch, bool) {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	w, ok := watches[id]
+	if !ok || w.owner != username {
+		return nil, false
+	}
+	return w, true
+}
+
+// handleUnwatch handles nasx.root.fs.unwatch[.<watchId>] (request-reply).
+func handleUnwatch(nc *nats.Conn, msg *nats.Msg) {
+	var req struct {
+		WatchID       string `json:"watchId"`
+		LinuxUsername string `json:"linuxUsername"` // must be the watch's owner
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		replyErr(nc, msg.Reply, &fsError{Code: "ERR", Message: err.Error()})
+		return
+	}
+	if id, ok := strings.CutPrefix(msg.Subject, "nasx.root.fs.unwatch."); ok {
+		req.WatchID = id
+	}
+	w, ok := ownWatch(req.WatchID, req.LinuxUsername)
+	if !ok {
+		replyErr(nc, msg.Reply, noSuchWatch(req.WatchID))
+		return
+	}
+	w.stop()
+	replyOk(nc, msg.Reply, map[string]bool{"ok": true})
+}